@@ -0,0 +1,81 @@
+package turnstile
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AdminAccess controls access to every introspection endpoint of the plugin
+// (metrics, admin API, debug handlers). It is disabled by default.
+type AdminAccess struct {
+	Enabled bool `yaml:"enabled"`
+	// AllowedCIDRs are the client networks allowed to reach admin endpoints, if not provided, only loopback addresses will be allowed
+	AllowedCIDRs []string `yaml:"allowedcidrs"`
+	// Token is required as a bearer token on every admin request when set
+	Token string `yaml:"token"`
+}
+
+var loopbackCIDRs = []string{"127.0.0.0/8", "::1/128"}
+
+// adminGuard is the single component enforcing AdminAccess, every diagnostic
+// handler must be wrapped by it so enabling one feature can't expose another.
+type adminGuard struct {
+	enabled  bool
+	networks []*net.IPNet
+	token    string
+}
+
+func newAdminGuard(config AdminAccess) (*adminGuard, error) {
+	cidrs := config.AllowedCIDRs
+	if len(cidrs) == 0 {
+		cidrs = loopbackCIDRs
+	}
+	networks, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid adminaccess.allowedcidrs: %w", err)
+	}
+	token, err := resolveSecretRef("adminaccess.token", config.Token)
+	if err != nil {
+		return nil, err
+	}
+	return &adminGuard{
+		enabled:  config.Enabled,
+		networks: networks,
+		token:    token,
+	}, nil
+}
+
+// protect wraps an admin handler with the access checks.
+func (g *adminGuard) protect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !g.enabled {
+			http.NotFound(rw, req)
+			return
+		}
+		if !containsIP(g.networks, clientIP(req)) {
+			errorHandler(rw, req, http.StatusForbidden, "Forbidden")
+			return
+		}
+		if g.token != "" {
+			token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				errorHandler(rw, req, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+		}
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// serveAdmin starts an admin listener of the middleware instance name on addr,
+// refusing to do so while admin access is disabled.
+func (g *adminGuard) serveAdmin(option, addr, name string, mux *http.ServeMux) error {
+	if !g.enabled {
+		return fmt.Errorf("%s requires adminaccess.enabled", option)
+	}
+	return serveOn(addr, name, g.protect(mux))
+}
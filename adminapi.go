@@ -0,0 +1,170 @@
+package turnstile
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// enforcement modes of a middleware instance
+const (
+	modeEnforce = "enforce"
+	modeShadow  = "shadow"
+)
+
+// enforcementMode switches an instance between enforcing decisions and only
+// recording them. It is shared by every handler of an instance.
+type enforcementMode struct {
+	shadow atomic.Bool
+}
+
+func newEnforcementMode(value string) (*enforcementMode, error) {
+	m := &enforcementMode{}
+	if err := m.set(value); err != nil {
+		return nil, fmt.Errorf("invalid mode: %w", err)
+	}
+	return m, nil
+}
+
+func (m *enforcementMode) set(value string) error {
+	switch strings.ToLower(value) {
+	case "", modeEnforce:
+		m.shadow.Store(false)
+	case modeShadow:
+		m.shadow.Store(true)
+	default:
+		return fmt.Errorf("%q is neither enforce nor shadow", value)
+	}
+	return nil
+}
+
+func (m *enforcementMode) String() string {
+	if m.shadow.Load() {
+		return modeShadow
+	}
+	return modeEnforce
+}
+
+// adminAPI manages a middleware instance at runtime. Changes are lost when
+// Traefik reloads the configuration and creates a new instance.
+type adminAPI struct {
+	routes *liveRoutes
+	mode   *enforcementMode
+	store  counterStore
+	stats  *decisionStats
+}
+
+type routerInfo struct {
+	Route    string `json:"route"`
+	Priority int    `json:"priority"`
+	Group    string `json:"group,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Excluded bool   `json:"excluded,omitempty"`
+	Fallback bool   `json:"fallback,omitempty"`
+}
+
+func (api *adminAPI) handler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routers", api.serveRouters)
+	mux.HandleFunc("/mode", api.serveMode)
+	mux.HandleFunc("/cache/flush", api.serveFlush)
+	mux.HandleFunc("/stats", api.serveStats)
+	return mux
+}
+
+// serveRouters lists the routers in the order they are matched.
+func (api *adminAPI) serveRouters(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodGet) {
+		return
+	}
+	matcher := api.routes.load()
+	routers := []routerInfo{}
+	for i := range matcher.excluded.routers {
+		r := &matcher.excluded.routers[i]
+		routers = append(routers, routerInfo{Route: r.label(), Priority: r.Priority, Group: r.Group, Excluded: true})
+	}
+	for i := range matcher.routers.routers {
+		r := &matcher.routers.routers[i]
+		routers = append(routers, routerInfo{Route: r.label(), Priority: r.Priority, Group: r.Group, Action: r.action})
+	}
+	if matcher.fallback != nil {
+		routers = append(routers, routerInfo{Route: matcher.fallback.label(), Action: matcher.fallback.action, Fallback: true})
+	}
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"routers": routers})
+}
+
+// serveMode reports the enforcement mode, PUT {"mode": "shadow"} changes it.
+func (api *adminAPI) serveMode(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		var body struct {
+			Mode string `json:"mode"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 1024)).Decode(&body); err != nil || body.Mode == "" {
+			errorHandler(rw, req, http.StatusBadRequest, `Expected {"mode": "enforce"} or {"mode": "shadow"}`)
+			return
+		}
+		if err := api.mode.set(body.Mode); err != nil {
+			errorHandler(rw, req, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	writeJSON(rw, http.StatusOK, map[string]string{"mode": api.mode.String()})
+}
+
+// serveFlush drops the request counters used for abuse tracking.
+func (api *adminAPI) serveFlush(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodPost) {
+		return
+	}
+	api.store.flush()
+	writeJSON(rw, http.StatusOK, map[string]bool{"flushed": true})
+}
+
+// serveStats reports the decisions of the last 1, 5 and 15 minutes by reason.
+func (api *adminAPI) serveStats(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodGet) {
+		return
+	}
+	now := time.Now()
+	windows := map[string]interface{}{}
+	for _, minutes := range []int{1, 5, statsMinutes} {
+		counts := api.stats.since(minutes, now)
+		var allowed, rejected uint64
+		for reason, n := range counts {
+			if reason.allows() {
+				allowed += n
+			} else {
+				rejected += n
+			}
+		}
+		windows[fmt.Sprintf("%dm", minutes)] = map[string]interface{}{
+			"allowed":  allowed,
+			"rejected": rejected,
+			"reasons":  counts,
+		}
+	}
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"mode": api.mode.String(), "decisions": windows})
+}
+
+func allowMethod(rw http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	rw.Header().Set("Allow", strings.Join(methods, ", "))
+	errorHandler(rw, req, http.StatusMethodNotAllowed, "Method not allowed")
+	return false
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(value)
+}
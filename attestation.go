@@ -0,0 +1,194 @@
+package turnstile
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAttestationPath   = "/turnstile/attest"
+	defaultClearanceHeader   = "X-Turnstile-Clearance"
+	maxAttestationRequestLen = 64 << 10
+)
+
+// AttestationConfig enables the endpoint exchanging a platform attestation
+// verdict for a clearance, for native apps that cannot render the widget.
+type AttestationConfig struct {
+	// Path is the endpoint the app backend posts verdicts to, if not provided, /turnstile/attest will be used
+	Path string `yaml:"path"`
+	// Token authenticates the app backend as a bearer token, it may be a ${env:NAME} reference
+	Token string `yaml:"token"`
+	// AppIDs are the accepted Android package names and iOS app IDs, if not provided, any app will be accepted
+	AppIDs []string `yaml:"appids"`
+	// Header is the request header apps send the clearance in, if not provided, X-Turnstile-Clearance will be used
+	Header string `yaml:"header"`
+}
+
+// attestationRequest is posted by the app backend after it verified the
+// attestation of the app with Apple or Google.
+type attestationRequest struct {
+	// Platform is "android" (Play Integrity) or "ios" (App Attest)
+	Platform string `json:"platform"`
+	// ClientIP is the address of the device, required when sessions are bound to client addresses
+	ClientIP string `json:"client_ip"`
+	// Verdict is the decoded Play Integrity payload or the App Attest verdict
+	Verdict json.RawMessage `json:"verdict"`
+}
+
+// playIntegrityVerdict holds the fields of a decoded Play Integrity payload the gate relies on.
+type playIntegrityVerdict struct {
+	AppIntegrity struct {
+		AppRecognitionVerdict string `json:"appRecognitionVerdict"`
+		PackageName           string `json:"packageName"`
+	} `json:"appIntegrity"`
+	DeviceIntegrity struct {
+		DeviceRecognitionVerdict []string `json:"deviceRecognitionVerdict"`
+	} `json:"deviceIntegrity"`
+}
+
+// appAttestVerdict is the outcome of an App Attest assertion checked by the app backend.
+type appAttestVerdict struct {
+	Verified bool   `json:"verified"`
+	AppID    string `json:"appId"`
+}
+
+// attestationResponse carries the clearance the app sends on protected requests.
+type attestationResponse struct {
+	Clearance string `json:"clearance"`
+	Header    string `json:"header"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+// attestationExchange issues session clearances for attested apps.
+type attestationExchange struct {
+	path     string
+	token    string
+	appIDs   map[string]bool
+	sessions *sessionManager
+}
+
+// newAttestationExchange returns nil when the endpoint is not configured.
+func newAttestationExchange(config *Config, sessions *sessionManager) (*attestationExchange, error) {
+	if config.Attestation == nil {
+		return nil, nil
+	}
+	if sessions == nil {
+		return nil, errors.New("attestation requires sessionttl, clearances are verification sessions")
+	}
+	token, err := resolveSecretRef("attestation.token", config.Attestation.Token)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, errors.New("attestation.token cannot be empty")
+	}
+	e := &attestationExchange{
+		path:     config.Attestation.Path,
+		token:    token,
+		sessions: sessions,
+	}
+	if e.path == "" {
+		e.path = defaultAttestationPath
+	}
+	if len(config.Attestation.AppIDs) > 0 {
+		e.appIDs = make(map[string]bool, len(config.Attestation.AppIDs))
+		for _, id := range config.Attestation.AppIDs {
+			e.appIDs[id] = true
+		}
+	}
+	return e, nil
+}
+
+func (e *attestationExchange) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		errorHandler(rw, req, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(e.token)) != 1 {
+		errorHandler(rw, req, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var attestation attestationRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxAttestationRequestLen)).Decode(&attestation); err != nil {
+		errorHandler(rw, req, http.StatusBadRequest, "Malformed attestation request")
+		return
+	}
+	if err := e.check(&attestation); err != nil {
+		errorHandler(rw, req, http.StatusForbidden, err.Error())
+		return
+	}
+
+	ip := net.ParseIP(attestation.ClientIP)
+	if e.sessions.ipBinding != sessionIPBindingOff && ip == nil {
+		errorHandler(rw, req, http.StatusBadRequest, "client_ip is required when sessions are bound to client addresses")
+		return
+	}
+	now := time.Now()
+	claims := &sessionClaims{IssuedAt: now.Unix(), ExpiresAt: now.Add(e.sessions.ttl).Unix(), IP: e.sessions.bindIP(ip)}
+	clearance, err := e.sessions.encode(claims)
+	if err != nil {
+		errorHandler(rw, req, http.StatusInternalServerError, "Failed to issue clearance")
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(rw).Encode(attestationResponse{
+		Clearance: clearance,
+		Header:    e.sessions.header,
+		ExpiresIn: int64(e.sessions.ttl.Seconds()),
+	})
+}
+
+// check applies the trust gate equivalent to a solved challenge: a genuine,
+// store-recognized app on a device passing integrity checks.
+func (e *attestationExchange) check(attestation *attestationRequest) error {
+	var appID string
+	switch attestation.Platform {
+	case "android":
+		var verdict playIntegrityVerdict
+		if err := json.Unmarshal(attestation.Verdict, &verdict); err != nil {
+			return errors.New("malformed Play Integrity verdict")
+		}
+		if verdict.AppIntegrity.AppRecognitionVerdict != "PLAY_RECOGNIZED" {
+			return errors.New("app is not recognized by Google Play")
+		}
+		if !containsString(verdict.DeviceIntegrity.DeviceRecognitionVerdict, "MEETS_DEVICE_INTEGRITY") {
+			return errors.New("device does not meet integrity requirements")
+		}
+		appID = verdict.AppIntegrity.PackageName
+	case "ios":
+		var verdict appAttestVerdict
+		if err := json.Unmarshal(attestation.Verdict, &verdict); err != nil {
+			return errors.New("malformed App Attest verdict")
+		}
+		if !verdict.Verified {
+			return errors.New("App Attest assertion was not verified")
+		}
+		appID = verdict.AppID
+	default:
+		return fmt.Errorf("unsupported platform %q", attestation.Platform)
+	}
+	if e.appIDs != nil && !e.appIDs[appID] {
+		return fmt.Errorf("app %q is not accepted", appID)
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
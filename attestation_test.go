@@ -0,0 +1,108 @@
+package turnstile
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testAttestationToken = "app-backend-token"
+
+func newTestAttestation(t *testing.T, binding string) *attestationExchange {
+	t.Helper()
+	attestation := &AttestationConfig{Token: testAttestationToken, AppIDs: []string{"com.example.app", "TEAMID.com.example.app"}}
+	sessions := newTestSessions(t, func(config *Config) {
+		config.Attestation = attestation
+		config.SessionIPBinding = binding
+	})
+	e, err := newAttestationExchange(&Config{Attestation: attestation}, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// playIntegrity returns an attestation request of an Android app.
+func playIntegrity(recognition, packageName, clientIP string, device ...string) string {
+	verdict := playIntegrityVerdict{}
+	verdict.AppIntegrity.AppRecognitionVerdict = recognition
+	verdict.AppIntegrity.PackageName = packageName
+	verdict.DeviceIntegrity.DeviceRecognitionVerdict = device
+	raw, _ := json.Marshal(verdict)
+	body, _ := json.Marshal(attestationRequest{Platform: "android", ClientIP: clientIP, Verdict: raw})
+	return string(body)
+}
+
+func TestAttestationExchange(t *testing.T) {
+	ios, _ := json.Marshal(appAttestVerdict{Verified: true, AppID: "TEAMID.com.example.app"})
+	unverifiedIOS, _ := json.Marshal(appAttestVerdict{Verified: false, AppID: "TEAMID.com.example.app"})
+	iosRequest := func(verdict []byte) string {
+		body, _ := json.Marshal(attestationRequest{Platform: "ios", Verdict: verdict})
+		return string(body)
+	}
+	tests := []struct {
+		name, binding, method, token, body string
+		status                             int
+	}{
+		{"android", "off", http.MethodPost, testAttestationToken, playIntegrity("PLAY_RECOGNIZED", "com.example.app", "", "MEETS_DEVICE_INTEGRITY"), http.StatusOK},
+		{"ios", "off", http.MethodPost, testAttestationToken, iosRequest(ios), http.StatusOK},
+		{"GET", "off", http.MethodGet, testAttestationToken, "", http.StatusMethodNotAllowed},
+		{"missing bearer token", "off", http.MethodPost, "", playIntegrity("PLAY_RECOGNIZED", "com.example.app", "", "MEETS_DEVICE_INTEGRITY"), http.StatusUnauthorized},
+		{"bad bearer token", "off", http.MethodPost, "another-token", playIntegrity("PLAY_RECOGNIZED", "com.example.app", "", "MEETS_DEVICE_INTEGRITY"), http.StatusUnauthorized},
+		{"malformed request", "off", http.MethodPost, testAttestationToken, "{", http.StatusBadRequest},
+		{"unrecognized app", "off", http.MethodPost, testAttestationToken, playIntegrity("UNRECOGNIZED_VERSION", "com.example.app", "", "MEETS_DEVICE_INTEGRITY"), http.StatusForbidden},
+		{"basic integrity only", "off", http.MethodPost, testAttestationToken, playIntegrity("PLAY_RECOGNIZED", "com.example.app", "", "MEETS_BASIC_INTEGRITY"), http.StatusForbidden},
+		{"no device verdict", "off", http.MethodPost, testAttestationToken, playIntegrity("PLAY_RECOGNIZED", "com.example.app", ""), http.StatusForbidden},
+		{"app outside appids", "off", http.MethodPost, testAttestationToken, playIntegrity("PLAY_RECOGNIZED", "com.example.other", "", "MEETS_DEVICE_INTEGRITY"), http.StatusForbidden},
+		{"unverified ios assertion", "off", http.MethodPost, testAttestationToken, iosRequest(unverifiedIOS), http.StatusForbidden},
+		{"unsupported platform", "off", http.MethodPost, testAttestationToken, `{"platform":"windows","verdict":{}}`, http.StatusForbidden},
+		{"missing client_ip under ip binding", "strict", http.MethodPost, testAttestationToken, playIntegrity("PLAY_RECOGNIZED", "com.example.app", "", "MEETS_DEVICE_INTEGRITY"), http.StatusBadRequest},
+		{"client_ip under ip binding", "strict", http.MethodPost, testAttestationToken, playIntegrity("PLAY_RECOGNIZED", "com.example.app", "192.0.2.10", "MEETS_DEVICE_INTEGRITY"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		e := newTestAttestation(t, tt.binding)
+		req := httptest.NewRequest(tt.method, e.path, strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rw := httptest.NewRecorder()
+		e.ServeHTTP(rw, req)
+		if rw.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rw.Code, tt.status, rw.Body)
+		}
+	}
+}
+
+// The clearance is a session the app presents in the clearance header.
+func TestAttestationClearanceValidates(t *testing.T) {
+	e := newTestAttestation(t, "strict")
+	req := httptest.NewRequest(http.MethodPost, e.path, strings.NewReader(playIntegrity("PLAY_RECOGNIZED", "com.example.app", "192.0.2.10", "MEETS_DEVICE_INTEGRITY")))
+	req.Header.Set("Authorization", "Bearer "+testAttestationToken)
+	rw := httptest.NewRecorder()
+	e.ServeHTTP(rw, req)
+	var resp attestationResponse
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header != defaultClearanceHeader || resp.Clearance == "" {
+		t.Fatalf("response = %+v", resp)
+	}
+
+	tests := []struct {
+		name, remoteIP, clearance string
+		want                      bool
+	}{
+		{"from the attested device", "192.0.2.10", resp.Clearance, true},
+		{"from another address", "198.51.100.7", resp.Clearance, false},
+		{"tampered", "192.0.2.10", resp.Clearance + "x", false},
+	}
+	for _, tt := range tests {
+		protected := sessionRequest(e.sessions, "", tt.remoteIP)
+		protected.Header.Set(resp.Header, tt.clearance)
+		if _, ok := e.sessions.validate(protected); ok != tt.want {
+			t.Errorf("%s: valid = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package turnstile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// auditLogStdout selects the standard output stream as audit log
+	auditLogStdout = "stdout"
+	// auditReopenInterval limits how often the audit file is checked for rotation
+	auditReopenInterval = time.Second
+)
+
+// Traefik calls New again on every configuration reload, so audit files are
+// shared per path and records of every instance are appended in order.
+var (
+	auditFilesMu sync.Mutex
+	auditFiles   = map[string]*auditFile{}
+)
+
+// decisionRecord describes a decision in a line of the audit log and in
+// published events.
+type decisionRecord struct {
+	Time        string   `json:"time"`
+	Middleware  string   `json:"middleware"`
+	RequestID   string   `json:"request_id,omitempty"`
+	ClientIP    string   `json:"client_ip"`
+	Method      string   `json:"method"`
+	Host        string   `json:"host"`
+	Path        string   `json:"path"`
+	Route       string   `json:"route"`
+	Decision    string   `json:"decision"`
+	Reason      Reason   `json:"reason"`
+	Status      int      `json:"status,omitempty"`
+	ErrorCodes  []string `json:"error_codes,omitempty"`
+	ChallengeTS string   `json:"challenge_ts,omitempty"`
+	Shadow      bool     `json:"shadow,omitempty"`
+}
+
+// auditLog appends a JSON line for every decision to a file or to stdout.
+type auditLog struct {
+	out io.Writer
+	// mu serializes writes to stdout, files serialize their own writes
+	mu sync.Mutex
+}
+
+// newAuditLog returns nil when no audit log is configured.
+func newAuditLog(config *Config) (*auditLog, error) {
+	switch config.AuditLog {
+	case "":
+		return nil, nil
+	case auditLogStdout:
+		return &auditLog{out: os.Stdout}, nil
+	}
+	f, err := openAuditFile(config.AuditLog)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{out: f}, nil
+}
+
+// newDecisionRecord returns the record of d, shadow tells whether the
+// middleware runs in shadow mode.
+func newDecisionRecord(req *http.Request, router *Router, d *decision, shadow bool, name string) *decisionRecord {
+	record := &decisionRecord{
+		Time:        time.Now().UTC().Format(time.RFC3339Nano),
+		Middleware:  name,
+		RequestID:   requestIDFromContext(req.Context()),
+		ClientIP:    clientIP(req).String(),
+		Method:      req.Method,
+		Host:        req.Host,
+		Path:        req.URL.Path,
+		Route:       router.label(),
+		Decision:    d.outcome(),
+		Reason:      d.Reason,
+		ErrorCodes:  d.ErrorCodes,
+		ChallengeTS: d.ChallengeTS,
+		Shadow:      shadow && !d.Allowed,
+	}
+	if !d.Allowed {
+		record.Status = d.Status
+	}
+	return record
+}
+
+// write appends a record. Records are written synchronously, an audit log
+// must not lose entries under load.
+func (l *auditLog) write(record *decisionRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		logger().Error("failed to write audit record", "error", err)
+	}
+}
+
+// auditFile is an append-only file reopened when it is moved away, so it
+// works with external log rotation.
+type auditFile struct {
+	path string
+
+	mu        sync.Mutex
+	f         *os.File
+	checkedAt time.Time
+}
+
+// openAuditFile returns the shared audit file of path, opening it on first use.
+func openAuditFile(path string) (*auditFile, error) {
+	auditFilesMu.Lock()
+	defer auditFilesMu.Unlock()
+	if a, ok := auditFiles[path]; ok {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auditlog: %w", err)
+	}
+	a := &auditFile{path: path, f: f, checkedAt: time.Now()}
+	auditFiles[path] = a
+	return a, nil
+}
+
+func (a *auditFile) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now := time.Now(); now.Sub(a.checkedAt) >= auditReopenInterval {
+		a.checkedAt = now
+		a.reopenIfRotated()
+	}
+	return a.f.Write(p)
+}
+
+// reopenIfRotated opens path again when the open file no longer is the file at path.
+func (a *auditFile) reopenIfRotated() {
+	current, err := a.f.Stat()
+	if err != nil {
+		return
+	}
+	if info, err := os.Stat(a.path); err == nil && os.SameFile(current, info) {
+		return
+	}
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		logger().Error("failed to reopen audit log, appending to the rotated file", "file", a.path, "error", err)
+		return
+	}
+	a.f.Close()
+	a.f = f
+}
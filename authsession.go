@@ -0,0 +1,106 @@
+package turnstile
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AuthSessionConfig skips verification for users already signed in to the
+// application, so they are not challenged again on every form.
+type AuthSessionConfig struct {
+	// Cookie is the application session cookie
+	Cookie string `yaml:"cookie"`
+	// Header carries the application session, e.g. Authorization, a Bearer prefix is ignored
+	Header string `yaml:"header"`
+	// PublicKey is a PEM encoded RSA, ECDSA or Ed25519 public key, when set, the session must be a JWT
+	// signed with it that has not expired, otherwise its presence is enough
+	PublicKey string `yaml:"publickey"`
+}
+
+// authSessionClaims are the registered JWT claims checked on a signed session.
+type authSessionClaims struct {
+	ExpiresAt *json.Number `json:"exp"`
+	NotBefore *json.Number `json:"nbf"`
+}
+
+// authSession admits requests carrying an application session.
+type authSession struct {
+	cookie    string
+	header    string
+	publicKey crypto.PublicKey
+}
+
+// newAuthSession returns nil when no application session is configured.
+func newAuthSession(config *Config) (*authSession, error) {
+	if config.AuthSession == nil {
+		return nil, nil
+	}
+	if config.AuthSession.Cookie == "" && config.AuthSession.Header == "" {
+		return nil, errors.New("authsession requires cookie or header")
+	}
+	s := &authSession{cookie: config.AuthSession.Cookie, header: config.AuthSession.Header}
+	if config.AuthSession.PublicKey != "" {
+		key, err := parsePublicKey("authsession.publickey", config.AuthSession.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		s.publicKey = key
+	}
+	return s, nil
+}
+
+// allows reports whether req carries an application session, a valid JWT
+// when a public key is configured.
+func (s *authSession) allows(req *http.Request) bool {
+	if s == nil {
+		return false
+	}
+	if s.cookie != "" {
+		if cookie, err := req.Cookie(s.cookie); err == nil && s.valid(cookie.Value) {
+			return true
+		}
+	}
+	if s.header != "" {
+		value := strings.TrimSpace(req.Header.Get(s.header))
+		if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+			value = strings.TrimSpace(value[7:])
+		}
+		return s.valid(value)
+	}
+	return false
+}
+
+func (s *authSession) valid(value string) bool {
+	if value == "" {
+		return false
+	}
+	if s.publicKey == nil {
+		return true
+	}
+	payload, err := openJWS(value, s.publicKey)
+	if err != nil {
+		return false
+	}
+	var claims authSessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return false
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt != nil {
+		exp, err := claims.ExpiresAt.Int64()
+		if err != nil || now >= exp {
+			return false
+		}
+	}
+	if claims.NotBefore != nil {
+		nbf, err := claims.NotBefore.Int64()
+		if err != nil || now < nbf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+package turnstile
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publicKeyPEM returns the PEM encoded public key of signer.
+func publicKeyPEM(t *testing.T, signer crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// signJWS returns the compact JWS of claims signed by signer with alg, which
+// is written to the header as given so tests can lie about it.
+func signJWS(t *testing.T, alg string, signer crypto.Signer, claims interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch key := signer.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	default:
+		digest := sha256.Sum256([]byte(signed))
+		if signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthSessionJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := newAuthSession(&Config{AuthSession: &AuthSessionConfig{Header: "Authorization", PublicKey: publicKeyPEM(t, rsaKey)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	valid := map[string]int64{"exp": now + 60}
+	signed := signJWS(t, "RS256", rsaKey, valid)
+	header, payload, signature := splitJWS(signed)
+	tampered, _ := json.Marshal(map[string]int64{"exp": now + 3600})
+	// an HMAC keyed with the public key, the classic algorithm confusion
+	hmacHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	mac := hmac.New(sha256.New, []byte(publicKeyPEM(t, rsaKey)))
+	mac.Write([]byte(hmacHeader + "." + payload))
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+
+	tests := []struct {
+		name, value string
+		want        bool
+	}{
+		{"valid", signed, true},
+		{"without expiry", signJWS(t, "RS256", rsaKey, map[string]string{"sub": "user"}), true},
+		{"wrong key", signJWS(t, "RS256", otherKey, valid), false},
+		{"look-alike algorithm", signJWS(t, "RSX256", rsaKey, valid), false},
+		{"algorithm of another key type", signJWS(t, "ES256", rsaKey, valid), false},
+		{"HS256 keyed with the public key", hmacHeader + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), false},
+		{"alg none", noneHeader + "." + payload + ".", false},
+		{"alg none with the original signature", noneHeader + "." + payload + "." + signature, false},
+		{"expired", signJWS(t, "RS256", rsaKey, map[string]int64{"exp": now - 1}), false},
+		{"not yet valid", signJWS(t, "RS256", rsaKey, map[string]int64{"nbf": now + 60, "exp": now + 120}), false},
+		{"non-numeric expiry", signJWS(t, "RS256", rsaKey, map[string]string{"exp": "tomorrow"}), false},
+		{"tampered payload", header + "." + base64.RawURLEncoding.EncodeToString(tampered) + "." + signature, false},
+		{"not a JWT", "opaque-session", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		if got := session.valid(tt.value); got != tt.want {
+			t.Errorf("%s: valid = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyJWSKeyTypes(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]string{"sub": "user"}
+	tests := []struct {
+		name   string
+		key    crypto.PublicKey
+		signed string
+		want   bool
+	}{
+		{"ES256", p256.Public(), signJWS(t, "ES256", p256, claims), true},
+		{"ES256 on a P-384 key", p384.Public(), signJWS(t, "ES256", p384, claims), false},
+		{"EdDSA", edKey.Public(), signJWS(t, "EdDSA", edKey, claims), true},
+		{"Ed25519 under another name", edKey.Public(), signJWS(t, "Ed25519", edKey, claims), false},
+		{"EdDSA header on an ECDSA key", p256.Public(), signJWS(t, "EdDSA", p256, claims), false},
+	}
+	for _, tt := range tests {
+		_, err := openJWS(tt.signed, tt.key)
+		if (err == nil) != tt.want {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+	// an ECDSA signature must be the fixed-size concatenation of r and s
+	header, payload, _ := splitJWS(signJWS(t, "ES256", p256, claims))
+	oversized := base64.RawURLEncoding.EncodeToString(new(big.Int).Lsh(big.NewInt(1), 520).Bytes())
+	if _, err := openJWS(header+"."+payload+"."+oversized, p256.Public()); err == nil {
+		t.Error("oversized ECDSA signature accepted")
+	}
+}
+
+func splitJWS(compact string) (header, payload, signature string) {
+	header, rest, _ := strings.Cut(compact, ".")
+	payload, signature, _ = strings.Cut(rest, ".")
+	return header, payload, signature
+}
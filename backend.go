@@ -0,0 +1,68 @@
+package turnstile
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// defaultUnverifiedReasons are the reasons sent to the unverified backend
+// when a router does not list them: requests admitted because verification
+// itself was unavailable.
+var defaultUnverifiedReasons = []Reason{ReasonFailOpen, ReasonGrace}
+
+// unverified reports whether requests allowed for reason skipped verification.
+func (r Reason) unverified() bool {
+	switch r {
+	case ReasonGrace, ReasonLowVelocity, ReasonFailOpen:
+		return true
+	default:
+		return false
+	}
+}
+
+// unverifiedBackend proxies requests allowed without verification to an
+// alternate backend, e.g. a hardened or read-only replica.
+type unverifiedBackend struct {
+	proxy   http.Handler
+	reasons []Reason
+}
+
+// newUnverifiedBackend returns nil when the router has no unverified backend.
+func newUnverifiedBackend(r *Router) (*unverifiedBackend, error) {
+	if r.UnverifiedBackend == "" {
+		if len(r.UnverifiedReasons) > 0 {
+			return nil, fmt.Errorf("unverifiedreasons requires unverifiedbackend")
+		}
+		return nil, nil
+	}
+	if err := validateEndpoint("unverifiedbackend", r.UnverifiedBackend); err != nil {
+		return nil, err
+	}
+	target, _ := url.Parse(r.UnverifiedBackend)
+	b := &unverifiedBackend{proxy: httputil.NewSingleHostReverseProxy(target), reasons: defaultUnverifiedReasons}
+	if len(r.UnverifiedReasons) > 0 {
+		b.reasons = make([]Reason, len(r.UnverifiedReasons))
+		for i, value := range r.UnverifiedReasons {
+			b.reasons[i] = Reason(value)
+			if !b.reasons[i].unverified() {
+				return nil, fmt.Errorf("invalid unverifiedreasons: %s is not a reason for admitting unverified requests", value)
+			}
+		}
+	}
+	return b, nil
+}
+
+// serves reports whether requests allowed for reason go to the backend.
+func (b *unverifiedBackend) serves(reason Reason) bool {
+	if b == nil {
+		return false
+	}
+	for _, r := range b.reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
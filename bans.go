@@ -0,0 +1,153 @@
+package turnstile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultBanCooldown = 10 * time.Minute
+
+// BanConfig rejects clients for a cooldown after consecutive failed
+// verifications, without calling siteverify.
+type BanConfig struct {
+	// Failures is the number of consecutive failed verifications of a client IP that bans it
+	Failures int `yaml:"failures"`
+	// Cooldown is how long a banned client is rejected, if not provided, 10m will be used
+	Cooldown string `yaml:"cooldown"`
+	// Status is the status of rejections of banned clients, if not provided, 429 will be used
+	Status int `yaml:"status"`
+}
+
+// banEntry tracks the failures of one client.
+type banEntry struct {
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// banList counts consecutive failed verifications per client IP and bans
+// clients reaching the threshold.
+type banList struct {
+	failures int
+	cooldown time.Duration
+	status   int
+
+	mu      sync.Mutex
+	clients map[string]*banEntry
+}
+
+// newBanList returns nil when bans are not configured.
+func newBanList(config *Config) (*banList, error) {
+	if config.Bans == nil {
+		return nil, nil
+	}
+	if config.Bans.Failures <= 0 {
+		return nil, errors.New("bans.failures must be positive")
+	}
+	b := &banList{
+		failures: config.Bans.Failures,
+		cooldown: defaultBanCooldown,
+		status:   config.Bans.Status,
+		clients:  map[string]*banEntry{},
+	}
+	if config.Bans.Cooldown != "" {
+		cooldown, err := time.ParseDuration(config.Bans.Cooldown)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bans.cooldown: %w", err)
+		}
+		if cooldown <= 0 {
+			return nil, errors.New("bans.cooldown must be positive")
+		}
+		b.cooldown = cooldown
+	}
+	switch {
+	case b.status == 0:
+		b.status = http.StatusTooManyRequests
+	case b.status < 400 || b.status > 599:
+		return nil, fmt.Errorf("invalid bans.status: %d is not an error status", b.status)
+	}
+	return b, nil
+}
+
+// start forgets idle clients until ctx is done.
+func (b *banList) start(ctx context.Context) {
+	if b != nil {
+		background.schedule(ctx, "ban-janitor", storeJanitorInterval, b.expire)
+	}
+}
+
+// banKey returns the client IP of req as the key failures are counted under.
+func (b *banList) banKey(req *http.Request) string {
+	if b == nil {
+		return ""
+	}
+	if ip := clientIP(req); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// remaining returns how long client is still banned, 0 when it is not.
+func (b *banList) remaining(client string) time.Duration {
+	if b == nil || client == "" {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if entry, ok := b.clients[client]; ok {
+		if remaining := time.Until(entry.bannedUntil); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+// fail counts a failed verification of client and reports whether it got banned.
+func (b *banList) fail(client string) bool {
+	if b == nil || client == "" {
+		return false
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.clients[client]
+	if !ok {
+		entry = &banEntry{}
+		b.clients[client] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+	if entry.failures < b.failures {
+		return false
+	}
+	// the count starts over once the ban is served
+	entry.failures = 0
+	entry.bannedUntil = now.Add(b.cooldown)
+	return true
+}
+
+// succeed resets the consecutive failures of client.
+func (b *banList) succeed(client string) {
+	if b == nil || client == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.clients, client)
+}
+
+// expire drops clients that are not banned and have not failed for a cooldown.
+func (b *banList) expire() {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for client, entry := range b.clients {
+		if now.After(entry.bannedUntil) && now.Sub(entry.lastFailure) >= b.cooldown {
+			delete(b.clients, client)
+		}
+	}
+}
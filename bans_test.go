@@ -0,0 +1,101 @@
+package turnstile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBanThreshold(t *testing.T) {
+	b, err := newBanList(&Config{Bans: &BanConfig{Failures: 3, Cooldown: "1m"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const client = "192.0.2.10"
+	for i := 1; i < 3; i++ {
+		if b.fail(client) {
+			t.Fatalf("banned after %d failures, want 3", i)
+		}
+	}
+	// a success resets the consecutive failures
+	b.succeed(client)
+	for i := 1; i < 3; i++ {
+		if b.fail(client) {
+			t.Fatalf("banned after %d failures following a success", i)
+		}
+	}
+	if !b.fail(client) {
+		t.Fatal("not banned after 3 consecutive failures")
+	}
+	if remaining := b.remaining(client); remaining <= 0 || remaining > time.Minute {
+		t.Errorf("remaining = %v, want up to the 1m cooldown", remaining)
+	}
+	if remaining := b.remaining("192.0.2.11"); remaining != 0 {
+		t.Errorf("another client is banned for %v", remaining)
+	}
+}
+
+func TestBanCooldown(t *testing.T) {
+	b, err := newBanList(&Config{Bans: &BanConfig{Failures: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const client = "192.0.2.10"
+	if !b.fail(client) {
+		t.Fatal("not banned after the first failure")
+	}
+	if remaining := b.remaining(client); remaining <= defaultBanCooldown-time.Second {
+		t.Errorf("remaining = %v, want the default %v cooldown", remaining, defaultBanCooldown)
+	}
+	// serve the ban
+	b.mu.Lock()
+	b.clients[client].bannedUntil = time.Now().Add(-time.Second)
+	b.mu.Unlock()
+	if remaining := b.remaining(client); remaining != 0 {
+		t.Errorf("still banned for %v after the cooldown", remaining)
+	}
+	// the count started over, so the next failure bans again
+	if !b.fail(client) {
+		t.Error("not banned again after the cooldown")
+	}
+}
+
+// A banned client is rejected even when a bypass would admit it.
+func TestBansCheckedBeforeBypasses(t *testing.T) {
+	const key = "billing-service-key"
+	sum := sha256.Sum256([]byte(key))
+	config := CreateConfig()
+	config.TurnstileSecret = "secret"
+	config.LogLevel = "error"
+	config.Bans = &BanConfig{Failures: 1}
+	config.BypassAPIKeys = &BypassAPIKeysConfig{Keys: []string{hex.EncodeToString(sum[:])}}
+	config.Routers = []Router{{Method: http.MethodPost, Path: "/api/submit"}}
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}), config, "bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/api/submit", nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set(defaultBypassAPIKeyHeader, key)
+		return req
+	}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, request())
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("status before the ban = %d, want the bypass to admit the request", rw.Code)
+	}
+	handler.(*turnstile).bans.fail("192.0.2.10")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, request())
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("status of the banned client = %d, want %d", rw.Code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,170 @@
+package turnstile
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	botLookupTimeout = 2 * time.Second
+	// verified crawlers are cached longer than failed lookups, which may be transient
+	botVerifiedTTL   = 24 * time.Hour
+	botUnverifiedTTL = time.Hour
+	botCacheMax      = 10000
+)
+
+// searchBot identifies a crawler by its User-Agent and the domains its
+// addresses resolve to, as documented by the search engine.
+type searchBot struct {
+	userAgent string
+	domains   []string
+}
+
+// knownBots are the crawlers verifiedbots can name.
+var knownBots = map[string]searchBot{
+	"googlebot": {userAgent: "googlebot", domains: []string{".googlebot.com", ".google.com"}},
+	"bingbot":   {userAgent: "bingbot", domains: []string{".search.msn.com"}},
+	"applebot":  {userAgent: "applebot", domains: []string{".applebot.apple.com"}},
+}
+
+// botLookup is a cached verification result for a crawler and client address.
+type botLookup struct {
+	verified bool
+	expires  time.Time
+}
+
+// verifiedBots admits GET and HEAD requests of search engine crawlers whose
+// address passes forward-confirmed reverse DNS.
+type verifiedBots struct {
+	bots     []searchBot
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	cache map[string]botLookup
+}
+
+// newVerifiedBots returns nil when no crawlers are configured.
+func newVerifiedBots(config *Config) (*verifiedBots, error) {
+	if len(config.VerifiedBots) == 0 {
+		return nil, nil
+	}
+	var problems configErrors
+	v := &verifiedBots{resolver: net.DefaultResolver, cache: map[string]botLookup{}}
+	for _, name := range config.VerifiedBots {
+		bot, ok := knownBots[strings.ToLower(name)]
+		if !ok {
+			problems.add(fmt.Errorf("invalid verifiedbots: unknown crawler %q", name))
+			continue
+		}
+		v.bots = append(v.bots, bot)
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// start expires cached lookups until ctx is done.
+func (v *verifiedBots) start(ctx context.Context) {
+	if v != nil {
+		background.schedule(ctx, "bot-cache-janitor", storeJanitorInterval, v.expire)
+	}
+}
+
+// allows reports whether req is a safe request of a verified crawler.
+func (v *verifiedBots) allows(req *http.Request) bool {
+	if v == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+	userAgent := strings.ToLower(req.UserAgent())
+	for _, bot := range v.bots {
+		if strings.Contains(userAgent, bot.userAgent) {
+			return v.verify(req.Context(), clientIP(req), bot)
+		}
+	}
+	return false
+}
+
+// verify checks that ip reverse-resolves to a domain of bot and that the
+// name resolves back to ip, caching the result.
+func (v *verifiedBots) verify(ctx context.Context, ip net.IP, bot searchBot) bool {
+	if ip == nil {
+		return false
+	}
+	// an address verified as one crawler must not pass as another
+	key := bot.userAgent + " " + ip.String()
+	now := time.Now()
+	v.mu.Lock()
+	lookup, ok := v.cache[key]
+	v.mu.Unlock()
+	if ok && now.Before(lookup.expires) {
+		return lookup.verified
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, botLookupTimeout)
+	defer cancel()
+	verified := v.confirm(ctx, ip, bot)
+	if ctx.Err() != nil && !verified {
+		// the lookup was cut short, do not remember it
+		return false
+	}
+	lookup = botLookup{verified: verified, expires: now.Add(botUnverifiedTTL)}
+	if verified {
+		lookup.expires = now.Add(botVerifiedTTL)
+	}
+	v.mu.Lock()
+	if len(v.cache) < botCacheMax {
+		v.cache[key] = lookup
+	}
+	v.mu.Unlock()
+	return verified
+}
+
+func (v *verifiedBots) confirm(ctx context.Context, ip net.IP, bot searchBot) bool {
+	names, err := v.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !hasAnySuffix(name, bot.domains) {
+			continue
+		}
+		addrs, err := v.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasAnySuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// expire drops cached lookups past their expiry.
+func (v *verifiedBots) expire() {
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, lookup := range v.cache {
+		if !now.Before(lookup.expires) {
+			delete(v.cache, key)
+		}
+	}
+}
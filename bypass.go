@@ -0,0 +1,334 @@
+package turnstile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBypassSignatureHeader = "X-Turnstile-Bypass"
+	defaultBypassSignatureMaxAge = 5 * time.Minute
+	minBypassSignatureKeyLen     = 16
+)
+
+// BypassSignatureConfig lets trusted internal callers skip verification with
+// a header signed by a shared key, e.g. services and end-to-end test runners.
+type BypassSignatureConfig struct {
+	// Header carries the signature, if not provided, X-Turnstile-Bypass will be used
+	Header string `yaml:"header"`
+	// Key is the shared HMAC key of at least 16 bytes, it may be a ${env:NAME} reference
+	Key string `yaml:"key"`
+	// MaxAge is how far the signed timestamp may be from now, if not provided, 5m will be used
+	MaxAge string `yaml:"maxage"`
+}
+
+// signedBypass checks bypass headers of the form "t=<unix time>,sig=<hex HMAC-SHA256>",
+// signing the timestamp, a dot and the request path.
+type signedBypass struct {
+	header string
+	key    []byte
+	maxAge time.Duration
+}
+
+// newSignedBypass returns nil when the bypass header is not configured.
+func newSignedBypass(config *Config) (*signedBypass, error) {
+	if config.BypassSignature == nil {
+		return nil, nil
+	}
+	key, err := resolveSecretRef("bypasssignature.key", config.BypassSignature.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < minBypassSignatureKeyLen {
+		return nil, fmt.Errorf("bypasssignature.key must be at least %d bytes", minBypassSignatureKeyLen)
+	}
+	b := &signedBypass{
+		header: config.BypassSignature.Header,
+		key:    []byte(key),
+		maxAge: defaultBypassSignatureMaxAge,
+	}
+	if b.header == "" {
+		b.header = defaultBypassSignatureHeader
+	}
+	if config.BypassSignature.MaxAge != "" {
+		b.maxAge, err = time.ParseDuration(config.BypassSignature.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bypasssignature.maxage: %w", err)
+		}
+		if b.maxAge <= 0 {
+			return nil, errors.New("bypasssignature.maxage must be positive")
+		}
+	}
+	return b, nil
+}
+
+// allows reports whether req carries a valid, fresh bypass signature for its path.
+func (b *signedBypass) allows(req *http.Request) bool {
+	if b == nil {
+		return false
+	}
+	value := req.Header.Get(b.header)
+	if value == "" {
+		return false
+	}
+	var timestamp, signature string
+	for _, part := range strings.Split(value, ",") {
+		name, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "t":
+			timestamp = v
+		case "sig":
+			signature = v
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > b.maxAge || age < -b.maxAge {
+		return false
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, b.sign(timestamp, req.URL.Path))
+}
+
+func (b *signedBypass) sign(timestamp, path string) []byte {
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte(timestamp + "." + path))
+	return mac.Sum(nil)
+}
+
+const defaultClientCertHeader = "X-Forwarded-Tls-Client-Cert"
+
+// ClientCertConfig lets machine-to-machine callers presenting a trusted client
+// certificate skip verification.
+type ClientCertConfig struct {
+	// Header carries the certificate forwarded by Traefik's PassTLSClientCert middleware with pem enabled,
+	// if not provided, X-Forwarded-Tls-Client-Cert will be used
+	Header string `yaml:"header"`
+	// TrustedProxies are the CIDRs of the proxies allowed to forward the header, if not provided, the header is ignored
+	TrustedProxies []string `yaml:"trustedproxies"`
+	// CAFile is the path of the PEM bundle of the CAs issuing trusted certificates, required by subjects
+	CAFile string `yaml:"cafile"`
+	// Subjects are the trusted certificate subjects in RFC 2253 form, e.g. CN=billing,O=Example
+	Subjects []string `yaml:"subjects"`
+	// Fingerprints are the hex SHA-256 fingerprints of trusted certificates, colons are ignored
+	Fingerprints []string `yaml:"fingerprints"`
+}
+
+// clientCertBypass admits requests whose client certificate is trusted by
+// subject or fingerprint.
+type clientCertBypass struct {
+	header  string
+	proxies []*net.IPNet
+	// roots verifies the chain of every certificate, nil when cafile is not configured
+	roots        *x509.CertPool
+	subjects     map[string]bool
+	fingerprints map[string]bool
+}
+
+// newClientCertBypass returns nil when client certificates are not configured.
+func newClientCertBypass(config *Config) (*clientCertBypass, error) {
+	if config.ClientCerts == nil {
+		return nil, nil
+	}
+	if len(config.ClientCerts.Subjects) == 0 && len(config.ClientCerts.Fingerprints) == 0 {
+		return nil, errors.New("clientcerts requires subjects or fingerprints")
+	}
+	// anyone can issue a certificate with a given subject, only a CA makes it trustworthy
+	if len(config.ClientCerts.Subjects) > 0 && config.ClientCerts.CAFile == "" {
+		return nil, errors.New("clientcerts.subjects requires clientcerts.cafile")
+	}
+	proxies, err := parseCIDRs(config.ClientCerts.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clientcerts.trustedproxies: %w", err)
+	}
+	b := &clientCertBypass{
+		header:       config.ClientCerts.Header,
+		subjects:     make(map[string]bool, len(config.ClientCerts.Subjects)),
+		proxies:      proxies,
+		fingerprints: make(map[string]bool, len(config.ClientCerts.Fingerprints)),
+	}
+	if b.header == "" {
+		b.header = defaultClientCertHeader
+	}
+	if config.ClientCerts.CAFile != "" {
+		content, err := os.ReadFile(config.ClientCerts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clientcerts.cafile: %w", err)
+		}
+		b.roots = x509.NewCertPool()
+		if !b.roots.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("invalid clientcerts.cafile: no certificate found in %s", config.ClientCerts.CAFile)
+		}
+	}
+	for _, subject := range config.ClientCerts.Subjects {
+		b.subjects[strings.TrimSpace(subject)] = true
+	}
+	var problems configErrors
+	for _, fingerprint := range config.ClientCerts.Fingerprints {
+		normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+		if decoded, err := hex.DecodeString(normalized); err != nil || len(decoded) != sha256.Size {
+			problems.add(fmt.Errorf("invalid clientcerts.fingerprints: %s is not a SHA-256 fingerprint", fingerprint))
+			continue
+		}
+		b.fingerprints[normalized] = true
+	}
+	return b, problems.err()
+}
+
+// allows reports whether the client certificate of req is trusted.
+func (b *clientCertBypass) allows(req *http.Request) bool {
+	if b == nil {
+		return false
+	}
+	chain := b.chain(req)
+	if len(chain) == 0 || !b.verify(chain) {
+		return false
+	}
+	cert := chain[0]
+	if b.subjects[cert.Subject.String()] {
+		return true
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	return b.fingerprints[hex.EncodeToString(fingerprint[:])]
+}
+
+// verify checks the chain against the configured CAs, any chain passes without cafile.
+func (b *clientCertBypass) verify(chain []*x509.Certificate) bool {
+	if b.roots == nil {
+		return true
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         b.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// chain returns the certificates of the TLS connection, leaf first, or the
+// ones forwarded in the header when a trusted proxy terminated TLS in front of
+// the plugin. Certificates are public, so a header from anywhere else is ignored.
+func (b *clientCertBypass) chain(req *http.Request) []*x509.Certificate {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return req.TLS.PeerCertificates
+	}
+	if !containsIP(b.proxies, clientIP(req)) {
+		return nil
+	}
+	value := req.Header.Get(b.header)
+	if value == "" {
+		return nil
+	}
+	// PathUnescape keeps a literal + of unescaped base64 intact
+	unescaped, err := url.PathUnescape(value)
+	if err != nil {
+		return nil
+	}
+	var chain []*x509.Certificate
+	rest := []byte(unescaped)
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil
+		}
+		chain = append(chain, cert)
+	}
+	if chain != nil {
+		return chain
+	}
+	// Traefik sends the base64 DER of the chain separated by commas, the leaf first
+	for _, encoded := range strings.Split(unescaped, ",") {
+		der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil
+		}
+		chain = append(chain, cert)
+	}
+	return chain
+}
+
+const defaultBypassAPIKeyHeader = "X-API-Key"
+
+// BypassAPIKeysConfig lets API consumers with a documented key skip verification.
+type BypassAPIKeysConfig struct {
+	// Header carries the API key, if not provided, X-API-Key will be used
+	Header string `yaml:"header"`
+	// Keys are the hex SHA-256 hashes of the accepted keys, so the configuration never holds a usable key
+	Keys []string `yaml:"keys"`
+}
+
+// apiKeyBypass admits requests carrying an API key whose hash is configured.
+type apiKeyBypass struct {
+	header string
+	hashes map[string]bool
+}
+
+// newAPIKeyBypass returns nil when no API keys are configured.
+func newAPIKeyBypass(config *Config) (*apiKeyBypass, error) {
+	if config.BypassAPIKeys == nil {
+		return nil, nil
+	}
+	if len(config.BypassAPIKeys.Keys) == 0 {
+		return nil, errors.New("bypassapikeys.keys cannot be empty")
+	}
+	b := &apiKeyBypass{
+		header: config.BypassAPIKeys.Header,
+		hashes: make(map[string]bool, len(config.BypassAPIKeys.Keys)),
+	}
+	if b.header == "" {
+		b.header = defaultBypassAPIKeyHeader
+	}
+	var problems configErrors
+	for i, hash := range config.BypassAPIKeys.Keys {
+		normalized := strings.ToLower(strings.TrimSpace(hash))
+		if decoded, err := hex.DecodeString(normalized); err != nil || len(decoded) != sha256.Size {
+			problems.add(fmt.Errorf("invalid bypassapikeys.keys[%d]: not a hex SHA-256 hash", i))
+			continue
+		}
+		b.hashes[normalized] = true
+	}
+	return b, problems.err()
+}
+
+// allows reports whether req carries an accepted API key.
+func (b *apiKeyBypass) allows(req *http.Request) bool {
+	if b == nil {
+		return false
+	}
+	key := req.Header.Get(b.header)
+	if key == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(key))
+	return b.hashes[hex.EncodeToString(hash[:])]
+}
@@ -0,0 +1,266 @@
+package turnstile
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBypassKey = "0123456789abcdef0123456789abcdef"
+
+// signBypass returns the bypass header value a trusted caller sends for path at t.
+func signBypass(key, path string, t time.Time) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + "." + path))
+	return fmt.Sprintf("t=%s,sig=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestSignedBypass(t *testing.T) {
+	b, err := newSignedBypass(&Config{BypassSignature: &BypassSignatureConfig{Key: testBypassKey, MaxAge: "1m"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	valid := signBypass(testBypassKey, "/api/submit", now)
+	_, validSig, _ := strings.Cut(valid, ",sig=")
+	tampered := []byte(valid)
+	// flip the last hex digit of the signature
+	if tampered[len(tampered)-1] == '0' {
+		tampered[len(tampered)-1] = '1'
+	} else {
+		tampered[len(tampered)-1] = '0'
+	}
+
+	tests := []struct {
+		name, path, header string
+		want               bool
+	}{
+		{"valid", "/api/submit", valid, true},
+		{"clock skew within max age", "/api/submit", signBypass(testBypassKey, "/api/submit", now.Add(30*time.Second)), true},
+		{"missing", "/api/submit", "", false},
+		{"expired", "/api/submit", signBypass(testBypassKey, "/api/submit", now.Add(-2*time.Minute)), false},
+		{"from the future", "/api/submit", signBypass(testBypassKey, "/api/submit", now.Add(2*time.Minute)), false},
+		{"tampered signature", "/api/submit", string(tampered), false},
+		{"other path", "/api/admin", valid, false},
+		{"other key", "/api/submit", signBypass("fedcba9876543210fedcba9876543210", "/api/submit", now), false},
+		{"replaced timestamp", "/api/submit", fmt.Sprintf("t=%d,sig=%s", now.Unix()+1, validSig), false},
+		{"malformed timestamp", "/api/submit", "t=now,sig=00", false},
+		{"malformed signature", "/api/submit", fmt.Sprintf("t=%d,sig=zz", now.Unix()), false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set(defaultBypassSignatureHeader, tt.header)
+		}
+		if got := b.allows(req); got != tt.want {
+			t.Errorf("%s: allows = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSignedBypassConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *BypassSignatureConfig
+		valid  bool
+	}{
+		{"defaults", &BypassSignatureConfig{Key: testBypassKey}, true},
+		{"short key", &BypassSignatureConfig{Key: "short"}, false},
+		{"invalid max age", &BypassSignatureConfig{Key: testBypassKey, MaxAge: "soon"}, false},
+		{"negative max age", &BypassSignatureConfig{Key: testBypassKey, MaxAge: "-1m"}, false},
+	}
+	for _, tt := range tests {
+		_, err := newSignedBypass(&Config{BypassSignature: tt.config})
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+// issueCert returns a client certificate for subject signed by parent, or self-signed when parent is nil.
+func issueCert(t *testing.T, subject string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: subject, Organization: []string{"Example"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func certPEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestClientCertBypass(t *testing.T) {
+	ca, caKey := issueCert(t, "Example CA", true, nil, nil)
+	client, _ := issueCert(t, "billing", false, ca, caKey)
+	// anyone can issue a certificate with the trusted subject
+	impostor, _ := issueCert(t, "billing", false, nil, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte(certPEM(ca)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bySubject := &ClientCertConfig{TrustedProxies: []string{"10.0.0.0/8"}, CAFile: caFile, Subjects: []string{client.Subject.String()}}
+	byFingerprint := &ClientCertConfig{TrustedProxies: []string{"10.0.0.0/8"}, Fingerprints: []string{certFingerprint(impostor)}}
+	// Traefik's PassTLSClientCert sends the escaped base64 DER of the chain separated by commas
+	traefikChain := url.QueryEscape(base64.StdEncoding.EncodeToString(client.Raw) + "," + base64.StdEncoding.EncodeToString(ca.Raw))
+
+	tests := []struct {
+		name       string
+		config     *ClientCertConfig
+		remoteAddr string
+		header     string
+		peer       *x509.Certificate
+		want       bool
+	}{
+		// escaped like nginx's $ssl_client_escaped_cert
+		{"escaped PEM from a trusted proxy", bySubject, "10.0.0.1:1234", url.PathEscape(certPEM(client)), nil, true},
+		{"unescaped PEM chain", bySubject, "10.0.0.1:1234", certPEM(client) + certPEM(ca), nil, true},
+		{"Traefik DER chain", bySubject, "10.0.0.1:1234", traefikChain, nil, true},
+		{"header from an untrusted address", bySubject, "192.0.2.1:1234", url.PathEscape(certPEM(client)), nil, false},
+		{"TLS connection", bySubject, "192.0.2.1:1234", "", client, true},
+		{"subject match failing CA verification", bySubject, "10.0.0.1:1234", url.PathEscape(certPEM(impostor)), nil, false},
+		{"subject match over TLS failing CA verification", bySubject, "192.0.2.1:1234", "", impostor, false},
+		{"garbage header", bySubject, "10.0.0.1:1234", "not-a-certificate", nil, false},
+		{"fingerprint without cafile", byFingerprint, "10.0.0.1:1234", url.PathEscape(certPEM(impostor)), nil, true},
+		{"other fingerprint", byFingerprint, "10.0.0.1:1234", url.PathEscape(certPEM(client)), nil, false},
+		{"fingerprint from an untrusted address", byFingerprint, "192.0.2.1:1234", url.PathEscape(certPEM(impostor)), nil, false},
+	}
+	for _, tt := range tests {
+		b, err := newClientCertBypass(&Config{ClientCerts: tt.config})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/api/submit", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			req.Header.Set(defaultClientCertHeader, tt.header)
+		}
+		if tt.peer != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.peer}}
+		}
+		if got := b.allows(req); got != tt.want {
+			t.Errorf("%s: allows = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientCertBypassConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *ClientCertConfig
+		valid  bool
+	}{
+		{"fingerprints", &ClientCertConfig{Fingerprints: []string{strings.Repeat("ab:", 31) + "ab"}}, true},
+		{"nothing trusted", &ClientCertConfig{}, false},
+		{"subjects without cafile", &ClientCertConfig{Subjects: []string{"CN=billing"}}, false},
+		{"missing cafile", &ClientCertConfig{Subjects: []string{"CN=billing"}, CAFile: filepath.Join(t.TempDir(), "missing.pem")}, false},
+		{"short fingerprint", &ClientCertConfig{Fingerprints: []string{"abcd"}}, false},
+		{"invalid proxy", &ClientCertConfig{Fingerprints: []string{strings.Repeat("ab", 32)}, TrustedProxies: []string{"10.0.0.0/99"}}, false},
+	}
+	for _, tt := range tests {
+		_, err := newClientCertBypass(&Config{ClientCerts: tt.config})
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestAPIKeyBypass(t *testing.T) {
+	sum := sha256.Sum256([]byte("billing-service-key"))
+	hash := hex.EncodeToString(sum[:])
+	b, err := newAPIKeyBypass(&Config{BypassAPIKeys: &BypassAPIKeysConfig{Keys: []string{" " + strings.ToUpper(hash) + " "}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, header, key string
+		want              bool
+	}{
+		{"valid key", defaultBypassAPIKeyHeader, "billing-service-key", true},
+		{"wrong key", defaultBypassAPIKeyHeader, "billing-service-key2", false},
+		{"the hash itself", defaultBypassAPIKeyHeader, hash, false},
+		{"missing", defaultBypassAPIKeyHeader, "", false},
+		{"other header", "Authorization", "billing-service-key", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/api/submit", nil)
+		if tt.key != "" {
+			req.Header.Set(tt.header, tt.key)
+		}
+		if got := b.allows(req); got != tt.want {
+			t.Errorf("%s: allows = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyBypassConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		err  string
+	}{
+		{"valid hash", []string{strings.Repeat("0a", 32)}, ""},
+		{"no keys", nil, "bypassapikeys.keys cannot be empty"},
+		{"not hex", []string{strings.Repeat("zz", 32)}, "invalid bypassapikeys.keys[0]"},
+		{"wrong length", []string{strings.Repeat("0a", 32), strings.Repeat("0a", 20)}, "invalid bypassapikeys.keys[1]"},
+		{"plain key", []string{"billing-service-key"}, "invalid bypassapikeys.keys[0]"},
+	}
+	for _, tt := range tests {
+		_, err := newAPIKeyBypass(&Config{BypassAPIKeys: &BypassAPIKeysConfig{Keys: tt.keys}})
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: err = %v, want it to contain %q", tt.name, err, tt.err)
+		}
+	}
+}
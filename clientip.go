@@ -0,0 +1,24 @@
+package turnstile
+
+import (
+	"net"
+	"net/http"
+)
+
+// clientIP returns the IP address of the client that sent the request.
+func clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ipPrefix masks ip to its /24 (IPv4) or /64 (IPv6) network, which stays
+// stable for mobile clients hopping between addresses of the same carrier.
+func ipPrefix(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(64, 128))
+}
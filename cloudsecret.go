@@ -0,0 +1,300 @@
+package turnstile
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCloudSecretRefresh = 5 * time.Minute
+	cloudSecretTimeout        = 10 * time.Second
+	gcpMetadataTokenURL       = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// cloudSecret is a secret read from a cloud secret manager, cached and
+// refreshed in the background so it can be rotated at the provider.
+type cloudSecret struct {
+	ref     string
+	fetch   func(ctx context.Context) (string, error)
+	refresh time.Duration
+	current atomic.Value
+}
+
+// loadCloudSecret reads the secret referenced by ref, one of
+//
+//	aws-sm://<secret-id>?region=<region>&key=<json-field>
+//	gcp-sm://projects/<project>/secrets/<secret>/versions/<version>?key=<json-field>
+//
+// Both accept refresh=<duration> to change how often the secret is read again.
+func loadCloudSecret(ref string) (*cloudSecret, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secretref: %w", err)
+	}
+	query := u.Query()
+	s := &cloudSecret{ref: u.Scheme + "://" + u.Host + u.Path, refresh: defaultCloudSecretRefresh}
+	if value := query.Get("refresh"); value != "" {
+		if s.refresh, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid secretref refresh: %w", err)
+		}
+		if s.refresh <= 0 {
+			return nil, errors.New("secretref refresh must be positive")
+		}
+	}
+	client := &http.Client{Timeout: cloudSecretTimeout}
+	var fetch func(ctx context.Context) (string, error)
+	switch u.Scheme {
+	case "aws-sm":
+		fetch, err = awsSecretFetcher(client, strings.TrimPrefix(u.Host+u.Path, "/"), query)
+	case "gcp-sm":
+		fetch, err = gcpSecretFetcher(client, strings.Trim(u.Host+u.Path, "/"), query)
+	default:
+		return nil, fmt.Errorf("invalid secretref: unsupported scheme %q, use aws-sm or gcp-sm", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid secretref: %w", err)
+	}
+	key := query.Get("key")
+	s.fetch = func(ctx context.Context) (string, error) {
+		value, err := fetch(ctx)
+		if err != nil {
+			return "", err
+		}
+		if key != "" {
+			var fields map[string]interface{}
+			if err := json.Unmarshal([]byte(value), &fields); err != nil {
+				return "", fmt.Errorf("the secret is not a JSON object: %w", err)
+			}
+			field, ok := fields[key].(string)
+			if !ok {
+				return "", fmt.Errorf("the secret has no string field %q", key)
+			}
+			value = field
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return "", errors.New("the secret is empty")
+		}
+		return value, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cloudSecretTimeout)
+	defer cancel()
+	if err := s.reload(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read secretref %s: %w", s.ref, err)
+	}
+	return s, nil
+}
+
+func (s *cloudSecret) secret() string {
+	return s.current.Load().(string)
+}
+
+// watch reads the secret again every refresh interval until ctx is done. The
+// last secret stays in use while the secret manager is unreachable.
+func (s *cloudSecret) watch(ctx context.Context) {
+	background.schedule(ctx, "cloud-secret-refresh", s.refresh, func() {
+		if err := s.reload(ctx); err != nil {
+			logger().Warn("keeping the current secret, failed to read it from the secret manager", "secretref", s.ref, "error", err)
+		}
+	})
+}
+
+func (s *cloudSecret) reload(ctx context.Context) error {
+	value, err := s.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	redactor.add(value)
+	s.current.Store(value)
+	return nil
+}
+
+// awsSecretFetcher reads a secret from AWS Secrets Manager with the
+// credentials of the standard AWS environment variables.
+func awsSecretFetcher(client *http.Client, secretID string, query url.Values) (func(ctx context.Context) (string, error), error) {
+	if secretID == "" {
+		return nil, errors.New("aws-sm requires a secret id")
+	}
+	region := query.Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, errors.New("aws-sm requires a region parameter or AWS_REGION")
+	}
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com/"
+	} else if err := validateEndpoint("aws-sm endpoint", endpoint); err != nil {
+		return nil, err
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("aws-sm requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	sessionToken := os.Getenv("AWS_SESSION_TOKEN")
+
+	return func(ctx context.Context) (string, error) {
+		body, _ := json.Marshal(map[string]string{"SecretId": secretID})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(string(body)))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+		req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+		if sessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", sessionToken)
+		}
+		signAWSRequest(req, body, accessKey, secretKey, region, "secretsmanager", time.Now().UTC())
+
+		var result struct {
+			SecretString string `json:"SecretString"`
+		}
+		if err := doCloudSecretRequest(client, req, &result); err != nil {
+			return "", err
+		}
+		return result.SecretString, nil
+	}, nil
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header to req.
+func signAWSRequest(req *http.Request, body []byte, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	// sign the host, the content type and every x-amz-* header
+	names := []string{"host"}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// gcpSecretFetcher reads a secret version from GCP Secret Manager with an
+// access token from GOOGLE_OAUTH_ACCESS_TOKEN or the metadata server.
+func gcpSecretFetcher(client *http.Client, name string, query url.Values) (func(ctx context.Context) (string, error), error) {
+	parts := strings.Split(name, "/")
+	if len(parts) == 4 && parts[0] == "projects" && parts[2] == "secrets" {
+		name += "/versions/latest"
+	} else if len(parts) != 6 || parts[0] != "projects" || parts[2] != "secrets" || parts[4] != "versions" {
+		return nil, errors.New("gcp-sm requires projects/<project>/secrets/<secret>[/versions/<version>]")
+	}
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://secretmanager.googleapis.com"
+	} else if err := validateEndpoint("gcp-sm endpoint", endpoint); err != nil {
+		return nil, err
+	}
+	accessURL := strings.TrimSuffix(endpoint, "/") + "/v1/" + name + ":access"
+	tokenURL := query.Get("tokenurl")
+	if tokenURL == "" {
+		tokenURL = gcpMetadataTokenURL
+	}
+
+	return func(ctx context.Context) (string, error) {
+		token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+		if token == "" {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
+			if err != nil {
+				return "", err
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			var result struct {
+				AccessToken string `json:"access_token"`
+			}
+			if err := doCloudSecretRequest(client, req, &result); err != nil {
+				return "", fmt.Errorf("failed to get an access token from the metadata server: %w", err)
+			}
+			token = result.AccessToken
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, accessURL, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		var result struct {
+			Payload struct {
+				Data string `json:"data"`
+			} `json:"payload"`
+		}
+		if err := doCloudSecretRequest(client, req, &result); err != nil {
+			return "", err
+		}
+		data, err := base64.StdEncoding.DecodeString(result.Payload.Data)
+		if err != nil {
+			return "", fmt.Errorf("malformed secret payload: %w", err)
+		}
+		return string(data), nil
+	}, nil
+}
+
+func doCloudSecretRequest(client *http.Client, req *http.Request, result interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,228 @@
+// Command turnstile-demo serves a sample form protected by the turnstile
+// middleware and generates load-testing scenarios for it.
+//
+// Usage:
+//
+//	turnstile-demo serve [flags]      serve the demo form and protected endpoint
+//	turnstile-demo scenario [flags]   print vegeta targets or hey commands
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/arwoosa/turnstile"
+)
+
+const (
+	// Cloudflare test keys, see https://developers.cloudflare.com/turnstile/troubleshooting/testing/
+	testSiteKey    = "1x00000000000000000000AA"
+	testSecret     = "1x0000000000000000000000000000000AA"
+	testDummyToken = "XXXX.DUMMY.TOKEN.XXXX"
+
+	// mockValidToken is the only token accepted by the mock siteverify endpoint
+	mockValidToken = "demo-valid-token"
+	formKey        = "cf-turnstile-response"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "serve":
+		serve(os.Args[2:])
+	case "scenario":
+		scenario(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: turnstile-demo serve|scenario [flags]")
+	os.Exit(2)
+}
+
+var formPage = template.Must(template.New("form").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Turnstile demo</title>
+<script src="https://challenges.cloudflare.com/turnstile/v0/api.js" async defer></script>
+</head>
+<body>
+<h1>Turnstile demo</h1>
+<form action="/submit" method="POST">
+<input name="message" placeholder="Message">
+<div class="cf-turnstile" data-sitekey="{{.}}"></div>
+<button type="submit">Submit</button>
+</form>
+</body>
+</html>
+`))
+
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "address to listen on")
+	siteKey := fs.String("sitekey", testSiteKey, "Turnstile site key rendered in the form")
+	secret := fs.String("secret", testSecret, "Turnstile secret key")
+	mock := fs.Bool("mock", false, "verify tokens against a local mock siteverify endpoint that only accepts "+mockValidToken)
+	_ = fs.Parse(args)
+
+	config := turnstile.CreateConfig()
+	config.TurnstileSecret = *secret
+	config.Routers = []turnstile.Router{{Method: http.MethodPost, Path: "/submit", FormKey: formKey}}
+	if *mock {
+		verifyURL, err := startMockSiteverify()
+		if err != nil {
+			log.Fatalf("failed to start mock siteverify: %v", err)
+		}
+		config.VerifyURL = verifyURL
+	}
+
+	backend := http.NewServeMux()
+	backend.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = formPage.Execute(rw, *siteKey)
+	})
+	backend.HandleFunc("/submit", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(map[string]string{"status": "accepted"})
+	})
+
+	handler, err := turnstile.New(context.Background(), backend, config, "turnstile-demo")
+	if err != nil {
+		log.Fatalf("failed to create middleware: %v", err)
+	}
+	log.Printf("serving demo on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, handler))
+}
+
+// startMockSiteverify serves a siteverify stand-in on a random local port so
+// load tests neither depend on nor consume Cloudflare.
+func startMockSiteverify() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		_ = http.Serve(ln, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_ = req.ParseForm()
+			resp := map[string]interface{}{"success": true, "error-codes": []string{}}
+			if req.PostForm.Get("response") != mockValidToken {
+				resp = map[string]interface{}{"success": false, "error-codes": []string{"invalid-input-response"}}
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(rw).Encode(resp)
+		}))
+	}()
+	return "http://" + ln.Addr().String() + "/siteverify", nil
+}
+
+// vegetaTarget is a target in vegeta's JSON format (vegeta attack -format=json).
+type vegetaTarget struct {
+	Method string              `json:"method"`
+	URL    string              `json:"url"`
+	Body   string              `json:"body,omitempty"`
+	Header map[string][]string `json:"header,omitempty"`
+}
+
+func scenario(args []string) {
+	fs := flag.NewFlagSet("scenario", flag.ExitOnError)
+	target := fs.String("url", "http://localhost:8080/submit", "protected endpoint")
+	format := fs.String("format", "vegeta", "output format: vegeta (JSON targets) or hey (shell commands)")
+	count := fs.Int("n", 1000, "number of requests")
+	valid := fs.Float64("valid", 0.7, "share of requests with a valid token")
+	missing := fs.Float64("missing", 0.2, "share of requests without a token")
+	bogus := fs.Float64("bogus", 0.1, "share of requests with a bogus token")
+	mock := fs.Bool("mock", false, "use the token accepted by the serve -mock siteverify instead of Cloudflare's dummy token")
+	seed := fs.Int64("seed", 1, "random seed")
+	_ = fs.Parse(args)
+
+	total := *valid + *missing + *bogus
+	if total <= 0 {
+		log.Fatal("at least one of -valid, -missing and -bogus must be positive")
+	}
+	validToken := testDummyToken
+	if *mock {
+		validToken = mockValidToken
+	}
+
+	rng := rand.New(rand.NewSource(*seed))
+	bodies := map[string]func() string{
+		"valid":   func() string { return formBody(validToken) },
+		"missing": func() string { return url.Values{"message": {"hello"}}.Encode() },
+		"bogus":   func() string { return formBody(fmt.Sprintf("bogus-%016x", rng.Uint64())) },
+	}
+	pick := func() string {
+		r := rng.Float64() * total
+		switch {
+		case r < *valid:
+			return "valid"
+		case r < *valid+*missing:
+			return "missing"
+		default:
+			return "bogus"
+		}
+	}
+
+	switch *format {
+	case "vegeta":
+		writeVegeta(os.Stdout, *target, *count, pick, bodies)
+	case "hey":
+		writeHey(os.Stdout, *target, *count, pick, bodies)
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+}
+
+func formBody(token string) string {
+	return url.Values{"message": {"hello"}, formKey: {token}}.Encode()
+}
+
+func writeVegeta(w io.Writer, target string, count int, pick func() string, bodies map[string]func() string) {
+	encoder := json.NewEncoder(w)
+	for i := 0; i < count; i++ {
+		_ = encoder.Encode(vegetaTarget{
+			Method: http.MethodPost,
+			URL:    target,
+			Body:   base64.StdEncoding.EncodeToString([]byte(bodies[pick()]())),
+			Header: map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}},
+		})
+	}
+}
+
+// writeHey prints one hey invocation per request kind, hey sends a single
+// request shape per run, so the mix is expressed as request counts.
+func writeHey(w io.Writer, target string, count int, pick func() string, bodies map[string]func() string) {
+	counts := map[string]int{}
+	for i := 0; i < count; i++ {
+		counts[pick()]++
+	}
+	fmt.Fprintln(w, "#!/bin/sh")
+	for _, kind := range []string{"valid", "missing", "bogus"} {
+		if counts[kind] == 0 {
+			continue
+		}
+		concurrency := 10
+		if counts[kind] < concurrency {
+			concurrency = counts[kind]
+		}
+		fmt.Fprintf(w, "# %s tokens\n", kind)
+		fmt.Fprintf(w, "hey -n %d -c %d -m POST -T application/x-www-form-urlencoded -d '%s' '%s' &\n",
+			counts[kind], concurrency, strings.ReplaceAll(bodies[kind](), "'", ""), target)
+	}
+	fmt.Fprintln(w, "wait")
+}
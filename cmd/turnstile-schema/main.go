@@ -0,0 +1,344 @@
+// Command turnstile-schema generates a JSON schema for the plugin
+// configuration and Kubernetes Middleware manifests from the Go types, so the
+// options users paste into a Middleware resource always match what the plugin
+// accepts.
+//
+// Usage:
+//
+//	turnstile-schema schema [flags]     print the JSON schema of the configuration
+//	turnstile-schema manifest [flags]   print a traefik.io/v1alpha1 Middleware
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/arwoosa/turnstile"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "schema":
+		schema(os.Args[2:])
+	case "manifest":
+		manifest(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: turnstile-schema schema|manifest [flags]")
+	os.Exit(2)
+}
+
+func schema(args []string) {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	src := fs.String("src", ".", "directory of the plugin sources, field comments become descriptions")
+	_ = fs.Parse(args)
+
+	docs, err := fieldDocs(*src)
+	if err != nil {
+		log.Printf("field descriptions unavailable: %v", err)
+	}
+	g := &schemaGenerator{docs: docs, defs: map[string]interface{}{}}
+	root := g.ref(reflect.TypeOf(turnstile.Config{}))
+	g.defaults(reflect.ValueOf(turnstile.CreateConfig()).Elem())
+
+	out := map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     "https://github.com/arwoosa/turnstile/turnstile.schema.json",
+		"title":   "Turnstile middleware configuration",
+		"$ref":    root["$ref"],
+		"$defs":   g.defs,
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(out); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// schemaGenerator collects one definition per named struct type, nested
+// types reference each other so recursive options such as profiles resolve.
+type schemaGenerator struct {
+	// docs maps Type.Field to the comment of the field
+	docs map[string]string
+	defs map[string]interface{}
+}
+
+func (g *schemaGenerator) ref(t reflect.Type) map[string]interface{} {
+	name := t.Name()
+	if _, ok := g.defs[name]; !ok {
+		// reserve the name before walking the fields to stop recursion
+		g.defs[name] = nil
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			key := yamlKey(field)
+			if key == "" {
+				continue
+			}
+			property := g.typeOf(field.Type)
+			if doc := g.docs[name+"."+field.Name]; doc != "" {
+				property["description"] = doc
+			}
+			properties[key] = property
+		}
+		g.defs[name] = map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	}
+	return map[string]interface{}{"$ref": "#/$defs/" + name}
+}
+
+func (g *schemaGenerator) typeOf(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.typeOf(t.Elem())
+	case reflect.Struct:
+		return g.ref(t)
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": g.typeOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.typeOf(t.Elem())}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+// defaults records the non-zero values set by CreateConfig.
+func (g *schemaGenerator) defaults(config reflect.Value) {
+	def := g.defs[config.Type().Name()].(map[string]interface{})
+	properties := def["properties"].(map[string]interface{})
+	for i := 0; i < config.NumField(); i++ {
+		field := config.Type().Field(i)
+		key := yamlKey(field)
+		if key == "" || config.Field(i).IsZero() || field.Type.Kind() == reflect.Struct {
+			continue
+		}
+		properties[key].(map[string]interface{})["default"] = config.Field(i).Interface()
+	}
+}
+
+// fieldDocs returns the comments of the exported struct fields in dir.
+func fieldDocs(dir string) (map[string]string, error) {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	docs := map[string]string{}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			ast.Inspect(file, func(node ast.Node) bool {
+				spec, ok := node.(*ast.TypeSpec)
+				if !ok {
+					return true
+				}
+				structType, ok := spec.Type.(*ast.StructType)
+				if !ok {
+					return false
+				}
+				for _, field := range structType.Fields.List {
+					doc := field.Doc.Text()
+					if doc == "" {
+						doc = field.Comment.Text()
+					}
+					doc = strings.Join(strings.Fields(doc), " ")
+					for _, name := range field.Names {
+						if name.IsExported() && doc != "" {
+							docs[spec.Name.Name+"."+name.Name] = doc
+						}
+					}
+				}
+				return false
+			})
+		}
+	}
+	return docs, nil
+}
+
+func manifest(args []string) {
+	fs := flag.NewFlagSet("manifest", flag.ExitOnError)
+	name := fs.String("name", "turnstile", "name of the Middleware resource")
+	namespace := fs.String("namespace", "", "namespace of the Middleware resource")
+	plugin := fs.String("plugin", "turnstile", "plugin name used in the Traefik static configuration")
+	configFile := fs.String("config", "", "JSON file with the plugin configuration, an example is used when empty")
+	_ = fs.Parse(args)
+
+	config := turnstile.CreateConfig()
+	if *configFile == "" {
+		config.TurnstileSecret = "your-turnstile-secret-key"
+		config.Routers = []turnstile.Router{
+			{Method: "POST", Path: "/verify", FormKey: "cf-turnstile-response"},
+			{Method: "GET", Path: "/api/identity/{token}", HeaderKey: "X-Turnstile-Token"},
+		}
+	} else {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// unknown keys are rejected so typos fail here instead of in the cluster
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(config); err != nil {
+			log.Fatalf("invalid configuration %s: %v", *configFile, err)
+		}
+	}
+
+	w := &yamlWriter{w: os.Stdout}
+	w.line(0, "apiVersion: traefik.io/v1alpha1")
+	w.line(0, "kind: Middleware")
+	w.line(0, "metadata:")
+	w.line(1, "name: "+yamlKeyString(*name))
+	if *namespace != "" {
+		w.line(1, "namespace: "+yamlKeyString(*namespace))
+	}
+	w.line(0, "spec:")
+	w.line(1, "plugin:")
+	w.line(2, yamlKeyString(*plugin)+":")
+	w.value(3, reflect.ValueOf(config).Elem())
+	if w.err != nil {
+		log.Fatal(w.err)
+	}
+}
+
+// yamlWriter writes configuration values as block-style YAML with the keys of
+// their yaml tags, zero values are omitted.
+type yamlWriter struct {
+	w   io.Writer
+	err error
+	// pending is written in front of the next line, it holds "- " for list items
+	pending string
+}
+
+func (y *yamlWriter) line(depth int, text string) {
+	if y.err != nil {
+		return
+	}
+	indent := strings.Repeat("  ", depth)
+	if y.pending != "" {
+		indent, y.pending = indent[:len(indent)-2]+y.pending, ""
+	}
+	_, y.err = fmt.Fprintln(y.w, indent+text)
+}
+
+// value writes the fields of a struct or the entries of a map at depth.
+func (y *yamlWriter) value(depth int, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		y.value(depth, v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			key := yamlKey(v.Type().Field(i))
+			if key != "" && !v.Field(i).IsZero() {
+				y.entry(depth, key, v.Field(i))
+			}
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			y.entry(depth, yamlKeyString(key.String()), v.MapIndex(key))
+		}
+	}
+}
+
+func (y *yamlWriter) entry(depth int, key string, v reflect.Value) {
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct, reflect.Map:
+		y.line(depth, key+":")
+		y.value(depth+1, v)
+	case reflect.Slice:
+		y.line(depth, key+":")
+		for i := 0; i < v.Len(); i++ {
+			item := v.Index(i)
+			for item.Kind() == reflect.Ptr {
+				item = item.Elem()
+			}
+			if item.IsZero() && (item.Kind() == reflect.Struct || item.Kind() == reflect.Map) {
+				y.line(depth+1, "- {}")
+				continue
+			}
+			if item.Kind() == reflect.Struct || item.Kind() == reflect.Map {
+				y.pending = "- "
+				y.value(depth+2, item)
+				continue
+			}
+			y.line(depth+1, "- "+yamlScalar(item))
+		}
+	default:
+		y.line(depth, key+": "+yamlScalar(v))
+	}
+}
+
+func yamlScalar(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return yamlString(v.String())
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// yamlString quotes s, a JSON string is a valid double-quoted YAML scalar.
+func yamlString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// yamlKeyString leaves names made of letters, digits, '-', '_' and '.' unquoted.
+func yamlKeyString(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == '.')
+	}) >= 0 {
+		return yamlString(s)
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~":
+		return yamlString(s)
+	}
+	return s
+}
+
+func yamlKey(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if key == "-" {
+		return ""
+	}
+	return key
+}
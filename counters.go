@@ -0,0 +1,73 @@
+package turnstile
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counterVec is a set of counters keyed by their label values. Incrementing an
+// existing counter is a lock-free map lookup plus an atomic add, so concurrent
+// requests never serialize on decision accounting; only the first increment
+// of a new key takes the map's internal lock.
+type counterVec struct {
+	counters sync.Map
+}
+
+// add increments the counter of key, which must be a comparable label struct.
+func (v *counterVec) add(key interface{}, delta uint64) {
+	counter, ok := v.counters.Load(key)
+	if !ok {
+		counter, _ = v.counters.LoadOrStore(key, new(atomic.Uint64))
+	}
+	counter.(*atomic.Uint64).Add(delta)
+}
+
+// each calls fn with every key and its current value, in no particular order.
+func (v *counterVec) each(fn func(key interface{}, value uint64)) {
+	v.counters.Range(func(key, counter interface{}) bool {
+		fn(key, counter.(*atomic.Uint64).Load())
+		return true
+	})
+}
+
+// histogram counts durations in cumulative buckets, lock-free like counterVec.
+type histogram struct {
+	// bounds are the upper bounds of the buckets in seconds, ascending
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	// sum is the total of the observed durations in nanoseconds
+	sum atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds))}
+}
+
+func (h *histogram) observe(duration time.Duration) {
+	seconds := duration.Seconds()
+	for i, bound := range h.bounds {
+		if seconds <= bound {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(uint64(duration))
+}
+
+// write writes the histogram series of name with the given label pairs, e.g. `route="x"`.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+	}
+	count := h.count.Load()
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, time.Duration(h.sum.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, count)
+}
@@ -0,0 +1,158 @@
+package turnstile
+
+import (
+	"net/http"
+	"time"
+)
+
+// Reason explains why a request to a protected route was allowed or rejected.
+// Reason values are a stable, documented contract: they appear in the decision
+// header and in exported logs, so existing values must never be renamed.
+type Reason string
+
+// Reasons for allowed requests.
+const (
+	// ReasonVerified means the token was verified by siteverify
+	ReasonVerified Reason = "verified"
+	// ReasonSession means the request carried a valid verification session cookie
+	ReasonSession Reason = "session"
+	// ReasonPreClearance means the request carried a Cloudflare pre-clearance cookie
+	ReasonPreClearance Reason = "preclearance"
+	// ReasonGrace means the request was admitted unverified under grace mode
+	ReasonGrace Reason = "grace"
+	// ReasonLowVelocity means the client was below the router's velocity trigger
+	ReasonLowVelocity Reason = "low-velocity"
+	// ReasonFailOpen means siteverify could not be reached and the failure policy is open
+	ReasonFailOpen Reason = "fail-open"
+	// ReasonTrustedIP means the client address is in trustedips
+	ReasonTrustedIP Reason = "trusted-ip"
+	// ReasonSignedBypass means the request carried a valid bypass signature
+	ReasonSignedBypass Reason = "signed-bypass"
+	// ReasonClientCert means the request presented a trusted client certificate
+	ReasonClientCert Reason = "client-cert"
+	// ReasonAPIKey means the request carried an API key accepted by bypassapikeys
+	ReasonAPIKey Reason = "api-key"
+	// ReasonAuthSession means the request carried an application session accepted by authsession
+	ReasonAuthSession Reason = "auth-session"
+	// ReasonVerifiedBot means the request came from a search engine crawler confirmed by DNS
+	ReasonVerifiedBot Reason = "verified-bot"
+)
+
+// Reasons for rejected requests.
+const (
+	// ReasonMissingToken means no token could be extracted from the request
+	ReasonMissingToken Reason = "missing-token"
+	// ReasonEmptyToken means the token source was present but empty
+	ReasonEmptyToken Reason = "empty-token"
+	// ReasonMalformedRequest means the body, form or envelope holding the token could not be read
+	ReasonMalformedRequest Reason = "malformed-request"
+	// ReasonVerificationFailed means siteverify rejected the token
+	ReasonVerificationFailed Reason = "verification-failed"
+	// ReasonVerificationError means siteverify could not be reached or answered unexpectedly
+	ReasonVerificationError Reason = "verification-error"
+	// ReasonMaintenance means the router is switched to the maintenance action
+	ReasonMaintenance Reason = "maintenance"
+	// ReasonHookRejected means the OnMatch hook rejected the request
+	ReasonHookRejected Reason = "hook-rejected"
+	// ReasonBlockedIP means the client address is in blockedips
+	ReasonBlockedIP Reason = "blocked-ip"
+	// ReasonBanned means the client IP is banned after consecutive failed verifications
+	ReasonBanned Reason = "banned"
+)
+
+// reasons enumerates every Reason, new reasons must be appended.
+var reasons = []Reason{
+	ReasonVerified, ReasonSession, ReasonPreClearance, ReasonGrace, ReasonLowVelocity, ReasonFailOpen,
+	ReasonMissingToken, ReasonEmptyToken, ReasonMalformedRequest, ReasonVerificationFailed, ReasonVerificationError, ReasonMaintenance,
+	ReasonHookRejected, ReasonTrustedIP, ReasonBlockedIP, ReasonSignedBypass, ReasonClientCert, ReasonAPIKey, ReasonAuthSession, ReasonVerifiedBot,
+	ReasonBanned,
+}
+
+// reasonIndex returns the position of reason in reasons, or -1.
+func reasonIndex(reason Reason) int {
+	for i := range reasons {
+		if reasons[i] == reason {
+			return i
+		}
+	}
+	return -1
+}
+
+// allows reports whether requests decided with r are allowed.
+func (r Reason) allows() bool {
+	switch r {
+	case ReasonVerified, ReasonSession, ReasonPreClearance, ReasonGrace, ReasonLowVelocity, ReasonFailOpen, ReasonTrustedIP, ReasonSignedBypass, ReasonClientCert, ReasonAPIKey, ReasonAuthSession, ReasonVerifiedBot:
+		return true
+	}
+	return false
+}
+
+// decision is the outcome of protecting a single request.
+type decision struct {
+	Allowed bool
+	Reason  Reason
+	// Status and Message describe the error response of a rejected request
+	Status     int
+	Message    string
+	ErrorCodes []string
+	// Interstitial is set when the rejection is answered with the challenge page
+	Interstitial bool
+	// Redirect is set when the rejection is answered with a redirect to the challenge page
+	Redirect bool
+	// SPA is set when the rejection is answered with the single-page app contract
+	SPA bool
+	// RetryAfter is sent as the Retry-After header when the rejection is caused by a transient failure
+	RetryAfter time.Duration
+	// Tarpit delays the rejection of a client repeatedly failing verification
+	Tarpit time.Duration
+	// Err is the error verifying the token when siteverify could not be reached
+	Err error
+	// ChallengeTS is the time the verified token was issued, as reported by siteverify
+	ChallengeTS string
+	// Duration is the time spent deciding, excluding the next handler
+	Duration time.Duration
+}
+
+func allow(reason Reason) *decision {
+	return &decision{Allowed: true, Reason: reason}
+}
+
+func reject(reason Reason, status int, message string) *decision {
+	return &decision{Reason: reason, Status: status, Message: message}
+}
+
+// outcome returns the decision as "allowed" or "rejected".
+func (d *decision) outcome() string {
+	if d.Allowed {
+		return "allowed"
+	}
+	return "rejected"
+}
+
+// setDecisionHeader writes the compact decision header, e.g. "rejected; reason=verification-failed".
+func (a *turnstile) setDecisionHeader(rw http.ResponseWriter, d *decision) {
+	if a.decisionHeader == "" {
+		return
+	}
+	rw.Header().Set(a.decisionHeader, d.outcome()+"; reason="+string(d.Reason))
+}
+
+// record publishes a decision to the configured sinks.
+func (a *turnstile) record(req *http.Request, router *Router, d *decision) {
+	// decision logs are nonessential and shed while latency is over budget
+	if a.otlpLogs != nil && !a.latency.shed() {
+		a.otlpLogs.export(req, router, d)
+	}
+	if a.webhook != nil {
+		a.webhook.observe(req, router, d)
+	}
+	// the audit log and published events are never shed
+	if a.audit == nil && a.events == nil {
+		return
+	}
+	record := newDecisionRecord(req, router, d, a.mode.shadow.Load(), a.name)
+	if a.audit != nil {
+		a.audit.write(record)
+	}
+	a.events.publish(record)
+}
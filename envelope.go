@@ -0,0 +1,222 @@
+package turnstile
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// EnvelopeConfig configures extraction of the token from a JWS/JWT envelope
+// the frontend wraps its form data in.
+type EnvelopeConfig struct {
+	// Header is the header carrying the compact JWS, if not provided, the whole request body will be used
+	Header string `yaml:"header"`
+	// Claim is the payload claim holding the token, dots select nested claims, if not provided, cf-turnstile-response will be used
+	Claim string `yaml:"claim"`
+	// PublicKey is a PEM encoded RSA, ECDSA or Ed25519 public key, when set, the envelope signature is verified
+	PublicKey string `yaml:"publickey"`
+}
+
+// maxEnvelopeBytes bounds the size of an envelope read from the body.
+const maxEnvelopeBytes = 1 << 20
+
+type envelope struct {
+	header    string
+	claim     []string
+	publicKey crypto.PublicKey
+}
+
+func newEnvelope(config *EnvelopeConfig) (*envelope, error) {
+	if config == nil {
+		return nil, nil
+	}
+	claim := config.Claim
+	if claim == "" {
+		claim = "cf-turnstile-response"
+	}
+	e := &envelope{header: config.Header, claim: strings.Split(claim, ".")}
+	if config.PublicKey != "" {
+		key, err := parsePublicKey("envelope publickey", config.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		e.publicKey = key
+	}
+	return e, nil
+}
+
+// parsePublicKey parses the PEM encoded public key of the named option.
+func parsePublicKey(name, value string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(value))
+	if block == nil {
+		return nil, fmt.Errorf("invalid %s: no PEM block found", name)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return key, nil
+}
+
+// token extracts the token from the envelope of req, restoring the body for the backend.
+func (e *envelope) token(req *http.Request) Extraction {
+	var compact string
+	if e.header != "" {
+		compact = req.Header.Get(e.header)
+	} else {
+		body, err := peekBody(req, maxEnvelopeBytes)
+		if err != nil {
+			return failed(SourceEnvelope, err)
+		}
+		compact = string(body)
+	}
+	compact = strings.TrimSpace(compact)
+	if compact == "" {
+		return failed(SourceEnvelope, ErrTokenMissing)
+	}
+
+	payload, err := openJWS(compact, e.publicKey)
+	if err != nil {
+		return failed(SourceEnvelope, err)
+	}
+	var claims interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return failed(SourceEnvelope, ErrEnvelopeInvalid)
+	}
+	for _, name := range e.claim {
+		object, ok := claims.(map[string]interface{})
+		if !ok {
+			return failed(SourceEnvelope, ErrTokenMissing)
+		}
+		claims = object[name]
+	}
+	token, ok := claims.(string)
+	if !ok {
+		return failed(SourceEnvelope, ErrTokenMissing)
+	}
+	if token == "" {
+		return failed(SourceEnvelope, ErrTokenEmpty)
+	}
+	return extracted(SourceEnvelope, token)
+}
+
+// openJWS returns the payload of a compact JWS, verifying its signature when key is not nil.
+func openJWS(compact string, key crypto.PublicKey) ([]byte, error) {
+	parts := strings.Split(compact, ".")
+	if len(parts) != 3 {
+		return nil, ErrEnvelopeInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrEnvelopeInvalid
+	}
+	if key == nil {
+		return payload, nil
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrEnvelopeInvalid
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, ErrEnvelopeInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrEnvelopeInvalid
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// jwsAlgorithm is a JWS signature algorithm accepted for public keys.
+type jwsAlgorithm struct {
+	// family is RS, PS or ES
+	family   string
+	hashFunc crypto.Hash
+	newHash  func() hash.Hash
+	// curveBits is the size of the curve ES algorithms are bound to
+	curveBits int
+}
+
+// jwsAlgorithms are the accepted JWS algorithms by exact name besides EdDSA,
+// any other, none and the HMAC ones included, is rejected.
+var jwsAlgorithms = map[string]jwsAlgorithm{
+	"RS256": {family: "RS", hashFunc: crypto.SHA256, newHash: sha256.New},
+	"RS384": {family: "RS", hashFunc: crypto.SHA384, newHash: sha512.New384},
+	"RS512": {family: "RS", hashFunc: crypto.SHA512, newHash: sha512.New},
+	"PS256": {family: "PS", hashFunc: crypto.SHA256, newHash: sha256.New},
+	"PS384": {family: "PS", hashFunc: crypto.SHA384, newHash: sha512.New384},
+	"PS512": {family: "PS", hashFunc: crypto.SHA512, newHash: sha512.New},
+	"ES256": {family: "ES", hashFunc: crypto.SHA256, newHash: sha256.New, curveBits: 256},
+	"ES384": {family: "ES", hashFunc: crypto.SHA384, newHash: sha512.New384, curveBits: 384},
+	"ES512": {family: "ES", hashFunc: crypto.SHA512, newHash: sha512.New, curveBits: 521},
+}
+
+// verifyJWS checks a JWS signature made with alg by the owner of key. alg
+// must name an algorithm of the type of key exactly.
+func verifyJWS(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	invalid := ErrEnvelopeSignature
+	if k, ok := key.(ed25519.PublicKey); ok {
+		if alg != "EdDSA" || !ed25519.Verify(k, signed, signature) {
+			return invalid
+		}
+		return nil
+	}
+	algorithm, ok := jwsAlgorithms[alg]
+	if !ok {
+		return invalid
+	}
+	h := algorithm.newHash()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch algorithm.family {
+		case "RS":
+			if rsa.VerifyPKCS1v15(k, algorithm.hashFunc, digest, signature) != nil {
+				return invalid
+			}
+		case "PS":
+			if rsa.VerifyPSS(k, algorithm.hashFunc, digest, signature, nil) != nil {
+				return invalid
+			}
+		default:
+			return invalid
+		}
+	case *ecdsa.PublicKey:
+		if algorithm.family != "ES" || k.Curve.Params().BitSize != algorithm.curveBits {
+			return invalid
+		}
+		size := (algorithm.curveBits + 7) / 8
+		if len(signature) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+	default:
+		return invalid
+	}
+	return nil
+}
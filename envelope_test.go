@@ -0,0 +1,74 @@
+package turnstile
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// unsignedJWS returns a compact JWS of claims without a signature.
+func unsignedJWS(t *testing.T, claims interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+}
+
+func TestEnvelopeToken(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested := map[string]interface{}{"form": map[string]interface{}{"captcha": map[string]string{"token": "nested-token"}}}
+	tests := []struct {
+		name   string
+		config EnvelopeConfig
+		value  string
+		want   string
+		err    error
+	}{
+		{"default claim", EnvelopeConfig{}, unsignedJWS(t, map[string]string{"cf-turnstile-response": "token"}), "token", nil},
+		{"nested claim", EnvelopeConfig{Claim: "form.captcha.token"}, unsignedJWS(t, nested), "nested-token", nil},
+		{"nested claim through a string", EnvelopeConfig{Claim: "form.captcha.token.value"}, unsignedJWS(t, nested), "", ErrTokenMissing},
+		{"missing nested claim", EnvelopeConfig{Claim: "form.turnstile"}, unsignedJWS(t, nested), "", ErrTokenMissing},
+		{"numeric claim", EnvelopeConfig{Claim: "token"}, unsignedJWS(t, map[string]int{"token": 42}), "", ErrTokenMissing},
+		{"object claim", EnvelopeConfig{Claim: "form"}, unsignedJWS(t, nested), "", ErrTokenMissing},
+		{"empty claim", EnvelopeConfig{}, unsignedJWS(t, map[string]string{"cf-turnstile-response": ""}), "", ErrTokenEmpty},
+		{"payload not JSON", EnvelopeConfig{}, "e30." + base64.RawURLEncoding.EncodeToString([]byte("token")) + ".", "", ErrEnvelopeInvalid},
+		{"not a JWS", EnvelopeConfig{}, "token", "", ErrEnvelopeInvalid},
+		{"signed", EnvelopeConfig{PublicKey: publicKeyPEM(t, key)}, signJWS(t, "EdDSA", key, map[string]string{"cf-turnstile-response": "token"}), "token", nil},
+		{"unsigned with a public key", EnvelopeConfig{PublicKey: publicKeyPEM(t, key)}, unsignedJWS(t, map[string]string{"cf-turnstile-response": "token"}), "", ErrEnvelopeSignature},
+	}
+	for _, tt := range tests {
+		for _, header := range []string{"", "X-Envelope"} {
+			config := tt.config
+			config.Header = header
+			e, err := newEnvelope(&config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(tt.value))
+			if header != "" {
+				req = httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader("unrelated body"))
+				req.Header.Set(header, tt.value)
+			}
+			extraction := e.token(req)
+			if extraction.Source != SourceEnvelope || extraction.Token != tt.want || extraction.Err != tt.err {
+				t.Errorf("%s (header %q): got %+v, want token %q, error %v", tt.name, header, extraction, tt.want, tt.err)
+			}
+			if header == "" {
+				if body, _ := io.ReadAll(req.Body); string(body) != tt.value {
+					t.Errorf("%s: body = %q, want it forwarded unchanged", tt.name, body)
+				}
+			}
+		}
+	}
+}
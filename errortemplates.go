@@ -0,0 +1,175 @@
+package turnstile
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"text/template"
+)
+
+const (
+	defaultErrorTemplateContentType = "text/html; charset=utf-8"
+	// errorTemplateDefault is the key of the template used when no other key matches
+	errorTemplateDefault = "default"
+)
+
+// ErrorTemplate renders the response of rejected requests.
+type ErrorTemplate struct {
+	// File is the Go template file, it is read when the configuration is loaded
+	File string `yaml:"file"`
+	// Template is the inline Go template, used when no file is given
+	Template string `yaml:"template"`
+	// ContentType is the content type of the response, HTML content types are rendered with
+	// html/template escaping, if not provided, text/html; charset=utf-8 will be used
+	ContentType string `yaml:"contenttype"`
+}
+
+// errorTemplateData is the data error templates are executed with.
+type errorTemplateData struct {
+	Status     int
+	StatusText string
+	Reason     Reason
+	Message    string
+	ErrorCodes []string
+	Route      string
+	Path       string
+	RequestID  string
+}
+
+// templateExecutor is implemented by text/template and html/template templates.
+type templateExecutor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+type errorTemplate struct {
+	executor    templateExecutor
+	contentType string
+	// html is set for HTML content types
+	html bool
+}
+
+// errorTemplates maps reasons, statuses ("403"), status classes ("4xx") and
+// "default" to their templates.
+type errorTemplates map[string]*errorTemplate
+
+func newErrorTemplates(configured map[string]*ErrorTemplate) (errorTemplates, error) {
+	if len(configured) == 0 {
+		return nil, nil
+	}
+	var problems configErrors
+	keys := make([]string, 0, len(configured))
+	for key := range configured {
+		keys = append(keys, key)
+	}
+	// sorted, so problems are reported in a stable order
+	sort.Strings(keys)
+	templates := make(errorTemplates, len(configured))
+	for _, key := range keys {
+		config := configured[key]
+		if !validErrorTemplateKey(key) {
+			problems.add(fmt.Errorf("invalid errortemplates key %q: expected a rejection reason, a status, a status class like 4xx or default", key))
+			continue
+		}
+		t, err := compileErrorTemplate(key, config)
+		if err != nil {
+			problems.add(fmt.Errorf("invalid errortemplates.%s: %w", key, err))
+			continue
+		}
+		templates[key] = t
+	}
+	return templates, problems.err()
+}
+
+func validErrorTemplateKey(key string) bool {
+	if key == errorTemplateDefault || key == "4xx" || key == "5xx" {
+		return true
+	}
+	if status, err := strconv.Atoi(key); err == nil {
+		return status >= 400 && status <= 599
+	}
+	reason := Reason(key)
+	return reasonIndex(reason) >= 0 && !reason.allows()
+}
+
+func compileErrorTemplate(key string, config *ErrorTemplate) (*errorTemplate, error) {
+	if config == nil {
+		return nil, fmt.Errorf("file or template is required")
+	}
+	text := config.Template
+	if config.File != "" {
+		content, err := os.ReadFile(config.File)
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	}
+	if text == "" {
+		return nil, fmt.Errorf("file or template is required")
+	}
+	t := &errorTemplate{contentType: config.ContentType}
+	if t.contentType == "" {
+		t.contentType = defaultErrorTemplateContentType
+	}
+	mediaType, _, err := mime.ParseMediaType(t.contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid contenttype: %w", err)
+	}
+	t.html = mediaType == "text/html" || mediaType == "application/xhtml+xml"
+	if t.html {
+		t.executor, err = htmltemplate.New(key).Parse(text)
+	} else {
+		t.executor, err = template.New(key).Parse(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// lookup returns the most specific template of d: by reason, status, status
+// class, then default. When the error format was negotiated, only templates
+// of the negotiated kind, HTML or not, are considered.
+func (t errorTemplates) lookup(d *decision, negotiated string) *errorTemplate {
+	status := strconv.Itoa(d.Status)
+	for _, key := range []string{string(d.Reason), status, status[:1] + "xx", errorTemplateDefault} {
+		tmpl, ok := t[key]
+		if ok && (negotiated == "" || tmpl.html == (negotiated == errorFormatHTML)) {
+			return tmpl
+		}
+	}
+	return nil
+}
+
+// write renders the template of d and reports whether a response was written.
+// A failing template is logged and leaves the response to the error format.
+func (t errorTemplates) write(rw http.ResponseWriter, req *http.Request, router *Router, d *decision, negotiated string) bool {
+	tmpl := t.lookup(d, negotiated)
+	if tmpl == nil {
+		return false
+	}
+	var buf bytes.Buffer
+	err := tmpl.executor.Execute(&buf, errorTemplateData{
+		Status:     d.Status,
+		StatusText: http.StatusText(d.Status),
+		Reason:     d.Reason,
+		Message:    d.Message,
+		ErrorCodes: d.ErrorCodes,
+		Route:      router.label(),
+		Path:       req.URL.Path,
+		RequestID:  requestIDFromContext(req.Context()),
+	})
+	if err != nil {
+		logger().ErrorContext(req.Context(), "failed to render error template", "reason", string(d.Reason), "error", err)
+		return false
+	}
+	rw.Header().Set("Content-Type", tmpl.contentType)
+	rw.WriteHeader(d.Status)
+	_, _ = rw.Write(buf.Bytes())
+	return true
+}
@@ -0,0 +1,197 @@
+package turnstile_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/arwoosa/turnstile"
+)
+
+// siteverify is a stand-in for the Cloudflare endpoint that only accepts "valid-token".
+func siteverify() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		resp := map[string]interface{}{"success": true, "hostname": "example.com"}
+		if req.PostForm.Get("response") != "valid-token" {
+			resp = map[string]interface{}{"success": false, "error-codes": []string{"invalid-input-response"}}
+		}
+		_ = json.NewEncoder(rw).Encode(resp)
+	}))
+}
+
+func ExampleNew() {
+	server := siteverify()
+	defer server.Close()
+
+	config := turnstile.CreateConfig()
+	config.TurnstileSecret = "your-turnstile-secret-key"
+	config.VerifyURL = server.URL
+	config.LogLevel = "warn"
+	config.Routers = []turnstile.Router{{Method: http.MethodPost, Path: "/login", FormKey: "cf-turnstile-response"}}
+
+	backend := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, "welcome")
+	})
+	handler, err := turnstile.New(context.Background(), backend, config, "login")
+	if err != nil {
+		panic(err)
+	}
+
+	for _, token := range []string{"valid-token", "forged-token"} {
+		form := url.Values{"cf-turnstile-response": {token}, "user": {"alice"}}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		fmt.Println(token, rec.Code)
+	}
+	// Output:
+	// valid-token 200
+	// forged-token 400
+}
+
+func ExampleVerifyToken() {
+	server := siteverify()
+	defer server.Close()
+
+	config := turnstile.CreateConfig()
+	config.TurnstileSecret = "your-turnstile-secret-key"
+	config.VerifyURL = server.URL
+
+	resp, err := turnstile.VerifyToken(context.Background(), config, "forged-token")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(resp.Success, resp.ErrorCodes)
+	// Output: false [invalid-input-response]
+}
+
+func ExampleVerifier() {
+	server := siteverify()
+	defer server.Close()
+
+	config := turnstile.CreateConfig()
+	config.TurnstileSecret = "your-turnstile-secret-key"
+	config.VerifyURL = server.URL
+
+	// build the verifier once and share it between requests
+	verifier, err := turnstile.NewVerifier(config)
+	if err != nil {
+		panic(err)
+	}
+	for _, token := range []string{"valid-token", "forged-token"} {
+		resp, err := verifier.Verify(context.Background(), token)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(token, resp.Success)
+	}
+	// Output:
+	// valid-token true
+	// forged-token false
+}
+
+func ExampleMiddleware() {
+	server := siteverify()
+	defer server.Close()
+
+	config := turnstile.CreateConfig()
+	config.TurnstileSecret = "your-turnstile-secret-key"
+	config.VerifyURL = server.URL
+	config.LogLevel = "warn"
+	config.Routers = []turnstile.Router{{Method: http.MethodPost, Path: "/api/**", HeaderKey: "X-Turnstile-Token"}}
+
+	protect, err := turnstile.Middleware(context.Background(), config, "api")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", protect(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, "created")
+	})))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/orders", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	fmt.Println(rec.Code, strings.TrimSpace(rec.Body.String()))
+
+	req = httptest.NewRequest(http.MethodPost, "/api/orders", nil)
+	req.Header.Set("X-Turnstile-Token", "valid-token")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	fmt.Println(rec.Code, strings.TrimSpace(rec.Body.String()))
+	// Output:
+	// 400 {"error":"no token provided","request_id":"req-1"}
+	// 200 created
+}
+
+func ExampleCollectorFor() {
+	server := siteverify()
+	defer server.Close()
+
+	config := turnstile.CreateConfig()
+	config.TurnstileSecret = "your-turnstile-secret-key"
+	config.VerifyURL = server.URL
+	config.LogLevel = "warn"
+	config.Routers = []turnstile.Router{{Method: http.MethodPost, Path: "/login", HeaderKey: "X-Turnstile-Token"}}
+
+	handler, err := turnstile.New(context.Background(), http.NotFoundHandler(), config, "login")
+	if err != nil {
+		panic(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.Header.Set("X-Turnstile-Token", "forged-token")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// serve the middleware metrics next to the application's own
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", turnstile.CollectorFor(handler))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, "turnstile_verifications_total") {
+			fmt.Println(line)
+		}
+	}
+	// Output: turnstile_verifications_total{route="POST /login",result="failure"} 1
+}
+
+func ExampleHooks() {
+	server := siteverify()
+	defer server.Close()
+
+	blocked := map[string]bool{"192.0.2.1": true}
+	config := turnstile.CreateConfig()
+	config.TurnstileSecret = "your-turnstile-secret-key"
+	config.VerifyURL = server.URL
+	config.LogLevel = "warn"
+	config.Routers = []turnstile.Router{{Method: http.MethodPost, Path: "/login", HeaderKey: "X-Turnstile-Token"}}
+	config.Hooks = &turnstile.Hooks{
+		OnMatch: func(req *http.Request, route string) error {
+			if host, _, _ := strings.Cut(req.RemoteAddr, ":"); blocked[host] {
+				return errors.New("blocked")
+			}
+			return nil
+		},
+		OnRejected: func(event turnstile.Event) {
+			fmt.Println("rejected", event.Route, event.Reason)
+		},
+	}
+
+	handler, err := turnstile.New(context.Background(), http.NotFoundHandler(), config, "login")
+	if err != nil {
+		panic(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.Header.Set("X-Turnstile-Token", "valid-token")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	// Output: rejected POST /login hook-rejected
+}
@@ -0,0 +1,523 @@
+package turnstile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const defaultFormKey = "cf-turnstile-response"
+
+// defaultAuthScheme is the Authorization scheme read by the authorization source.
+const defaultAuthScheme = "Turnstile"
+
+// maxJSONBodyBytes bounds the size of a JSON body read for a token.
+const maxJSONBodyBytes = 1 << 20
+
+// maxURLEncodedFormBytes bounds the size of a urlencoded form, as in net/http.
+const maxURLEncodedFormBytes = 10 << 20
+
+// TokenSource identifies where a token was extracted from.
+type TokenSource string
+
+// Token sources.
+const (
+	SourceHeader    TokenSource = "header"
+	SourceForm      TokenSource = "form"
+	SourceMultipart TokenSource = "multipart"
+	SourceEnvelope  TokenSource = "envelope"
+	SourceQuery     TokenSource = "query"
+	SourceCookie    TokenSource = "cookie"
+	SourceJSONBody  TokenSource = "jsonbody"
+	SourceGraphQL   TokenSource = "graphql"
+	// SourceAuthorization reads the Authorization header, e.g. "Turnstile <token>"
+	SourceAuthorization TokenSource = "authorization"
+	// SourceExpression is the result of the router's tokenexpr
+	SourceExpression TokenSource = "tokenexpr"
+)
+
+// chainSources are the sources a router can list in tokensources.
+var chainSources = map[TokenSource]bool{
+	SourceHeader:        true,
+	SourceForm:          true,
+	SourceQuery:         true,
+	SourceCookie:        true,
+	SourceJSONBody:      true,
+	SourceGraphQL:       true,
+	SourceAuthorization: true,
+}
+
+// compileTokenSources parses the tokensources of a router.
+func compileTokenSources(names []string) ([]TokenSource, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	var problems configErrors
+	sources := make([]TokenSource, 0, len(names))
+	seen := map[TokenSource]bool{}
+	for _, name := range names {
+		source := TokenSource(strings.ToLower(strings.TrimSpace(name)))
+		switch {
+		case !chainSources[source]:
+			problems.add(fmt.Errorf("invalid tokensources: unknown source %q", name))
+		case seen[source]:
+			problems.add(fmt.Errorf("invalid tokensources: %s is listed twice", source))
+		default:
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	return sources, problems.err()
+}
+
+// Token extraction errors.
+var (
+	// ErrTokenMissing means the source does not carry a token at all
+	ErrTokenMissing = errors.New("no token provided")
+	// ErrTokenEmpty means the source is present but its value is empty
+	ErrTokenEmpty = errors.New("empty token provided")
+	// ErrTokenTooLarge means the token or the payload holding it exceeds its size limit
+	ErrTokenTooLarge = errors.New("token too large")
+	// ErrBodyUnreadable means the request body could not be read
+	ErrBodyUnreadable = errors.New("failed to read request body")
+	// ErrBodyTooLarge means the request body exceeds maxbodybytes
+	ErrBodyTooLarge = errors.New("request body too large")
+	// ErrFormInvalid means the form could not be parsed
+	ErrFormInvalid = errors.New("failed to parse form")
+	// ErrEnvelopeInvalid means the envelope is malformed or its payload is not a JSON object
+	ErrEnvelopeInvalid = errors.New("malformed envelope")
+	// ErrEnvelopeSignature means the envelope signature could not be verified
+	ErrEnvelopeSignature = errors.New("invalid envelope signature")
+)
+
+// Extraction is the result of extracting a token from a request.
+type Extraction struct {
+	Source TokenSource
+	Token  string
+	// Err is one of the token extraction errors when no token could be extracted
+	Err error
+}
+
+func extracted(source TokenSource, token string) Extraction {
+	if token == "" {
+		return Extraction{Source: source, Err: ErrTokenMissing}
+	}
+	return Extraction{Source: source, Token: token}
+}
+
+func failed(source TokenSource, err error) Extraction {
+	return Extraction{Source: source, Err: err}
+}
+
+// reason returns the decision reason of a failed extraction.
+func (e Extraction) reason() Reason {
+	switch e.Err {
+	case ErrTokenMissing:
+		return ReasonMissingToken
+	case ErrTokenEmpty:
+		return ReasonEmptyToken
+	default:
+		return ReasonMalformedRequest
+	}
+}
+
+// extractToken extracts the token from the router's configured source.
+func (t *Router) extractToken(req *http.Request) Extraction {
+	if t.envelope != nil {
+		return t.envelope.token(req)
+	}
+	if t.tokenExpr != nil {
+		return t.tokenExpr.token(req, t)
+	}
+	if len(t.tokenSources) > 0 {
+		return t.extractChain(req)
+	}
+	switch {
+	case t.HeaderKey != "":
+		return t.extractFrom(SourceHeader, req)
+	case t.CookieKey != "":
+		return t.extractFrom(SourceCookie, req)
+	case t.QueryKey != "":
+		return t.extractFrom(SourceQuery, req)
+	case t.JSONKey != "":
+		return t.extractFrom(SourceJSONBody, req)
+	case t.graphql != nil:
+		return t.extractFrom(SourceGraphQL, req)
+	case t.AuthScheme != "":
+		return t.extractFrom(SourceAuthorization, req)
+	}
+	return t.extractFrom(SourceForm, req)
+}
+
+// extractChain walks the token sources of the router in order. The first
+// token found wins; when no source carries one, the first failure other than
+// a missing token is reported, so an empty or malformed source is not hidden
+// by the sources after it.
+func (t *Router) extractChain(req *http.Request) Extraction {
+	var result Extraction
+	for i, source := range t.tokenSources {
+		extraction := t.extractFrom(source, req)
+		if extraction.Err == nil {
+			return extraction
+		}
+		if i == 0 || result.Err == ErrTokenMissing && extraction.Err != ErrTokenMissing {
+			result = extraction
+		}
+	}
+	return result
+}
+
+// extractFrom extracts the token from a single source.
+func (t *Router) extractFrom(source TokenSource, req *http.Request) Extraction {
+	switch source {
+	case SourceHeader:
+		values, ok := req.Header[http.CanonicalHeaderKey(t.HeaderKey)]
+		if !ok {
+			return failed(SourceHeader, ErrTokenMissing)
+		}
+		if len(values) == 0 || values[0] == "" {
+			return failed(SourceHeader, ErrTokenEmpty)
+		}
+		return extracted(SourceHeader, values[0])
+	case SourceQuery:
+		name := t.QueryKey
+		if name == "" {
+			name = t.formKey()
+		}
+		values, ok := req.URL.Query()[name]
+		if ok && (len(values) == 0 || values[0] == "") {
+			return failed(SourceQuery, ErrTokenEmpty)
+		}
+		if !ok {
+			return failed(SourceQuery, ErrTokenMissing)
+		}
+		return extracted(SourceQuery, values[0])
+	case SourceCookie:
+		name := t.CookieKey
+		if name == "" {
+			name = t.formKey()
+		}
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return failed(SourceCookie, ErrTokenMissing)
+		}
+		if cookie.Value == "" {
+			return failed(SourceCookie, ErrTokenEmpty)
+		}
+		return extracted(SourceCookie, cookie.Value)
+	case SourceJSONBody:
+		pointer := t.jsonPointer
+		if pointer == nil {
+			pointer = []string{t.formKey()}
+		}
+		return readJSONBodyToken(req, pointer)
+	case SourceGraphQL:
+		return t.graphql.token(req)
+	case SourceAuthorization:
+		scheme := t.AuthScheme
+		if scheme == "" {
+			scheme = defaultAuthScheme
+		}
+		// a credential of another scheme, e.g. a Bearer token of the API, is not a token
+		name, credentials, _ := strings.Cut(strings.TrimSpace(req.Header.Get("Authorization")), " ")
+		if !strings.EqualFold(name, scheme) {
+			return failed(SourceAuthorization, ErrTokenMissing)
+		}
+		if credentials = strings.TrimSpace(credentials); credentials == "" {
+			return failed(SourceAuthorization, ErrTokenEmpty)
+		}
+		return extracted(SourceAuthorization, credentials)
+	}
+
+	formSource := SourceForm
+	if isMultipart(req) {
+		if t.TokenFirstPart {
+			return readFirstPartToken(req, t.formKeys, t.maxFormBytes)
+		}
+		formSource = SourceMultipart
+	}
+	form, err := readPostForm(req, t.multipartMemory, t.maxFormBytes)
+	if err != nil {
+		return failed(formSource, err)
+	}
+	// like Request.ParseForm, body values take precedence over query values
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return failed(formSource, ErrFormInvalid)
+	}
+	for key, values := range query {
+		form[key] = append(form[key], values...)
+	}
+	return formToken(formSource, form, t.formKeys)
+}
+
+// formToken returns the value of the first of keys carrying a token. A key
+// that is present but empty only counts when no later key carries one.
+func formToken(source TokenSource, form map[string][]string, keys []string) Extraction {
+	result := failed(source, ErrTokenMissing)
+	for _, key := range keys {
+		values, ok := form[key]
+		switch {
+		case !ok:
+		case len(values) == 0 || values[0] == "":
+			result = failed(source, ErrTokenEmpty)
+		default:
+			return extracted(source, values[0])
+		}
+	}
+	return result
+}
+
+// formKey returns the name the token is sent under in forms, and in query
+// strings, cookies and JSON bodies that have no key of their own.
+func (t *Router) formKey() string {
+	return t.formKeys[0]
+}
+
+// compileFormKeys merges FormKey in front of FormKeys, defaulting to
+// cf-turnstile-response.
+func compileFormKeys(r *Router) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, key := range append([]string{r.FormKey}, r.FormKeys...) {
+		key = strings.TrimSpace(key)
+		if key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		keys = []string{defaultFormKey}
+	}
+	return keys
+}
+
+// parseJSONPointer returns the reference tokens of an RFC 6901 JSON pointer,
+// nil when pointer is empty.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer == "/" || !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid jsonkey: %q is not a JSON pointer like /captcha/token", pointer)
+	}
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = unescape.Replace(token)
+	}
+	return tokens, nil
+}
+
+// readJSONBodyToken reads the string at pointer of a JSON body, restoring the
+// body for the backend. Only the values along the pointer are decoded, the
+// rest of the document is skipped as raw JSON. Bodies that are not JSON carry
+// no token.
+func readJSONBodyToken(req *http.Request, pointer []string) Extraction {
+	if req.Body == nil || req.Body == http.NoBody || !isJSON(req) {
+		return failed(SourceJSONBody, ErrTokenMissing)
+	}
+	body, err := peekBody(req, maxJSONBodyBytes)
+	if err != nil {
+		return failed(SourceJSONBody, err)
+	}
+	if !json.Valid(body) {
+		return failed(SourceJSONBody, ErrFormInvalid)
+	}
+	raw := json.RawMessage(body)
+	for _, name := range pointer {
+		var ok bool
+		if raw, ok = jsonChild(raw, name); !ok {
+			return failed(SourceJSONBody, ErrTokenMissing)
+		}
+	}
+	var token string
+	if err := json.Unmarshal(raw, &token); err != nil {
+		return failed(SourceJSONBody, ErrFormInvalid)
+	}
+	if token == "" {
+		return failed(SourceJSONBody, ErrTokenEmpty)
+	}
+	return extracted(SourceJSONBody, token)
+}
+
+// isJSON reports whether the body of req is declared as JSON.
+func isJSON(req *http.Request) bool {
+	mediaType, _, _ := strings.Cut(req.Header.Get("Content-Type"), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// peekBody reads the body of req up to limit bytes and restores it for the
+// backend. The returned bytes are valid until the body is closed. It fails
+// with ErrBodyUnreadable, ErrBodyTooLarge or ErrTokenTooLarge.
+func peekBody(req *http.Request, limit int64) ([]byte, error) {
+	consumed := getBodyBuffer()
+	_, err := consumed.ReadFrom(io.LimitReader(req.Body, limit+1))
+	splice(req, req.Body, consumed)
+	if err != nil {
+		return nil, bodyError(err)
+	}
+	if int64(consumed.Len()) > limit {
+		return nil, ErrTokenTooLarge
+	}
+	return consumed.Bytes(), nil
+}
+
+// jsonChild returns the member name of a JSON object, or the element at index
+// name of a JSON array.
+func jsonChild(raw json.RawMessage, name string) (json.RawMessage, bool) {
+	switch first := bytes.TrimLeft(raw, " \t\r\n"); {
+	case len(first) > 0 && first[0] == '{':
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(raw, &fields) != nil {
+			return nil, false
+		}
+		child, ok := fields[name]
+		return child, ok
+	case len(first) > 0 && first[0] == '[':
+		index, err := strconv.Atoi(name)
+		if err != nil || index < 0 {
+			return nil, false
+		}
+		var elements []json.RawMessage
+		if json.Unmarshal(raw, &elements) != nil || index >= len(elements) {
+			return nil, false
+		}
+		return elements[index], true
+	}
+	return nil, false
+}
+
+// applyFormKey sets the form keys of a router that configures no token source,
+// or whose token sources name the token in a form, query, cookie or JSON body.
+func (t *Router) applyFormKey(formKey string, formKeys []string) {
+	if t.Envelope == nil && t.FormKey == "" && len(t.FormKeys) == 0 && (len(t.TokenSources) > 0 || t.HeaderKey == "" && t.CookieKey == "" && t.QueryKey == "" && t.JSONKey == "" && t.GraphQL == nil && t.AuthScheme == "" && t.TokenExpr == "") {
+		t.FormKey = formKey
+		t.FormKeys = formKeys
+	}
+}
+
+// readsForm reports whether the router looks for the token in a form, which
+// an HTML page can submit.
+func (t *Router) readsForm() bool {
+	if t.envelope != nil {
+		return false
+	}
+	if len(t.tokenSources) > 0 {
+		return hasSource(t.tokenSources, SourceForm)
+	}
+	return t.HeaderKey == "" && t.CookieKey == "" && t.QueryKey == "" && t.JSONKey == "" && t.graphql == nil && t.AuthScheme == "" && t.tokenExpr == nil
+}
+
+// readsBody reports whether extracting the token may read the request body.
+func (t *Router) readsBody() bool {
+	switch {
+	case t.envelope != nil:
+		return t.envelope.header == ""
+	case t.tokenExpr != nil:
+		return t.tokenExpr.readsBody
+	case len(t.tokenSources) > 0:
+		return hasSource(t.tokenSources, SourceForm) || hasSource(t.tokenSources, SourceJSONBody) ||
+			hasSource(t.tokenSources, SourceGraphQL)
+	}
+	return t.HeaderKey == "" && t.CookieKey == "" && t.QueryKey == "" && t.AuthScheme == ""
+}
+
+// bodyError returns the extraction error of a failed read of a request body.
+func bodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return ErrBodyTooLarge
+	}
+	return ErrBodyUnreadable
+}
+
+// limitBody bounds the bytes read from body to limit, reads past it fail with
+// an *http.MaxBytesError mapped to ErrBodyTooLarge by bodyError.
+func limitBody(body io.ReadCloser, limit int64) io.Reader {
+	// without a ResponseWriter, the server is not asked to close the connection
+	return http.MaxBytesReader(nil, body, limit)
+}
+
+// readPostForm parses the urlencoded or multipart form in the body of req,
+// reading the body once and restoring it for the backend. Multipart forms are
+// read through a tee that keeps up to maxMemory of the consumed bytes in
+// memory and spools the others to a temporary file removed with the body;
+// ReadForm likewise holds up to maxMemory bytes and spools larger files to
+// temporary files that are removed before returning. Bodies over limit fail
+// with ErrBodyTooLarge.
+func readPostForm(req *http.Request, maxMemory, limit int64) (url.Values, error) {
+	form := url.Values{}
+	if req.Body == nil || req.Body == http.NoBody {
+		return form, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		// Request.ParseForm leaves bodies of unknown types alone, and so does this
+		return form, nil
+	}
+	urlEncoded := mediaType == "application/x-www-form-urlencoded" &&
+		(req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch)
+	if !urlEncoded && mediaType != "multipart/form-data" {
+		return form, nil
+	}
+
+	body := req.Body
+	if urlEncoded {
+		consumed := getBodyBuffer()
+		defer splice(req, body, consumed)
+		// the buffer keeps the bytes for the backend, they are not collected a second time
+		n, err := consumed.ReadFrom(io.LimitReader(limitBody(body, limit), maxURLEncodedFormBytes+1))
+		if err != nil {
+			return nil, bodyError(err)
+		}
+		if n > maxURLEncodedFormBytes {
+			return nil, ErrFormInvalid
+		}
+		if form, err = url.ParseQuery(consumed.String()); err != nil {
+			return nil, ErrFormInvalid
+		}
+		return form, nil
+	}
+
+	if params["boundary"] == "" {
+		return nil, ErrFormInvalid
+	}
+	consumed := newBodySpool(maxMemory)
+	defer consumed.splice(req, body)
+	reader := io.TeeReader(limitBody(body, limit), consumed)
+	multipartForm, err := multipart.NewReader(reader, params["boundary"]).ReadForm(maxMemory)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case consumed.err != nil:
+		return nil, ErrBodyUnreadable
+	case errors.As(err, &tooLarge), errors.Is(err, multipart.ErrMessageTooLarge):
+		// the values of the form do not fit in maxMemory
+		return nil, ErrBodyTooLarge
+	case err != nil:
+		return nil, ErrFormInvalid
+	}
+	// only the values are needed, spooled files are removed right away
+	_ = multipartForm.RemoveAll()
+	for key, values := range multipartForm.Value {
+		form[key] = values
+	}
+	// ReadForm stops at the closing boundary, the epilogue is read for the
+	// backend to receive the body exactly as sent
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		if consumed.err != nil {
+			return nil, ErrBodyUnreadable
+		}
+		return nil, bodyError(err)
+	}
+	return form, nil
+}
@@ -0,0 +1,64 @@
+package turnstile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Experimental subsystems gated behind a feature flag. They stay disabled
+// unless enabled in the features map, so they can ship incrementally without
+// changing the default behavior.
+const (
+	featureInjection          = "injection"
+	featureInterstitial       = "interstitial"
+	featureExpressionPolicies = "expressionpolicies"
+)
+
+var knownFeatures = map[string]bool{
+	featureInjection:          true,
+	featureInterstitial:       true,
+	featureExpressionPolicies: true,
+}
+
+// features is the set of enabled feature flags.
+type features map[string]bool
+
+// newFeatures validates the configured flags, an unknown name is an error
+// rather than silently ignored since it is most likely a typo.
+func newFeatures(configured map[string]bool) (features, error) {
+	var problems configErrors
+	enabled := make(features, len(configured))
+	for _, name := range sortedKeys(configured) {
+		if !knownFeatures[name] {
+			problems.add(fmt.Errorf("unknown feature %q", name))
+			continue
+		}
+		if configured[name] {
+			enabled[name] = true
+		}
+	}
+	return enabled, problems.err()
+}
+
+// enabled reports whether the feature named name is switched on.
+func (f features) enabled(name string) bool {
+	return f[name]
+}
+
+// log reports the enabled features once the configuration is accepted.
+func (f features) log() {
+	if len(f) == 0 {
+		return
+	}
+	logger().Info("experimental features enabled", "features", strings.Join(sortedKeys(f), ","))
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,232 @@
+package turnstile
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGraceMaxDuration = time.Hour
+	// graceCheckInterval limits how often the grace file is stat'ed
+	graceCheckInterval = time.Second
+)
+
+// graceMode lets operators keep traffic flowing during announced Cloudflare
+// maintenance: while the grace file exists, recently expired sessions are
+// extended and new tokens are admitted regardless of the verification result.
+// Every admission is written to an audit trail.
+type graceMode struct {
+	file        string
+	maxDuration time.Duration
+	extension   time.Duration
+	// auditLog is nil when admissions are logged instead of written to a file
+	auditLog *graceAuditLog
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	active    bool
+	// since is when the current grace period started, zero while the file is absent
+	since time.Time
+}
+
+// newGraceMode returns nil when grace mode is not configured.
+func newGraceMode(config *Config) (*graceMode, error) {
+	if config.GraceFile == "" {
+		return nil, nil
+	}
+	grace := &graceMode{
+		file:        config.GraceFile,
+		maxDuration: defaultGraceMaxDuration,
+	}
+	if config.GraceAuditFile != "" {
+		grace.auditLog = &graceAuditLog{file: config.GraceAuditFile}
+	}
+	if config.GraceMaxDuration != "" {
+		d, err := time.ParseDuration(config.GraceMaxDuration)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid gracemaxduration: %s", config.GraceMaxDuration)
+		}
+		grace.maxDuration = d
+	}
+	switch {
+	case config.GraceSessionExtension != "":
+		d, err := time.ParseDuration(config.GraceSessionExtension)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid gracesessionextension: %s", config.GraceSessionExtension)
+		}
+		grace.extension = d
+	case config.SessionTTL != "":
+		// already validated by newSessionManager
+		grace.extension, _ = time.ParseDuration(config.SessionTTL)
+	}
+	return grace, nil
+}
+
+// isActive reports whether grace mode is currently enabled.
+func (g *graceMode) isActive() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if now.Sub(g.checkedAt) < graceCheckInterval {
+		return g.active
+	}
+	g.checkedAt = now
+	g.active = g.read(now)
+	return g.active
+}
+
+// read evaluates the grace file, grace mode ends at the time written in the
+// file or after maxDuration since the grace period started, whichever comes
+// first. The period starts when the file is first seen, or when it was last
+// modified if that is earlier, so touching the file does not extend it.
+func (g *graceMode) read(now time.Time) bool {
+	info, err := os.Stat(g.file)
+	if err != nil {
+		g.since = time.Time{}
+		return false
+	}
+	if g.since.IsZero() {
+		g.since = now
+		if modified := info.ModTime(); modified.Before(now) {
+			g.since = modified
+		}
+	}
+	until := g.since.Add(g.maxDuration)
+	content, err := os.ReadFile(g.file)
+	if err != nil {
+		return false
+	}
+	if value := strings.TrimSpace(string(content)); value != "" {
+		end, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			logger().Warn("ignoring invalid end time in grace file", "file", g.file, "error", err)
+		} else if end.Before(until) {
+			until = end
+		}
+	}
+	return now.Before(until)
+}
+
+// graceAuditRecord is a single entry of the grace mode audit trail.
+type graceAuditRecord struct {
+	Time       string   `json:"time"`
+	Kind       string   `json:"kind"`
+	Method     string   `json:"method"`
+	Path       string   `json:"path"`
+	ClientIP   string   `json:"client_ip"`
+	Verified   bool     `json:"verified"`
+	ErrorCodes []string `json:"error_codes,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// audit records a request admitted under grace mode, kind is either
+// "session" for an extended session or "token" for a shadow-verified token.
+func (g *graceMode) audit(req *http.Request, kind string, resp *VerifyResponse, verifyErr error) {
+	record := graceAuditRecord{
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Kind:     kind,
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		ClientIP: clientIP(req).String(),
+	}
+	if resp != nil {
+		record.Verified = resp.Success
+		record.ErrorCodes = resp.ErrorCodes
+	}
+	if verifyErr != nil {
+		record.Error = verifyErr.Error()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	if g.auditLog == nil {
+		logger().Info("grace admission", "record", string(line))
+		return
+	}
+	g.auditLog.append(line)
+}
+
+// graceAuditMaxPending bounds the records queued for the audit file, those
+// arriving past it are written to the log instead.
+const graceAuditMaxPending = 1 << 20
+
+// graceAuditLog appends records to the audit file on the background worker
+// pool. Records arriving during a write are queued in memory up to
+// graceAuditMaxPending bytes rather than dropped.
+type graceAuditLog struct {
+	file string
+
+	mu      sync.Mutex
+	pending []byte
+	// writing is set while a write of pending is queued or running
+	writing bool
+}
+
+func (l *graceAuditLog) append(line []byte) {
+	l.mu.Lock()
+	if len(l.pending)+len(line) >= graceAuditMaxPending {
+		l.mu.Unlock()
+		// the record still reaches the trail through the log
+		logger().Warn("grace audit file is falling behind, logging the record instead", "file", l.file)
+		logger().Info("grace admission", "record", string(line))
+		return
+	}
+	l.pending = append(append(l.pending, line...), '\n')
+	start := !l.writing
+	l.writing = true
+	l.mu.Unlock()
+	if start {
+		l.submit()
+	}
+}
+
+// submit queues a write of the pending records. When the queue is full the
+// records stay pending for the next append to submit.
+func (l *graceAuditLog) submit() {
+	if !background.submit("grace-audit-write", l.drain) {
+		l.mu.Lock()
+		l.writing = false
+		l.mu.Unlock()
+	}
+}
+
+// drain writes the pending records, then queues another write for those
+// arriving meanwhile rather than holding a worker while requests keep coming.
+func (l *graceAuditLog) drain() {
+	l.mu.Lock()
+	batch := l.pending
+	l.pending = nil
+	if len(batch) == 0 {
+		l.writing = false
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+	if err := l.write(batch); err != nil {
+		// the records still reach the trail through the log
+		logger().Error("failed to write grace audit file, logging the records instead", "file", l.file, "error", err)
+		for _, line := range strings.Split(strings.TrimSuffix(string(batch), "\n"), "\n") {
+			logger().Info("grace admission", "record", line)
+		}
+	}
+	l.submit()
+}
+
+func (l *graceAuditLog) write(batch []byte) error {
+	f, err := os.OpenFile(l.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(batch); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
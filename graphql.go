@@ -0,0 +1,285 @@
+package turnstile
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const defaultGraphQLVariable = "turnstileToken"
+
+// GraphQLConfig reads the token from the variables of GraphQL requests and
+// optionally restricts the router to some operations, so a single endpoint
+// can protect only its mutations.
+type GraphQLConfig struct {
+	// Variable is the operation variable carrying the token, if not provided, turnstileToken will be used
+	Variable string `yaml:"variable"`
+	// Operations are the operation names the router protects, if not provided, every operation will be protected
+	Operations []string `yaml:"operations"`
+}
+
+// graphQLOperation is a GraphQL request as sent over HTTP.
+type graphQLOperation struct {
+	Query         string                     `json:"query"`
+	OperationName string                     `json:"operationName"`
+	Variables     map[string]json.RawMessage `json:"variables"`
+}
+
+// name returns the name of the operation the server executes, empty when it
+// is anonymous or cannot be told for certain: the document does not parse, it
+// holds several operations without an operationName to choose one, or
+// operationName names no single operation of the document.
+func (o graphQLOperation) name() string {
+	names, ok := graphQLOperationNames(o.Query)
+	if !ok {
+		return ""
+	}
+	if o.OperationName == "" {
+		if len(names) == 1 {
+			return names[0]
+		}
+		return ""
+	}
+	found := 0
+	for _, name := range names {
+		if name == o.OperationName {
+			found++
+		}
+	}
+	if found != 1 {
+		return ""
+	}
+	return o.OperationName
+}
+
+// graphQLOperationNames returns the names of the operations defined by a
+// GraphQL document in order, the empty string for anonymous ones. Only the
+// top level of the document is considered, so names in comments, strings and
+// selection sets are never taken for operations. ok is false when the
+// document cannot be tokenized.
+func graphQLOperationNames(document string) (names []string, ok bool) {
+	tokens, ok := lexGraphQL(document)
+	if !ok {
+		return nil, false
+	}
+	depth := 0
+	// inDefinition is set between the keyword of a definition and its selection set
+	inDefinition := false
+	for i, token := range tokens {
+		switch token {
+		case "{", "(", "[":
+			if token == "{" && depth == 0 {
+				if !inDefinition {
+					// the query shorthand is an anonymous operation
+					names = append(names, "")
+				}
+				inDefinition = false
+			}
+			depth++
+		case "}", ")", "]":
+			if depth--; depth < 0 {
+				return nil, false
+			}
+		case "query", "mutation", "subscription":
+			if depth > 0 || inDefinition {
+				continue
+			}
+			inDefinition = true
+			name := ""
+			if i+1 < len(tokens) && isGraphQLName(tokens[i+1]) {
+				name = tokens[i+1]
+			}
+			names = append(names, name)
+		case "fragment":
+			if depth == 0 && !inDefinition {
+				inDefinition = true
+			}
+		}
+	}
+	return names, depth == 0
+}
+
+// lexGraphQL splits a GraphQL document into its names and punctuators.
+// Comments, white space and commas are dropped, and every string and number
+// becomes a placeholder token that no name equals.
+func lexGraphQL(document string) ([]string, bool) {
+	var tokens []string
+	for i := 0; i < len(document); {
+		c := document[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(document) && document[i] != '\n' && document[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(document[i:], `"""`):
+			// a block string ends at the first """ not escaped as \"""
+			end := i + 3
+			for {
+				next := strings.Index(document[end:], `"""`)
+				if next < 0 {
+					return nil, false
+				}
+				end += next
+				if document[end-1] != '\\' {
+					break
+				}
+				end += 3
+			}
+			tokens = append(tokens, `""`)
+			i = end + 3
+		case c == '"':
+			i++
+			for ; i < len(document) && document[i] != '"'; i++ {
+				switch document[i] {
+				case '\\':
+					i++
+				case '\n', '\r':
+					return nil, false
+				}
+			}
+			if i >= len(document) {
+				return nil, false
+			}
+			tokens = append(tokens, `""`)
+			i++
+		case isGraphQLNameStart(c):
+			start := i
+			for i < len(document) && (isGraphQLNameStart(document[i]) || '0' <= document[i] && document[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, document[start:i])
+		case c == '-' || '0' <= c && c <= '9':
+			for i++; i < len(document) && strings.IndexByte("0123456789.eE+-", document[i]) >= 0; i++ {
+			}
+			tokens = append(tokens, "0")
+		case strings.HasPrefix(document[i:], "..."):
+			tokens = append(tokens, "...")
+			i += 3
+		case strings.IndexByte("{}()[]:=@$!|&", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			return nil, false
+		}
+	}
+	return tokens, true
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isGraphQLName(token string) bool {
+	return token != "" && isGraphQLNameStart(token[0])
+}
+
+// graphQL extracts tokens from GraphQL requests.
+type graphQL struct {
+	variable string
+	// operations is nil when every operation is protected
+	operations map[string]bool
+}
+
+// newGraphQL returns nil when the router does not read GraphQL requests.
+func newGraphQL(config *GraphQLConfig) (*graphQL, error) {
+	if config == nil {
+		return nil, nil
+	}
+	g := &graphQL{variable: config.Variable}
+	if g.variable == "" {
+		g.variable = defaultGraphQLVariable
+	}
+	if len(config.Operations) > 0 {
+		g.operations = make(map[string]bool, len(config.Operations))
+		for _, name := range config.Operations {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return nil, errors.New("graphql.operations cannot contain an empty name")
+			}
+			g.operations[name] = true
+		}
+	}
+	return g, nil
+}
+
+// matches reports whether req runs a protected operation. Requests whose
+// operations cannot be read or are anonymous are protected, so that a
+// malformed body never bypasses verification.
+func (g *graphQL) matches(req *http.Request) bool {
+	if g == nil || g.operations == nil {
+		return true
+	}
+	operations, err := readGraphQLOperations(req)
+	if err != nil || len(operations) == 0 {
+		return true
+	}
+	for _, operation := range operations {
+		if name := operation.name(); name == "" || g.operations[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// token extracts the token from the variables of the first operation
+// carrying it, batched requests included.
+func (g *graphQL) token(req *http.Request) Extraction {
+	operations, err := readGraphQLOperations(req)
+	if err != nil {
+		return failed(SourceGraphQL, err)
+	}
+	for _, operation := range operations {
+		raw, ok := operation.Variables[g.variable]
+		if !ok {
+			continue
+		}
+		var token string
+		if err := json.Unmarshal(raw, &token); err != nil {
+			return failed(SourceGraphQL, ErrFormInvalid)
+		}
+		if token == "" {
+			return failed(SourceGraphQL, ErrTokenEmpty)
+		}
+		return extracted(SourceGraphQL, token)
+	}
+	return failed(SourceGraphQL, ErrTokenMissing)
+}
+
+// readGraphQLOperations reads the operations of a GET request from its query
+// string, and those of a POST request from its JSON body, which may batch
+// several operations in an array. The body is restored for the backend.
+func readGraphQLOperations(req *http.Request) ([]graphQLOperation, error) {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		query := req.URL.Query()
+		operation := graphQLOperation{Query: query.Get("query"), OperationName: query.Get("operationName")}
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &operation.Variables); err != nil {
+				return nil, ErrFormInvalid
+			}
+		}
+		return []graphQLOperation{operation}, nil
+	}
+	if req.Body == nil || req.Body == http.NoBody || !isJSON(req) {
+		return nil, nil
+	}
+	body, err := peekBody(req, maxJSONBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	body = []byte(strings.TrimSpace(string(body)))
+	if strings.HasPrefix(string(body), "[") {
+		var batch []graphQLOperation
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, ErrFormInvalid
+		}
+		return batch, nil
+	}
+	var operation graphQLOperation
+	if err := json.Unmarshal(body, &operation); err != nil {
+		return nil, ErrFormInvalid
+	}
+	return []graphQLOperation{operation}, nil
+}
@@ -0,0 +1,74 @@
+package turnstile
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGraphQLOperationName(t *testing.T) {
+	tests := []struct {
+		name, query, operationName, want string
+	}{
+		{"named", "mutation Transfer($to: ID!) { send(to: $to) { id } }", "", "Transfer"},
+		{"operation name selects", "query Harmless { me { id } }\nmutation Transfer { send { id } }", "Transfer", "Transfer"},
+		{"name in a comment", "# query Harmless\nmutation Transfer { send { id } }", "", "Transfer"},
+		{"name in a string", `mutation Transfer { send(note: "query Harmless") { id } }`, "", "Transfer"},
+		{"name in an escaped string", `mutation Transfer { send(note: "\" query Harmless") { id } }`, "", "Transfer"},
+		{"name in a block string", `mutation Transfer { send(note: """query Harmless \""" query Other""") { id } }`, "", "Transfer"},
+		{"field named like a keyword", "mutation Transfer { query { id } }", "", "Transfer"},
+		{"fragment", "fragment Parts on User { id }\nmutation Transfer { send { ...Parts } }", "", "Transfer"},
+		{"anonymous mutation", "mutation { send { id } }", "", ""},
+		{"query shorthand", "{ me { id } }", "", ""},
+		{"several operations without operation name", "query Harmless { me { id } }\nmutation Transfer { send { id } }", "", ""},
+		{"operation name absent from the document", "mutation Transfer { send { id } }", "Harmless", ""},
+		{"operation name defined twice", "query Harmless { me { id } }\nmutation Harmless { send { id } }", "Harmless", ""},
+		{"unterminated string", `mutation Transfer { send(note: "query Harmless) { id } }`, "", ""},
+		{"unbalanced braces", "mutation Transfer { send { id }", "", ""},
+		{"operation name without a document", "", "Harmless", ""},
+	}
+	for _, tt := range tests {
+		operation := graphQLOperation{Query: tt.query, OperationName: tt.operationName}
+		if got := operation.name(); got != tt.want {
+			t.Errorf("%s: name = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGraphQLMatches(t *testing.T) {
+	g, err := newGraphQL(&GraphQLConfig{Operations: []string{"Transfer"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	operation := func(query, operationName string) map[string]string {
+		return map[string]string{"query": query, "operationName": operationName}
+	}
+	tests := []struct {
+		name string
+		body interface{}
+		want bool
+	}{
+		{"listed", operation("mutation Transfer { send { id } }", ""), true},
+		{"unlisted", operation("query Harmless { me { id } }", ""), false},
+		{"listed behind a comment", operation("# query Harmless\nmutation Transfer { send { id } }", ""), true},
+		{"listed behind a string", operation(`mutation Transfer { send(note: "query Harmless") { id } }`, ""), true},
+		{"anonymous", operation("mutation { send { id } }", ""), true},
+		{"batch with a listed operation", []interface{}{operation("query Harmless { me { id } }", ""), operation("mutation Transfer { send { id } }", "")}, true},
+		{"batch of unlisted operations", []interface{}{operation("query Harmless { me { id } }", ""), operation("query Other { me { id } }", "")}, false},
+		{"batch with an anonymous operation", []interface{}{operation("query Harmless { me { id } }", ""), operation("{ me { id } }", "")}, true},
+		{"ambiguous document", operation("query Harmless { me { id } }\nmutation Transfer { send { id } }", ""), true},
+	}
+	for _, tt := range tests {
+		body, err := json.Marshal(tt.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		if got := g.matches(req); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package turnstile
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// resolveGroups returns a copy of routers where every member of a group
+// inherits the group's settings it does not set itself.
+func resolveGroups(routers []Router, groups map[string]*Router) ([]Router, error) {
+	resolved := make([]Router, len(routers))
+	copy(resolved, routers)
+	var problems configErrors
+	for i := range resolved {
+		if resolved[i].Group == "" {
+			continue
+		}
+		group, ok := groups[resolved[i].Group]
+		if !ok || group == nil {
+			problems.add(fmt.Errorf("router %s: unknown group %q", resolved[i].label(), resolved[i].Group))
+			continue
+		}
+		inherit(&resolved[i], group)
+	}
+	return resolved, problems.err()
+}
+
+// tokenSourceFields select where a token is read from, a member setting any
+// of them replaces the token source of its group rather than merging with it.
+var tokenSourceFields = map[string]bool{"HeaderKey": true, "FormKey": true, "FormKeys": true, "CookieKey": true, "QueryKey": true, "JSONKey": true, "GraphQL": true, "AuthScheme": true, "TokenExpr": true, "TokenFirstPart": true, "Envelope": true, "TokenSources": true}
+
+// inherit copies every option set in group that member leaves at its zero value.
+func inherit(member, group *Router) {
+	dst := reflect.ValueOf(member).Elem()
+	src := reflect.ValueOf(group).Elem()
+	ownSource := false
+	for name := range tokenSourceFields {
+		if !dst.FieldByName(name).IsZero() {
+			ownSource = true
+		}
+	}
+	for i := 0; i < src.NumField(); i++ {
+		field := src.Type().Field(i)
+		if !field.IsExported() || field.Name == "Group" || ownSource && tokenSourceFields[field.Name] {
+			continue
+		}
+		if dst.Field(i).IsZero() && !src.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
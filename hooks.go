@@ -0,0 +1,86 @@
+package turnstile
+
+import (
+	"net/http"
+	"time"
+)
+
+// Hooks are callbacks programmatic users of the package can set in
+// Config.Hooks to integrate custom metrics, blocking lists or notifications.
+// Hooks are called synchronously on the request path, so they must be fast
+// and safe for concurrent use. Unset hooks are skipped.
+type Hooks struct {
+	// OnMatch is called when a request matches a protected router, after blocked IPs, bans,
+	// the maintenance action and the bypasses (trusted IPs, signed bypasses, client certificates,
+	// API keys, auth sessions, verified bots), which skip it, and before sessions and tokens are checked.
+	// A non-nil error rejects the request with status 403 and the error as message.
+	OnMatch func(req *http.Request, route string) error
+	// OnVerified is called for requests allowed by a verified token, a session or a pre-clearance
+	OnVerified func(event Event)
+	// OnRejected is called for every rejected request
+	OnRejected func(event Event)
+	// OnError is called when siteverify could not be reached or answered unexpectedly,
+	// whether the request is then rejected or admitted by the failure policy or grace mode
+	OnError func(event Event)
+}
+
+// Event describes the decision on a request to a protected router.
+type Event struct {
+	Request *http.Request
+	// Route is the label of the matched router, e.g. "POST /login"
+	Route  string
+	Reason Reason
+	// Status is the response status of a rejected request
+	Status int
+	// ErrorCodes are the error codes returned by siteverify
+	ErrorCodes []string
+	// Err is the error verifying the token, it is only set for OnError
+	Err error
+	// Duration is the time spent deciding
+	Duration time.Duration
+}
+
+// match calls OnMatch.
+func (h *Hooks) match(req *http.Request, router *Router) error {
+	if h == nil || h.OnMatch == nil {
+		return nil
+	}
+	return h.OnMatch(req, router.label())
+}
+
+// decided calls the hooks observing d.
+func (h *Hooks) decided(req *http.Request, router *Router, d *decision) {
+	if h == nil {
+		return
+	}
+	event := Event{
+		Request:    req,
+		Route:      router.label(),
+		Reason:     d.Reason,
+		Status:     d.Status,
+		ErrorCodes: d.ErrorCodes,
+		Duration:   d.Duration,
+	}
+	if d.Err != nil && h.OnError != nil {
+		errEvent := event
+		errEvent.Err = d.Err
+		h.OnError(errEvent)
+	}
+	switch {
+	case !d.Allowed && h.OnRejected != nil:
+		h.OnRejected(event)
+	case d.Allowed && d.Reason.verified() && h.OnVerified != nil:
+		h.OnVerified(event)
+	}
+}
+
+// verified reports whether requests allowed for reason passed a challenge,
+// directly or through a session or pre-clearance it issued.
+func (r Reason) verified() bool {
+	switch r {
+	case ReasonVerified, ReasonSession, ReasonPreClearance:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,33 @@
+package turnstile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHooksOnVerifiedReasons(t *testing.T) {
+	tests := []struct {
+		reason Reason
+		want   bool
+	}{
+		{ReasonVerified, true},
+		{ReasonSession, true},
+		{ReasonPreClearance, true},
+		{ReasonGrace, false},
+		{ReasonLowVelocity, false},
+		{ReasonFailOpen, false},
+		{ReasonTrustedIP, false},
+		{ReasonAPIKey, false},
+	}
+	router := &Router{Method: http.MethodPost, Path: "/login"}
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	for _, tt := range tests {
+		called := false
+		hooks := &Hooks{OnVerified: func(Event) { called = true }}
+		hooks.decided(req, router, allow(tt.reason))
+		if called != tt.want {
+			t.Errorf("%s: OnVerified called = %v, want %v", tt.reason, called, tt.want)
+		}
+	}
+}
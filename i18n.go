@@ -0,0 +1,134 @@
+package turnstile
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultLanguage = "en"
+
+// messageCatalog holds the client-facing message of every rejection reason
+// per language. Reasons without a message keep their original one.
+var messageCatalog = map[string]map[Reason]string{
+	"en": {
+		ReasonMissingToken:       "Please complete the security check and try again.",
+		ReasonEmptyToken:         "Please complete the security check and try again.",
+		ReasonMalformedRequest:   "The request could not be read.",
+		ReasonVerificationFailed: "The security check failed, please try again.",
+		ReasonVerificationError:  "The security check is temporarily unavailable, please try again later.",
+		ReasonMaintenance:        "Temporarily unavailable, please try again later.",
+	},
+	"de": {
+		ReasonMissingToken:       "Bitte schließen Sie die Sicherheitsprüfung ab und versuchen Sie es erneut.",
+		ReasonEmptyToken:         "Bitte schließen Sie die Sicherheitsprüfung ab und versuchen Sie es erneut.",
+		ReasonMalformedRequest:   "Die Anfrage konnte nicht gelesen werden.",
+		ReasonVerificationFailed: "Die Sicherheitsprüfung ist fehlgeschlagen, bitte versuchen Sie es erneut.",
+		ReasonVerificationError:  "Die Sicherheitsprüfung ist vorübergehend nicht verfügbar, bitte versuchen Sie es später erneut.",
+		ReasonMaintenance:        "Vorübergehend nicht verfügbar, bitte versuchen Sie es später erneut.",
+	},
+	"fr": {
+		ReasonMissingToken:       "Veuillez effectuer la vérification de sécurité et réessayer.",
+		ReasonEmptyToken:         "Veuillez effectuer la vérification de sécurité et réessayer.",
+		ReasonMalformedRequest:   "La requête n'a pas pu être lue.",
+		ReasonVerificationFailed: "La vérification de sécurité a échoué, veuillez réessayer.",
+		ReasonVerificationError:  "La vérification de sécurité est temporairement indisponible, veuillez réessayer plus tard.",
+		ReasonMaintenance:        "Temporairement indisponible, veuillez réessayer plus tard.",
+	},
+	"es": {
+		ReasonMissingToken:       "Completa la verificación de seguridad e inténtalo de nuevo.",
+		ReasonEmptyToken:         "Completa la verificación de seguridad e inténtalo de nuevo.",
+		ReasonMalformedRequest:   "No se pudo leer la solicitud.",
+		ReasonVerificationFailed: "La verificación de seguridad ha fallado, inténtalo de nuevo.",
+		ReasonVerificationError:  "La verificación de seguridad no está disponible temporalmente, inténtalo más tarde.",
+		ReasonMaintenance:        "No disponible temporalmente, inténtalo más tarde.",
+	},
+	"pt": {
+		ReasonMissingToken:       "Conclua a verificação de segurança e tente novamente.",
+		ReasonEmptyToken:         "Conclua a verificação de segurança e tente novamente.",
+		ReasonMalformedRequest:   "Não foi possível ler a solicitação.",
+		ReasonVerificationFailed: "A verificação de segurança falhou, tente novamente.",
+		ReasonVerificationError:  "A verificação de segurança está temporariamente indisponível, tente novamente mais tarde.",
+		ReasonMaintenance:        "Temporariamente indisponível, tente novamente mais tarde.",
+	},
+	"ja": {
+		ReasonMissingToken:       "セキュリティチェックを完了してから、もう一度お試しください。",
+		ReasonEmptyToken:         "セキュリティチェックを完了してから、もう一度お試しください。",
+		ReasonMalformedRequest:   "リクエストを読み取れませんでした。",
+		ReasonVerificationFailed: "セキュリティチェックに失敗しました。もう一度お試しください。",
+		ReasonVerificationError:  "セキュリティチェックは一時的に利用できません。しばらくしてからもう一度お試しください。",
+		ReasonMaintenance:        "一時的に利用できません。しばらくしてからもう一度お試しください。",
+	},
+	"zh": {
+		ReasonMissingToken:       "请完成安全验证后重试。",
+		ReasonEmptyToken:         "请完成安全验证后重试。",
+		ReasonMalformedRequest:   "无法读取请求。",
+		ReasonVerificationFailed: "安全验证失败，请重试。",
+		ReasonVerificationError:  "安全验证暂时不可用，请稍后重试。",
+		ReasonMaintenance:        "暂时无法使用，请稍后重试。",
+	},
+}
+
+// localizer selects the language of client-facing messages from the
+// Accept-Language header of a request.
+type localizer struct {
+	fallback string
+}
+
+// newLocalizer returns nil when localization is not enabled.
+func newLocalizer(config *Config) (*localizer, error) {
+	if !config.Localize {
+		if config.DefaultLanguage != "" {
+			return nil, fmt.Errorf("defaultlanguage requires localize")
+		}
+		return nil, nil
+	}
+	l := &localizer{fallback: strings.ToLower(config.DefaultLanguage)}
+	if l.fallback == "" {
+		l.fallback = defaultLanguage
+	}
+	if _, ok := messageCatalog[l.fallback]; !ok {
+		return nil, fmt.Errorf("invalid defaultlanguage: %s, supported languages are %s", config.DefaultLanguage, strings.Join(catalogLanguages(), ", "))
+	}
+	return l, nil
+}
+
+// message returns the message of d in language.
+func (l *localizer) message(language string, d *decision) string {
+	if message, ok := messageCatalog[language][d.Reason]; ok {
+		return message
+	}
+	return d.Message
+}
+
+// language returns the catalog language with the highest quality in the
+// Accept-Language header, matched by primary subtag, or the fallback.
+func (l *localizer) language(acceptLanguage string) string {
+	best, bestQuality := l.fallback, 0.0
+	for _, item := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			quality = q
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if _, ok := messageCatalog[primary]; ok && quality > bestQuality {
+			best, bestQuality = primary, quality
+		}
+	}
+	return best
+}
+
+func catalogLanguages() []string {
+	languages := make([]string, 0, len(messageCatalog))
+	for language := range messageCatalog {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
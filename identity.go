@@ -0,0 +1,77 @@
+package turnstile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// identity key components
+const (
+	identityIP      = "ip"
+	identityUA      = "ua"
+	identitySession = "session"
+	identityHeader  = "header:"
+)
+
+// identityKey describes how the velocity trigger identifies a client, bans
+// and the tarpit key on the client IP regardless. Keying on the IP alone
+// punishes users behind CGNAT and misses distributed attacks sharing one
+// session, so a key can combine the client IP, a hash of the User-Agent, a
+// hash of the session cookie or a forwarded header such as a tenant ID.
+type identityKey []string
+
+// parseIdentityKey validates the configured components, if none are provided,
+// the client IP will be used.
+func parseIdentityKey(components []string) (identityKey, error) {
+	if len(components) == 0 {
+		return identityKey{identityIP}, nil
+	}
+	key := make(identityKey, 0, len(components))
+	for _, component := range components {
+		c := strings.TrimSpace(component)
+		switch {
+		case strings.EqualFold(c, identityIP), strings.EqualFold(c, identityUA), strings.EqualFold(c, identitySession):
+			key = append(key, strings.ToLower(c))
+		case len(c) > len(identityHeader) && strings.EqualFold(c[:len(identityHeader)], identityHeader):
+			key = append(key, identityHeader+http.CanonicalHeaderKey(c[len(identityHeader):]))
+		default:
+			return nil, fmt.Errorf("invalid identitykey component: %s", component)
+		}
+	}
+	return key, nil
+}
+
+// derive returns the identity of the client sending req, sessionCookie is the
+// name of the cookie hashed by the session component.
+func (k identityKey) derive(req *http.Request, sessionCookie string) string {
+	parts := make([]string, len(k))
+	for i, component := range k {
+		switch {
+		case component == identityIP:
+			if ip := clientIP(req); ip != nil {
+				parts[i] = ip.String()
+			}
+		case component == identityUA:
+			parts[i] = hashIdentity(req.UserAgent())
+		case component == identitySession:
+			if cookie, err := req.Cookie(sessionCookie); err == nil {
+				parts[i] = hashIdentity(cookie.Value)
+			}
+		default:
+			parts[i] = hashIdentity(req.Header.Get(strings.TrimPrefix(component, identityHeader)))
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// hashIdentity shortens potentially large or sensitive values, empty values stay empty.
+func hashIdentity(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,153 @@
+package turnstile
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+const turnstileScript = `<script src="https://challenges.cloudflare.com/turnstile/v0/api.js" async defer></script>`
+
+// formActionPattern finds the action attribute of an opening form tag.
+var formActionPattern = regexp.MustCompile(`(?i)\saction\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+// InjectionConfig rewrites HTML pages of the backend to render the widget in
+// their forms, so legacy applications can be protected without touching
+// their templates.
+type InjectionConfig struct {
+	// Paths are the pages whose forms get the widget, with the same patterns as router paths
+	Paths []string `yaml:"paths"`
+	// FormActions limit injection to forms posting to these paths, if not provided, every form will get the widget
+	FormActions []string `yaml:"formactions"`
+}
+
+// injector adds the widget to the forms of HTML responses of configured pages.
+type injector struct {
+	paths   []pathPattern
+	actions map[string]bool
+	widget  []byte
+}
+
+// newInjector returns nil when injection is not configured.
+func newInjector(config *Config, enabled features) (*injector, error) {
+	if config.Injection == nil {
+		return nil, nil
+	}
+	var problems configErrors
+	if !enabled.enabled(featureInjection) {
+		problems.add(errors.New("injection requires the injection feature flag"))
+	}
+	if config.SiteKey == "" {
+		problems.add(errors.New("injection requires sitekey"))
+	}
+	if len(config.Injection.Paths) == 0 {
+		problems.add(errors.New("injection.paths cannot be empty"))
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	options := pathOptions{caseSensitive: config.CaseSensitive, strictTrailingSlash: config.StrictTrailingSlash}
+	i := &injector{}
+	for _, path := range config.Injection.Paths {
+		i.paths = append(i.paths, compilePath(path, options))
+	}
+	if len(config.Injection.FormActions) > 0 {
+		i.actions = make(map[string]bool, len(config.Injection.FormActions))
+		for _, action := range config.Injection.FormActions {
+			i.actions[action] = true
+		}
+	}
+	widget := `<div class="cf-turnstile" data-sitekey="` + html.EscapeString(config.SiteKey) + `"`
+	if config.FormKey != "" && config.FormKey != defaultFormKey {
+		widget += ` data-response-field-name="` + html.EscapeString(config.FormKey) + `"`
+	}
+	i.widget = []byte(widget + `></div>`)
+	return i, nil
+}
+
+// matches reports whether the response to req is rewritten.
+func (i *injector) matches(req *http.Request) bool {
+	if i == nil || req.Method != http.MethodGet {
+		return false
+	}
+	for j := range i.paths {
+		if i.paths[j].match(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve passes req to next and rewrites the HTML response.
+func (i *injector) serve(next http.Handler, rw http.ResponseWriter, req *http.Request) {
+	// compressed responses can't be rewritten
+	req.Header.Del("Accept-Encoding")
+	writer := newBodyRewriter(rw, isHTMLResponse, func(body []byte) []byte {
+		return i.inject(body, req.URL.Path)
+	})
+	next.ServeHTTP(writer, req)
+	writer.finish()
+}
+
+// inject adds the widget before the end of every selected form without one,
+// and the script to the head of pages that got a widget.
+func (i *injector) inject(body []byte, pagePath string) []byte {
+	lower := bytes.ToLower(body)
+	var result []byte
+	last, injected := 0, false
+	for offset := 0; ; {
+		start := bytes.Index(lower[offset:], []byte("<form"))
+		if start < 0 {
+			break
+		}
+		start += offset
+		tagEnd := bytes.IndexByte(lower[start:], '>')
+		formEnd := bytes.Index(lower[start:], []byte("</form"))
+		if tagEnd < 0 || formEnd < 0 {
+			break
+		}
+		tagEnd, formEnd = start+tagEnd, start+formEnd
+		offset = formEnd
+		if bytes.Contains(lower[tagEnd:formEnd], []byte("cf-turnstile")) || !i.selects(body[start:tagEnd], pagePath) {
+			continue
+		}
+		result = append(result, body[last:formEnd]...)
+		result = append(result, i.widget...)
+		last, injected = formEnd, true
+	}
+	if !injected {
+		return body
+	}
+	result = append(result, body[last:]...)
+	if bytes.Contains(lower, []byte("challenges.cloudflare.com/turnstile")) {
+		return result
+	}
+	// the script goes to the end of the head, or of the body of pages without one
+	lower = bytes.ToLower(result)
+	index := bytes.Index(lower, []byte("</head"))
+	if index < 0 {
+		index = bytes.LastIndex(lower, []byte("</body"))
+	}
+	if index < 0 {
+		return append(result, turnstileScript...)
+	}
+	return append(append(append([]byte{}, result[:index]...), turnstileScript...), result[index:]...)
+}
+
+// selects reports whether the form with the opening tag gets the widget.
+func (i *injector) selects(tag []byte, pagePath string) bool {
+	if i.actions == nil {
+		return true
+	}
+	action := pagePath
+	if m := formActionPattern.FindSubmatch(tag); m != nil {
+		value := html.UnescapeString(string(m[1]) + string(m[2]) + string(m[3]))
+		if u, err := url.Parse(value); err == nil && u.Path != "" {
+			action = u.Path
+		}
+	}
+	return i.actions[action]
+}
@@ -0,0 +1,139 @@
+package turnstile
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// interstitialPage embeds the widget in a form resubmitting the original
+// request, the widget adds the token under the router's form key.
+var interstitialPage = template.Must(template.New("interstitial").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Just a moment...</title>
+<script src="https://challenges.cloudflare.com/turnstile/v0/api.js" async defer></script>
+<style>body{font-family:system-ui,sans-serif;display:flex;min-height:90vh;align-items:center;justify-content:center;color:#222}main{text-align:center}</style>
+</head>
+<body>
+<main>
+<h1>Checking your browser</h1>
+<p>This only takes a moment, you will be forwarded automatically.</p>
+<form id="turnstile-resubmit" method="{{.Method}}" action="{{.Action}}">
+{{- range .Fields}}
+<input type="hidden" name="{{.Name}}" value="{{.Value}}">
+{{- end}}
+<div class="cf-turnstile" data-sitekey="{{.SiteKey}}" data-response-field-name="{{.FormKey}}" data-callback="turnstileResubmit"></div>
+</form>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<script>function turnstileResubmit(){document.getElementById("turnstile-resubmit").submit();}</script>
+</main>
+</body>
+</html>
+`))
+
+type interstitialField struct {
+	Name  string
+	Value string
+}
+
+type interstitialData struct {
+	SiteKey string
+	FormKey string
+	Method  string
+	Action  string
+	Fields  []interstitialField
+}
+
+// interstitial serves a challenge page to browsers that sent no token, so
+// they can solve the widget and resubmit the original request.
+type interstitial struct {
+	siteKey string
+}
+
+// newInterstitial returns nil when the interstitial is not enabled.
+func newInterstitial(config *Config, enabled features) (*interstitial, error) {
+	if !config.Interstitial {
+		return nil, nil
+	}
+	if !enabled.enabled(featureInterstitial) {
+		return nil, errors.New("interstitial requires the interstitial feature flag")
+	}
+	if config.SiteKey == "" {
+		return nil, errors.New("interstitial requires sitekey")
+	}
+	return &interstitial{siteKey: config.SiteKey}, nil
+}
+
+// applies reports whether the rejection of req for a missing token can be
+// answered with the page: a browser navigation to a form-based router whose
+// request can be reproduced by an HTML form.
+func (i *interstitial) applies(req *http.Request, router *Router) bool {
+	if i == nil || !router.readsForm() {
+		return false
+	}
+	if !strings.Contains(req.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet:
+		return true
+	case http.MethodPost:
+		if req.ContentLength == 0 && req.Header.Get("Content-Type") == "" {
+			return true
+		}
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		return mediaType == "application/x-www-form-urlencoded"
+	}
+	return false
+}
+
+// write renders the page, it reports false when the original request could
+// not be reproduced.
+func (i *interstitial) write(rw http.ResponseWriter, req *http.Request, router *Router, status int) bool {
+	data := interstitialData{SiteKey: i.siteKey, FormKey: router.formKey(), Method: req.Method}
+	var values url.Values
+	if req.Method == http.MethodGet {
+		// a GET form replaces the query, so it is carried in the fields
+		data.Action = req.URL.Path
+		values = req.URL.Query()
+	} else {
+		data.Action = req.URL.RequestURI()
+		var err error
+		if values, err = readPostForm(req, router.multipartMemory, router.maxFormBytes); err != nil {
+			return false
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		// stale tokens are not resubmitted
+		if !containsString(router.formKeys, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range values[name] {
+			data.Fields = append(data.Fields, interstitialField{Name: name, Value: value})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := interstitialPage.Execute(&buf, data); err != nil {
+		logger().ErrorContext(req.Context(), "failed to render interstitial", "error", err)
+		return false
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	_, _ = rw.Write(buf.Bytes())
+	return true
+}
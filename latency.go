@@ -0,0 +1,150 @@
+package turnstile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLatencyPercentile = 95
+	defaultLatencyWindow     = 30 * time.Second
+	// latencyShedWindows consecutive windows over budget start shedding, as
+	// many windows within budget stop it again
+	latencyShedWindows = 3
+	// windows with fewer decisions are not evaluated, a handful of slow
+	// requests says nothing about the percentile
+	latencyMinSamples = 20
+)
+
+// latencyGuard watches the time the middleware adds to protected requests.
+// When the configured percentile stays above the budget, nonessential work
+// such as decision log export is shed until latency recovers.
+type latencyGuard struct {
+	budget time.Duration
+	// allowedRatio is the share of decisions that may exceed the budget
+	allowedRatio float64
+	window       time.Duration
+
+	total atomic.Uint64
+	over  atomic.Uint64
+
+	// breaches counts consecutive windows over (positive) or within
+	// (negative) budget, it is only touched by evaluate
+	breaches int
+	shedding atomic.Bool
+	// overRatio is the share of decisions over budget in the last window, as float64 bits
+	overRatio   atomic.Uint64
+	activations atomic.Uint64
+}
+
+// newLatencyGuard returns nil when no latency budget is configured.
+func newLatencyGuard(config *Config) (*latencyGuard, error) {
+	if config.LatencyBudget == "" {
+		return nil, nil
+	}
+	budget, err := time.ParseDuration(config.LatencyBudget)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latencybudget: %w", err)
+	}
+	if budget <= 0 {
+		return nil, fmt.Errorf("latencybudget must be positive")
+	}
+	percentile := config.LatencyPercentile
+	if percentile == 0 {
+		percentile = defaultLatencyPercentile
+	}
+	if percentile < 1 || percentile > 99 {
+		return nil, fmt.Errorf("latencypercentile must be between 1 and 99")
+	}
+	window := defaultLatencyWindow
+	if config.LatencyWindow != "" {
+		window, err = time.ParseDuration(config.LatencyWindow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latencywindow: %w", err)
+		}
+		if window <= 0 {
+			return nil, fmt.Errorf("latencywindow must be positive")
+		}
+	}
+
+	return &latencyGuard{budget: budget, allowedRatio: 1 - float64(percentile)/100, window: window}, nil
+}
+
+// start evaluates the guard every window until ctx is done.
+func (g *latencyGuard) start(ctx context.Context) {
+	if g != nil {
+		background.schedule(ctx, "latency-guard", g.window, g.evaluate)
+	}
+}
+
+// observe records the time taken by one decision.
+func (g *latencyGuard) observe(duration time.Duration) {
+	if g == nil {
+		return
+	}
+	g.total.Add(1)
+	if duration > g.budget {
+		g.over.Add(1)
+	}
+}
+
+// shed reports whether nonessential features should be skipped.
+func (g *latencyGuard) shed() bool {
+	return g != nil && g.shedding.Load()
+}
+
+// evaluate closes the current window. The percentile is within budget as
+// long as no more than allowedRatio of the decisions exceeded it.
+func (g *latencyGuard) evaluate() {
+	total, over := g.total.Swap(0), g.over.Swap(0)
+	if total < latencyMinSamples {
+		return
+	}
+	ratio := float64(over) / float64(total)
+	g.overRatio.Store(math.Float64bits(ratio))
+
+	if ratio > g.allowedRatio {
+		if g.breaches < 0 {
+			g.breaches = 0
+		}
+		g.breaches++
+	} else {
+		if g.breaches > 0 {
+			g.breaches = 0
+		}
+		g.breaches--
+	}
+
+	switch {
+	case g.breaches >= latencyShedWindows && !g.shedding.Load():
+		g.shedding.Store(true)
+		g.activations.Add(1)
+		logger().Warn("decision latency over budget, shedding nonessential features", "budget", g.budget)
+	case g.breaches <= -latencyShedWindows && g.shedding.Load():
+		g.shedding.Store(false)
+		logger().Info("decision latency back within budget, restoring nonessential features", "budget", g.budget)
+	}
+}
+
+func (g *latencyGuard) writeMetrics(w io.Writer) {
+	shedding := 0
+	if g.shed() {
+		shedding = 1
+	}
+	fmt.Fprintln(w, "# HELP turnstile_latency_budget_seconds Added-latency budget of the middleware.")
+	fmt.Fprintln(w, "# TYPE turnstile_latency_budget_seconds gauge")
+	fmt.Fprintf(w, "turnstile_latency_budget_seconds %g\n", g.budget.Seconds())
+	fmt.Fprintln(w, "# HELP turnstile_latency_over_budget_ratio Share of decisions over the latency budget in the last window.")
+	fmt.Fprintln(w, "# TYPE turnstile_latency_over_budget_ratio gauge")
+	fmt.Fprintf(w, "turnstile_latency_over_budget_ratio %g\n", math.Float64frombits(g.overRatio.Load()))
+	fmt.Fprintln(w, "# HELP turnstile_latency_shedding Whether nonessential features are shed to protect latency.")
+	fmt.Fprintln(w, "# TYPE turnstile_latency_shedding gauge")
+	fmt.Fprintf(w, "turnstile_latency_shedding %d\n", shedding)
+	fmt.Fprintln(w, "# HELP turnstile_latency_shedding_activations_total Times shedding started because latency stayed over budget.")
+	fmt.Fprintln(w, "# TYPE turnstile_latency_shedding_activations_total counter")
+	fmt.Fprintf(w, "turnstile_latency_shedding_activations_total %d\n", g.activations.Load())
+}
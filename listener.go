@@ -0,0 +1,77 @@
+package turnstile
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// listener timeouts, so idle or slow clients cannot hold connections open
+const (
+	listenerReadHeaderTimeout = 10 * time.Second
+	listenerIdleTimeout       = 2 * time.Minute
+)
+
+// Traefik calls New again on every configuration reload, so listeners opened by
+// the plugin are shared per address and only their handler is swapped.
+var (
+	listenersMu sync.Mutex
+	listeners   = map[string]*sharedListener{}
+)
+
+type sharedListener struct {
+	// owner is the name of the middleware instance serving the address
+	owner string
+
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+func (l *sharedListener) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	l.mu.RLock()
+	handler := l.handler
+	l.mu.RUnlock()
+	handler.ServeHTTP(rw, req)
+}
+
+// serveOn starts serving handler of the middleware instance owner on addr, or
+// replaces the handler of the listener already serving addr for the same
+// instance. An address served by another instance is refused, rather than
+// silently taking over its endpoints.
+func serveOn(addr, owner string, handler http.Handler) error {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	if l, ok := listeners[addr]; ok {
+		if l.owner != owner {
+			return fmt.Errorf("%s is already served by middleware %q", addr, l.owner)
+		}
+		l.mu.Lock()
+		l.handler = handler
+		l.mu.Unlock()
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	l := &sharedListener{owner: owner, handler: handler}
+	listeners[addr] = l
+	server := &http.Server{
+		Handler:           l,
+		ReadHeaderTimeout: listenerReadHeaderTimeout,
+		IdleTimeout:       listenerIdleTimeout,
+	}
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			logger().Error("listener stopped", "address", addr, "error", err)
+		}
+		listenersMu.Lock()
+		delete(listeners, addr)
+		listenersMu.Unlock()
+	}()
+	return nil
+}
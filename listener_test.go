@@ -0,0 +1,22 @@
+package turnstile
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServeOnRefusesAnotherInstance(t *testing.T) {
+	addr := "127.0.0.1:0"
+	handler := http.NotFoundHandler()
+	if err := serveOn(addr, "first", handler); err != nil {
+		t.Fatal(err)
+	}
+	// a reload of the same instance replaces its handler
+	if err := serveOn(addr, "first", handler); err != nil {
+		t.Errorf("reload of the owner: %v", err)
+	}
+	if err := serveOn(addr, "second", handler); err == nil || !strings.Contains(err.Error(), `middleware "first"`) {
+		t.Errorf("second instance: err = %v, want the address refused", err)
+	}
+}
@@ -0,0 +1,110 @@
+package turnstile
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// log formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var (
+	// logLevel is the minimum level of every log record of the plugin
+	logLevel = new(slog.LevelVar)
+	// pluginLogger holds the *slog.Logger every component logs through
+	pluginLogger atomic.Value
+)
+
+func init() {
+	setLogFormat(logFormatText)
+}
+
+// logger returns the logger of the plugin.
+func logger() *slog.Logger {
+	return pluginLogger.Load().(*slog.Logger)
+}
+
+func setLogFormat(format string) {
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, options)
+	if format == logFormatJSON {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	}
+	pluginLogger.Store(slog.New(&requestIDHandler{next: &redactingHandler{next: handler}}).With("plugin", "turnstile"))
+}
+
+// logSettings are the validated loglevel and logformat options.
+type logSettings struct {
+	level  slog.Level
+	format string
+}
+
+func parseLogSettings(config *Config) (logSettings, error) {
+	settings := logSettings{level: slog.LevelInfo, format: logFormatText}
+	var problems configErrors
+	switch strings.ToLower(config.LogLevel) {
+	case "", "info":
+	case "debug":
+		settings.level = slog.LevelDebug
+	case "warn", "warning":
+		settings.level = slog.LevelWarn
+	case "error":
+		settings.level = slog.LevelError
+	default:
+		problems.add(fmt.Errorf("invalid loglevel: %s", config.LogLevel))
+	}
+	switch strings.ToLower(config.LogFormat) {
+	case "", logFormatText:
+	case logFormatJSON:
+		settings.format = logFormatJSON
+	default:
+		problems.add(fmt.Errorf("invalid logformat: %s", config.LogFormat))
+	}
+	return settings, problems.err()
+}
+
+// apply switches the plugin logger to the settings. The logger is shared by
+// every middleware instance of the process, so the instance loaded last wins.
+func (s logSettings) apply() {
+	logLevel.Set(s.level)
+	setLogFormat(s.format)
+}
+
+// logDecision logs a decision on a protected route: rejections at info,
+// verification errors at warn and allowed requests at debug level.
+func (a *turnstile) logDecision(req *http.Request, router *Router, d *decision) {
+	level := slog.LevelDebug
+	switch {
+	case d.Reason == ReasonVerificationError:
+		level = slog.LevelWarn
+	case !d.Allowed:
+		level = slog.LevelInfo
+	}
+	l := logger()
+	if !l.Enabled(req.Context(), level) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("middleware", a.name),
+		slog.String("route", router.label()),
+		slog.String("decision", d.outcome()),
+		slog.String("reason", string(d.Reason)),
+		slog.Float64("duration_ms", float64(d.Duration.Microseconds())/1000),
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+	}
+	if len(d.ErrorCodes) > 0 {
+		attrs = append(attrs, slog.Any("error_codes", d.ErrorCodes))
+	}
+	if !d.Allowed {
+		attrs = append(attrs, slog.Int("status", d.Status), slog.String("message", d.Message))
+	}
+	l.LogAttrs(req.Context(), level, "decision", attrs...)
+}
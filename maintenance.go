@@ -0,0 +1,69 @@
+package turnstile
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// router actions
+const (
+	actionChallenge   = "challenge"
+	actionMaintenance = "maintenance"
+)
+
+// MaintenanceResponse is the static response served by routers switched to the maintenance action.
+type MaintenanceResponse struct {
+	// Status is the response status code, if not provided, 503 will be used
+	Status int `yaml:"status"`
+	// ContentType is the response content type, if not provided, text/html; charset=utf-8 will be used
+	ContentType string `yaml:"contenttype"`
+	Body        string `yaml:"body"`
+	// RetryAfter is sent as the Retry-After header when set, e.g. "3600"
+	RetryAfter string `yaml:"retryafter"`
+}
+
+const defaultMaintenanceBody = "<!DOCTYPE html><html><head><title>Temporarily unavailable</title></head>" +
+	"<body><h1>Temporarily unavailable</h1><p>This page is temporarily unavailable, please try again later.</p></body></html>"
+
+func compileAction(r *Router) (string, error) {
+	action := strings.ToLower(r.Action)
+	switch action {
+	case "":
+		return actionChallenge, nil
+	case actionChallenge:
+		return action, nil
+	case actionMaintenance:
+		// WriteHeader panics on codes outside 100-599, and 1xx codes would not end the response
+		if m := r.Maintenance; m != nil && m.Status != 0 && (m.Status < 200 || m.Status > 599) {
+			return "", fmt.Errorf("invalid maintenance.status: %d is not between 200 and 599", m.Status)
+		}
+		return action, nil
+	default:
+		return "", fmt.Errorf("invalid action: %s", r.Action)
+	}
+}
+
+func (m *MaintenanceResponse) write(rw http.ResponseWriter) {
+	status, contentType, body := http.StatusServiceUnavailable, "text/html; charset=utf-8", defaultMaintenanceBody
+	if m != nil {
+		if m.Status != 0 {
+			status = m.Status
+		}
+		if m.ContentType != "" {
+			contentType = m.ContentType
+		}
+		if m.Body != "" {
+			body = m.Body
+		}
+		if m.RetryAfter != "" {
+			rw.Header().Set("Retry-After", m.RetryAfter)
+		}
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	_, _ = rw.Write([]byte(body))
+}
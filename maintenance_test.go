@@ -0,0 +1,37 @@
+package turnstile
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		valid  bool
+	}{
+		{0, true},
+		{200, true},
+		{503, true},
+		{599, true},
+		{42, false},
+		{101, false},
+		{600, false},
+		{1000, false},
+	}
+	for _, tt := range tests {
+		config := CreateConfig()
+		config.TurnstileSecret = "secret"
+		config.LogLevel = "error"
+		config.Routers = []Router{{Method: http.MethodPost, Path: "/signup", Action: "maintenance", Maintenance: &MaintenanceResponse{Status: tt.status}}}
+		_, err := New(context.Background(), http.NotFoundHandler(), config, "maintenance")
+		if tt.valid && err != nil {
+			t.Errorf("status %d: %v", tt.status, err)
+		}
+		if !tt.valid && (err == nil || !strings.Contains(err.Error(), "invalid maintenance.status")) {
+			t.Errorf("status %d: err = %v, want an invalid maintenance.status error", tt.status, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package turnstile
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Matcher is a router condition on a request header or query parameter.
+type Matcher struct {
+	Name string `yaml:"name"`
+	// Value must equal one of the field values case-insensitively, if neither value nor regexp is provided, presence is enough
+	Value string `yaml:"value"`
+	// Regexp must match one of the field values
+	Regexp string `yaml:"regexp"`
+	// Absent inverts the matcher, it matches requests without the field
+	Absent bool `yaml:"absent"`
+
+	regexp *regexp.Regexp
+}
+
+// compileMatchers returns a copy of matchers with their regular expressions compiled.
+func compileMatchers(configured []Matcher) ([]Matcher, error) {
+	matchers := make([]Matcher, len(configured))
+	copy(matchers, configured)
+	for i := range matchers {
+		if matchers[i].Name == "" {
+			return nil, fmt.Errorf("matcher name cannot be empty")
+		}
+		if matchers[i].Regexp != "" {
+			re, err := regexp.Compile(matchers[i].Regexp)
+			if err != nil {
+				return nil, fmt.Errorf("matcher %s: invalid regexp: %w", matchers[i].Name, err)
+			}
+			matchers[i].regexp = re
+		}
+	}
+	return matchers, nil
+}
+
+// matches reports whether the values of the field satisfy the matcher.
+func (m *Matcher) matches(values []string) bool {
+	if m.Absent {
+		return len(values) == 0
+	}
+	if len(values) == 0 {
+		return false
+	}
+	if m.Value == "" && m.regexp == nil {
+		return true
+	}
+	for _, value := range values {
+		if m.Value != "" && strings.EqualFold(value, m.Value) {
+			return true
+		}
+		if m.regexp != nil && m.regexp.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHeaders reports whether req satisfies every header matcher.
+func matchHeaders(matchers []Matcher, req *http.Request) bool {
+	for i := range matchers {
+		if !matchers[i].matches(req.Header.Values(matchers[i].Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchQuery reports whether query satisfies every query parameter matcher.
+func matchQuery(matchers []Matcher, query url.Values) bool {
+	for i := range matchers {
+		if !matchers[i].matches(query[matchers[i].Name]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+package turnstile
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics collects verification statistics of a middleware instance.
+type metrics struct {
+	// routes holds the counters of every route, registered when routes are
+	// compiled, so requests only ever touch atomic counters and never a lock
+	mu     sync.Mutex
+	routes map[string]*routeMetrics
+	// latency is the latency guard of the instance, nil when no budget is configured
+	latency *latencyGuard
+}
+
+// routeMetrics are the counters of one route.
+type routeMetrics struct {
+	route string
+	// extractions counts token extractions per source and result, indexed by extractionIndex
+	extractions []atomic.Uint64
+	// errorCodes counts siteverify error codes, shifts in this distribution
+	// are the earliest signal of widget bugs or token farming
+	errorCodes counterVec
+	// verifications counts siteverify outcomes, indexed like verificationResults
+	verifications []atomic.Uint64
+	// bypasses counts requests allowed without a token, indexed like reasons
+	bypasses []atomic.Uint64
+	// siteverify is the latency of siteverify calls, retries included
+	siteverify *histogram
+}
+
+// tokenSources and extractionResults enumerate the extraction counters of a route.
+var (
+	tokenSources      = []TokenSource{SourceHeader, SourceForm, SourceMultipart, SourceEnvelope, SourceQuery, SourceCookie, SourceJSONBody, SourceGraphQL, SourceAuthorization, SourceExpression}
+	extractionResults = []string{"ok", string(ReasonMissingToken), string(ReasonEmptyToken), string(ReasonMalformedRequest)}
+	// verificationResults are the outcomes of siteverify calls: the token was
+	// accepted, rejected, or siteverify could not be reached
+	verificationResults = []string{"success", "failure", "error"}
+	// siteverifyBuckets are the latency histogram bounds in seconds
+	siteverifyBuckets = []float64{0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// registerRoutes attaches counters to every router of matcher before it serves requests.
+func (m *metrics) registerRoutes(matcher *routeMatcher) {
+	for _, router := range matcher.all() {
+		router.metrics = m.register(router.label())
+	}
+}
+
+func newMetrics() *metrics {
+	return &metrics{routes: map[string]*routeMetrics{}}
+}
+
+// register returns the counters of route, routers sharing a label share them.
+func (m *metrics) register(route string) *routeMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.routes[route]; ok {
+		return r
+	}
+	r := &routeMetrics{
+		route:         route,
+		extractions:   make([]atomic.Uint64, len(tokenSources)*len(extractionResults)),
+		verifications: make([]atomic.Uint64, len(verificationResults)),
+		bypasses:      make([]atomic.Uint64, len(reasons)),
+		siteverify:    newHistogram(siteverifyBuckets),
+	}
+	m.routes[route] = r
+	return r
+}
+
+// extractionIndex returns the counter index of a source and result, or -1.
+func extractionIndex(source TokenSource, result string) int {
+	for i := range tokenSources {
+		if tokenSources[i] != source {
+			continue
+		}
+		for j := range extractionResults {
+			if extractionResults[j] == result {
+				return i*len(extractionResults) + j
+			}
+		}
+	}
+	return -1
+}
+
+// observeExtraction counts a token extraction, the result is "ok" or the failure reason.
+func (r *routeMetrics) observeExtraction(extraction Extraction) {
+	result := "ok"
+	if extraction.Err != nil {
+		result = string(extraction.reason())
+	}
+	if i := extractionIndex(extraction.Source, result); i >= 0 {
+		r.extractions[i].Add(1)
+	}
+}
+
+// observeErrorCodes counts the error codes returned by siteverify.
+func (r *routeMetrics) observeErrorCodes(codes []string) {
+	for _, code := range codes {
+		r.errorCodes.add(code, 1)
+	}
+}
+
+// observeVerification counts a siteverify call and its latency.
+func (r *routeMetrics) observeVerification(resp *VerifyResponse, err error, duration time.Duration) {
+	result := 0
+	switch {
+	case err != nil:
+		result = 2
+	case !resp.Success:
+		result = 1
+	}
+	r.verifications[result].Add(1)
+	r.siteverify.observe(duration)
+}
+
+// observeDecision counts requests allowed without verifying a token.
+func (r *routeMetrics) observeDecision(d *decision) {
+	if !d.Allowed || d.Reason == ReasonVerified {
+		return
+	}
+	if i := reasonIndex(d.Reason); i >= 0 {
+		r.bypasses[i].Add(1)
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *metrics) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(rw)
+}
+
+// write writes the metrics in the Prometheus text exposition format.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	routes := make([]*routeMetrics, 0, len(m.routes))
+	for _, r := range m.routes {
+		routes = append(routes, r)
+	}
+	m.mu.Unlock()
+	sort.Slice(routes, func(i, j int) bool { return routes[i].route < routes[j].route })
+
+	fmt.Fprintln(w, "# HELP turnstile_siteverify_error_codes_total Error codes returned by the siteverify API.")
+	fmt.Fprintln(w, "# TYPE turnstile_siteverify_error_codes_total counter")
+	for _, r := range routes {
+		var codes []string
+		values := map[string]uint64{}
+		r.errorCodes.each(func(code interface{}, value uint64) {
+			codes = append(codes, code.(string))
+			values[code.(string)] = value
+		})
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "turnstile_siteverify_error_codes_total{route=\"%s\",code=\"%s\"} %d\n",
+				escapeLabel(r.route), escapeLabel(code), values[code])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP turnstile_token_extractions_total Token extractions by route, source and result.")
+	fmt.Fprintln(w, "# TYPE turnstile_token_extractions_total counter")
+	for _, r := range routes {
+		for i, source := range tokenSources {
+			for j, result := range extractionResults {
+				// only sources and results that occurred are exposed
+				if value := r.extractions[i*len(extractionResults)+j].Load(); value > 0 {
+					fmt.Fprintf(w, "turnstile_token_extractions_total{route=\"%s\",source=\"%s\",result=\"%s\"} %d\n",
+						escapeLabel(r.route), source, result, value)
+				}
+			}
+		}
+	}
+	fmt.Fprintln(w, "# HELP turnstile_verifications_total Siteverify calls by route and result.")
+	fmt.Fprintln(w, "# TYPE turnstile_verifications_total counter")
+	for _, r := range routes {
+		for i, result := range verificationResults {
+			if value := r.verifications[i].Load(); value > 0 {
+				fmt.Fprintf(w, "turnstile_verifications_total{route=\"%s\",result=\"%s\"} %d\n", escapeLabel(r.route), result, value)
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP turnstile_bypasses_total Requests allowed without verifying a token, by route and reason.")
+	fmt.Fprintln(w, "# TYPE turnstile_bypasses_total counter")
+	for _, r := range routes {
+		for i, reason := range reasons {
+			if value := r.bypasses[i].Load(); value > 0 {
+				fmt.Fprintf(w, "turnstile_bypasses_total{route=\"%s\",reason=\"%s\"} %d\n", escapeLabel(r.route), reason, value)
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP turnstile_siteverify_duration_seconds Latency of siteverify calls, retries included.")
+	fmt.Fprintln(w, "# TYPE turnstile_siteverify_duration_seconds histogram")
+	for _, r := range routes {
+		if r.siteverify.count.Load() > 0 {
+			r.siteverify.write(w, "turnstile_siteverify_duration_seconds", fmt.Sprintf("route=\"%s\"", escapeLabel(r.route)))
+		}
+	}
+
+	if m.latency != nil {
+		m.latency.writeMetrics(w)
+	}
+	background.writeMetrics(w)
+}
+
+// Collector exposes the metrics of a middleware instance to applications
+// using the package as a library, so they can be served by an existing
+// metrics endpoint instead of a dedicated listener.
+type Collector struct {
+	metrics *metrics
+}
+
+// CollectorFor returns the Collector of a handler returned by New or wrapped
+// by the function returned by Middleware, or nil for any other handler.
+func CollectorFor(handler http.Handler) *Collector {
+	if a, ok := handler.(*turnstile); ok {
+		return &Collector{metrics: a.metrics}
+	}
+	return nil
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (c *Collector) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	c.metrics.ServeHTTP(rw, req)
+}
+
+// Collect writes the metrics in the Prometheus text exposition format to w,
+// e.g. to append them to the output of another registry.
+func (c *Collector) Collect(w io.Writer) {
+	c.metrics.write(w)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
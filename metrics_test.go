@@ -0,0 +1,107 @@
+package turnstile
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// mutexMetrics is the mutex-guarded map the extraction counters used to be
+// built on, kept as the baseline of the contention benchmark.
+type mutexMetrics struct {
+	mu     sync.Mutex
+	counts map[mutexMetricsKey]uint64
+}
+
+type mutexMetricsKey struct {
+	route  string
+	source TokenSource
+	result string
+}
+
+func (m *mutexMetrics) observeExtraction(route string, extraction Extraction) {
+	result := "ok"
+	if extraction.Err != nil {
+		result = string(extraction.reason())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[mutexMetricsKey{route: route, source: extraction.Source, result: result}]++
+}
+
+var benchmarkExtractions = []Extraction{
+	{Source: SourceHeader, Token: "token"},
+	{Source: SourceHeader, Err: ErrTokenMissing},
+	{Source: SourceForm, Token: "token"},
+	{Source: SourceForm, Err: ErrFormInvalid},
+}
+
+// BenchmarkObserveExtractionParallel counts extractions from every
+// GOMAXPROCS goroutine at once, run it with -cpu 1,4,16 to see contention.
+func BenchmarkObserveExtractionParallel(b *testing.B) {
+	const routes = 16
+	var labels []string
+	for i := 0; i < routes; i++ {
+		labels = append(labels, fmt.Sprintf("POST /route/%d", i))
+	}
+
+	b.Run("mutex", func(b *testing.B) {
+		m := &mutexMetrics{counts: map[mutexMetricsKey]uint64{}}
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				m.observeExtraction(labels[i%routes], benchmarkExtractions[i%len(benchmarkExtractions)])
+			}
+		})
+	})
+	b.Run("atomic", func(b *testing.B) {
+		m := newMetrics()
+		var registered []*routeMetrics
+		for _, label := range labels {
+			registered = append(registered, m.register(label))
+		}
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				registered[i%routes].observeExtraction(benchmarkExtractions[i%len(benchmarkExtractions)])
+			}
+		})
+	})
+}
+
+func TestRouteMetricsConcurrentObservations(t *testing.T) {
+	m := newMetrics()
+	r := m.register("POST /verify")
+	if m.register("POST /verify") != r {
+		t.Fatal("routers sharing a label must share their counters")
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				r.observeExtraction(benchmarkExtractions[i%len(benchmarkExtractions)])
+				r.observeErrorCodes([]string{"invalid-input-response"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	var extractions uint64
+	for i := range r.extractions {
+		extractions += r.extractions[i].Load()
+	}
+	if extractions != 8000 {
+		t.Errorf("got %d extractions, want 8000", extractions)
+	}
+	if got := r.extractions[extractionIndex(SourceForm, string(ReasonMalformedRequest))].Load(); got != 2000 {
+		t.Errorf("got %d malformed form extractions, want 2000", got)
+	}
+	var codes uint64
+	r.errorCodes.each(func(_ interface{}, value uint64) { codes += value })
+	if codes != 8000 {
+		t.Errorf("got %d error codes, want 8000", codes)
+	}
+}
@@ -0,0 +1,214 @@
+package turnstile
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxFirstPartTokenBytes bounds how much of the token part is read.
+const maxFirstPartTokenBytes = 4096
+
+// defaultMultipartMemory is the multipart form held in memory by default, as
+// in net/http.
+const defaultMultipartMemory = 32 << 20
+
+// defaultMaxFormBytes bounds the body buffered to read a form when
+// maxbodybytes is not configured, the buffer holds every byte up to the token.
+const defaultMaxFormBytes = 64 << 20
+
+func isMultipart(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// readFirstPartToken reads the token from the first part of a multipart body and
+// splices the bytes consumed so far back in front of the unread remainder, so
+// large uploads stream to the backend instead of being buffered before verification.
+// A first part running past limit fails with ErrBodyTooLarge.
+func readFirstPartToken(req *http.Request, formKeys []string, limit int64) Extraction {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return failed(SourceMultipart, ErrFormInvalid)
+	}
+
+	body := req.Body
+	consumed := getBodyBuffer()
+	defer splice(req, body, consumed)
+
+	reader := multipart.NewReader(io.TeeReader(limitBody(body, limit), consumed), params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return failed(SourceMultipart, ErrBodyTooLarge)
+		}
+		return failed(SourceMultipart, ErrFormInvalid)
+	}
+	// the part is not closed, closing would read the rest of it into the buffer
+	if !containsString(formKeys, part.FormName()) {
+		return failed(SourceMultipart, ErrTokenMissing)
+	}
+
+	value, err := io.ReadAll(io.LimitReader(part, maxFirstPartTokenBytes+1))
+	if err != nil {
+		return failed(SourceMultipart, ErrFormInvalid)
+	}
+	if len(value) > maxFirstPartTokenBytes {
+		return failed(SourceMultipart, ErrTokenTooLarge)
+	}
+	token := strings.TrimSpace(string(value))
+	if token == "" {
+		return failed(SourceMultipart, ErrTokenEmpty)
+	}
+	return extracted(SourceMultipart, token)
+}
+
+// maxPooledBodyBuffer bounds the buffers kept for reuse, so a single large
+// upload does not pin its memory in the pool.
+const maxPooledBodyBuffer = 1 << 20
+
+// errBodyClosed is returned by reads of a spliced body after it was closed.
+var errBodyClosed = errors.New("http: invalid Read on closed Body")
+
+// bodyBuffers recycles the buffers holding the consumed bytes of request
+// bodies, which would otherwise be allocated on every protected request.
+var bodyBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func getBodyBuffer() *bytes.Buffer {
+	buffer := bodyBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+func putBodyBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() <= maxPooledBodyBuffer {
+		bodyBuffers.Put(buffer)
+	}
+}
+
+// splice restores the body of req as the consumed bytes followed by the
+// unread rest of body. The buffer is owned by the new body from now on.
+func splice(req *http.Request, body io.ReadCloser, consumed *bytes.Buffer) {
+	req.Body = &splicedBody{replay: bytes.NewReader(consumed.Bytes()), buffer: consumed, rest: body}
+}
+
+// bodySpool keeps the bytes consumed from a body, up to maxMemory of them in a
+// pooled buffer and the others in a temporary file, so a form holding large
+// files is not kept in memory while it is parsed and spooled again.
+type bodySpool struct {
+	buffer    *bytes.Buffer
+	file      *os.File
+	size      int64
+	maxMemory int64
+	// err is the first error writing the file, the spool is unusable after it
+	err error
+}
+
+func newBodySpool(maxMemory int64) *bodySpool {
+	return &bodySpool{buffer: getBodyBuffer(), maxMemory: maxMemory}
+}
+
+func (s *bodySpool) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.file == nil && int64(s.buffer.Len()+len(p)) <= s.maxMemory {
+		return s.buffer.Write(p)
+	}
+	if s.file == nil {
+		if s.file, s.err = os.CreateTemp("", "turnstile-body-"); s.err != nil {
+			return 0, s.err
+		}
+	}
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// splice restores the body of req as the spooled bytes followed by the unread
+// rest of body. The buffer and the file are owned by the new body from now on.
+func (s *bodySpool) splice(req *http.Request, body io.ReadCloser) {
+	splice(req, body, s.buffer)
+	if s.file != nil {
+		spliced := req.Body.(*splicedBody)
+		spliced.replay = io.MultiReader(spliced.replay, io.NewSectionReader(s.file, 0, s.size))
+		spliced.file = s.file
+	}
+}
+
+// splicedBody replays already consumed bytes before the rest of the original
+// body. The buffer of the consumed bytes is recycled, and the file holding
+// those spooled past it is removed, once they are replayed or the body is
+// closed. The transport may close the body while another goroutine reads it,
+// so mu guards the replay, the buffer and the file, but never a read of the
+// rest, which may block, so Close can interrupt it.
+type splicedBody struct {
+	closed atomic.Bool
+	mu     sync.Mutex
+	replay io.Reader
+	buffer *bytes.Buffer
+	file   *os.File
+	rest   io.ReadCloser
+}
+
+func (b *splicedBody) Read(p []byte) (int, error) {
+	if b.closed.Load() {
+		return 0, errBodyClosed
+	}
+	if n, ok, err := b.readReplay(p); ok {
+		return n, err
+	}
+	return b.rest.Read(p)
+}
+
+// readReplay reads the consumed bytes, ok is false once they are all replayed.
+func (b *splicedBody) readReplay(p []byte) (n int, ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buffer == nil {
+		return 0, false, nil
+	}
+	n, err = b.replay.Read(p)
+	if err == io.EOF {
+		b.release()
+		return n, n > 0, nil
+	}
+	return n, true, err
+}
+
+// release recycles the buffer and removes the file, the caller holds mu.
+func (b *splicedBody) release() {
+	if b.buffer != nil {
+		b.replay = nil
+		putBodyBuffer(b.buffer)
+		b.buffer = nil
+	}
+	if b.file != nil {
+		_ = b.file.Close()
+		_ = os.Remove(b.file.Name())
+		b.file = nil
+	}
+}
+
+func (b *splicedBody) Close() error {
+	if !b.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	// closing the rest first unblocks a concurrent read of it
+	err := b.rest.Close()
+	b.mu.Lock()
+	b.release()
+	b.mu.Unlock()
+	return err
+}
@@ -0,0 +1,203 @@
+package turnstile
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingCloser counts the Close calls of the original body.
+type countingCloser struct {
+	io.Reader
+	closes int
+}
+
+func (c *countingCloser) Close() error {
+	c.closes++
+	return nil
+}
+
+func splicedRequest(consumed, rest string) (*http.Request, *countingCloser) {
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	body := &countingCloser{Reader: strings.NewReader(rest)}
+	buffer := getBodyBuffer()
+	buffer.WriteString(consumed)
+	splice(req, body, buffer)
+	return req, body
+}
+
+func TestSplicedBodyReplaysConsumedBytes(t *testing.T) {
+	req, _ := splicedRequest("consumed,", "rest")
+	spliced := req.Body.(*splicedBody)
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(req.Body, head); err != nil || string(head) != "cons" {
+		t.Fatalf("first read = %q, %v", head, err)
+	}
+	if spliced.buffer == nil {
+		t.Fatal("buffer recycled before the consumed bytes were replayed")
+	}
+	tail, err := io.ReadAll(req.Body)
+	if err != nil || string(tail) != "umed,rest" {
+		t.Fatalf("remainder = %q, %v", tail, err)
+	}
+	if spliced.buffer != nil {
+		t.Error("buffer kept after the consumed bytes were replayed")
+	}
+}
+
+func TestSplicedBodyClose(t *testing.T) {
+	req, original := splicedRequest("consumed", "rest")
+	spliced := req.Body.(*splicedBody)
+
+	if _, err := req.Body.Read(make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if spliced.buffer != nil {
+		t.Error("Close mid-replay did not recycle the buffer")
+	}
+	if n, err := req.Body.Read(make([]byte, 8)); n != 0 || err != errBodyClosed {
+		t.Errorf("read after Close = %d, %v, want 0, errBodyClosed", n, err)
+	}
+	if err := req.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if original.closes != 1 {
+		t.Errorf("original body closed %d times, want once", original.closes)
+	}
+}
+
+// A transport closes the body of an aborted request while the backend is
+// blocked reading it, which must interrupt the read rather than wait for it.
+func TestSplicedBodyCloseDuringBlockedRead(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	splice(req, reader, getBodyBuffer())
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := req.Body.Read(make([]byte, 8))
+		readErr <- err
+	}()
+	// give the read time to block on the pipe
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- req.Body.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close waited for the blocked read")
+	}
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Error("blocked read succeeded after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not interrupt the blocked read")
+	}
+}
+
+func multipartBody(t *testing.T, fields ...string) (string, string) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if err := writer.WriteField(fields[i], fields[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.String(), writer.FormDataContentType()
+}
+
+func TestFormReadsRestoreBody(t *testing.T) {
+	body, contentType := multipartBody(t, "cf-turnstile-response", "token", "file", strings.Repeat("x", 64<<10))
+	tests := []struct {
+		name string
+		read func(req *http.Request) (string, error)
+	}{
+		{"first part", func(req *http.Request) (string, error) {
+			extraction := readFirstPartToken(req, []string{"cf-turnstile-response"}, defaultMaxFormBytes)
+			return extraction.Token, extraction.Err
+		}},
+		{"whole form", func(req *http.Request) (string, error) {
+			form, err := readPostForm(req, defaultMultipartMemory, defaultMaxFormBytes)
+			return form.Get("cf-turnstile-response"), err
+		}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		token, err := tt.read(req)
+		if err != nil || token != "token" {
+			t.Errorf("%s: token = %q, %v", tt.name, token, err)
+		}
+		forwarded, err := io.ReadAll(req.Body)
+		if err != nil || string(forwarded) != body {
+			t.Errorf("%s: the backend received %d bytes, want the %d sent", tt.name, len(forwarded), len(body))
+		}
+		_ = req.Body.Close()
+	}
+}
+
+func TestFormReadsStopAtLimit(t *testing.T) {
+	body, contentType := multipartBody(t, "file", strings.Repeat("x", 64<<10), "cf-turnstile-response", "token")
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if _, err := readPostForm(req, defaultMultipartMemory, 16<<10); err != ErrBodyTooLarge {
+		t.Errorf("err = %v, want ErrBodyTooLarge", err)
+	}
+}
+
+func TestFormReadSpoolsPastMemory(t *testing.T) {
+	body, contentType := multipartBody(t, "file", strings.Repeat("x", 64<<10), "cf-turnstile-response", "token")
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	form, err := readPostForm(req, 16<<10, defaultMaxFormBytes)
+	if err != nil || form.Get("cf-turnstile-response") != "token" {
+		t.Fatalf("token = %q, %v", form.Get("cf-turnstile-response"), err)
+	}
+	spliced := req.Body.(*splicedBody)
+	if spliced.buffer.Len() > 16<<10 {
+		t.Errorf("%d bytes kept in memory, want at most 16384", spliced.buffer.Len())
+	}
+	if spliced.file == nil {
+		t.Fatal("the bytes past the memory limit were not spooled")
+	}
+	name := spliced.file.Name()
+	forwarded, err := io.ReadAll(req.Body)
+	if err != nil || string(forwarded) != body {
+		t.Errorf("the backend received %d bytes, want the %d sent", len(forwarded), len(body))
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("spool file kept after the body was replayed: %v", err)
+	}
+	_ = req.Body.Close()
+}
+
+func TestFormReadRejectsValuesPastMemory(t *testing.T) {
+	body, contentType := multipartBody(t, "note", strings.Repeat("x", 11<<20), "cf-turnstile-response", "token")
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if _, err := readPostForm(req, 1<<10, defaultMaxFormBytes); err != ErrBodyTooLarge {
+		t.Errorf("err = %v, want ErrBodyTooLarge", err)
+	}
+	_ = req.Body.Close()
+}
@@ -0,0 +1,245 @@
+package turnstile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	otlpBatchSize     = 100
+	otlpMaxPending    = 1000
+	otlpFlushInterval = 5 * time.Second
+	otlpScopeName     = "github.com/arwoosa/turnstile"
+)
+
+// OTLP/HTTP JSON encoding of the logs data model, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpAnyValue struct {
+	StringValue *string    `json:"stringValue,omitempty"`
+	IntValue    *string    `json:"intValue,omitempty"`
+	BoolValue   *bool      `json:"boolValue,omitempty"`
+	ArrayValue  *otlpArray `json:"arrayValue,omitempty"`
+}
+
+type otlpArray struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string         `json:"timeUnixNano"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceID              string         `json:"traceId,omitempty"`
+	SpanID               string         `json:"spanId,omitempty"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int64) otlpKeyValue {
+	v := strconv.FormatInt(value, 10)
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &v}}
+}
+
+func otlpBool(key string, value bool) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{BoolValue: &value}}
+}
+
+func otlpStrings(key string, values []string) otlpKeyValue {
+	array := &otlpArray{Values: make([]otlpAnyValue, len(values))}
+	for i := range values {
+		array.Values[i] = otlpAnyValue{StringValue: &values[i]}
+	}
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{ArrayValue: array}}
+}
+
+// otlpLogExporter batches decision records and ships them to an OTLP/HTTP logs endpoint.
+type otlpLogExporter struct {
+	endpoint string
+	headers  map[string]string
+	resource []otlpKeyValue
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []otlpLogRecord
+}
+
+// newOTLPLogExporter returns nil when no logs endpoint is configured.
+func newOTLPLogExporter(ctx context.Context, config *Config, name string) *otlpLogExporter {
+	if config.OTLPLogsEndpoint == "" {
+		return nil
+	}
+	exporter := &otlpLogExporter{
+		endpoint: config.OTLPLogsEndpoint,
+		headers:  config.OTLPHeaders,
+		resource: otlpResourceAttributes(config, name),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	background.schedule(ctx, "otlp-logs-flush", otlpFlushInterval, exporter.flush)
+	return exporter
+}
+
+// otlpResourceAttributes describe this Traefik instance in every OTLP export.
+func otlpResourceAttributes(config *Config, name string) []otlpKeyValue {
+	hostname, _ := os.Hostname()
+	resource := []otlpKeyValue{
+		otlpString("service.name", "traefik"),
+		otlpString("service.instance.id", hostname),
+		otlpString("traefik.middleware.name", name),
+	}
+	keys := make([]string, 0, len(config.OTLPResourceAttributes))
+	for key := range config.OTLPResourceAttributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		resource = append(resource, otlpString(key, config.OTLPResourceAttributes[key]))
+	}
+	return resource
+}
+
+// export queues the decision record of a request.
+func (e *otlpLogExporter) export(req *http.Request, router *Router, d *decision) {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	severity, severityText := 9, "INFO"
+	if !d.Allowed {
+		severity, severityText = 13, "WARN"
+	}
+	body := "turnstile " + d.outcome() + ": " + string(d.Reason)
+	record := otlpLogRecord{
+		TimeUnixNano:         now,
+		ObservedTimeUnixNano: now,
+		SeverityNumber:       severity,
+		SeverityText:         severityText,
+		Body:                 otlpAnyValue{StringValue: &body},
+		Attributes: []otlpKeyValue{
+			otlpString("turnstile.route", router.label()),
+			otlpString("turnstile.decision", d.outcome()),
+			otlpString("turnstile.reason", string(d.Reason)),
+			otlpBool("turnstile.allowed", d.Allowed),
+			otlpInt("turnstile.duration_ms", d.Duration.Milliseconds()),
+			otlpString("http.request.method", req.Method),
+			otlpString("url.path", req.URL.Path),
+			otlpString("client.address", clientIP(req).String()),
+		},
+	}
+	if !d.Allowed {
+		record.Attributes = append(record.Attributes, otlpInt("http.response.status_code", int64(d.Status)))
+	}
+	if len(d.ErrorCodes) > 0 {
+		record.Attributes = append(record.Attributes, otlpStrings("turnstile.error_codes", d.ErrorCodes))
+	}
+	if id := requestIDFromContext(req.Context()); id != "" {
+		record.Attributes = append(record.Attributes, otlpString("turnstile.request_id", id))
+	}
+	record.TraceID, record.SpanID = parseTraceParent(req.Header.Get("traceparent"))
+
+	e.mu.Lock()
+	if len(e.pending) >= otlpMaxPending {
+		e.pending = e.pending[1:]
+	}
+	e.pending = append(e.pending, record)
+	full := len(e.pending) >= otlpBatchSize
+	e.mu.Unlock()
+
+	if full {
+		background.submit("otlp-logs-flush", e.flush)
+	}
+}
+
+// flush sends all pending records in a single request.
+func (e *otlpLogExporter) flush() {
+	e.mu.Lock()
+	records := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(records) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: otlpResource{Attributes: e.resource},
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScope{Name: otlpScopeName},
+			LogRecords: records,
+		}},
+	}}})
+	if err != nil {
+		logger().Error("failed to encode OTLP logs", "error", err)
+		return
+	}
+	postOTLP(e.client, e.endpoint, e.headers, payload, "logs")
+}
+
+// postOTLP sends an encoded export request of signal, e.g. "logs", to endpoint.
+func postOTLP(client *http.Client, endpoint string, headers map[string]string, payload []byte, signal string) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		logger().Error("failed to create OTLP request", "signal", signal, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger().Warn("failed to export OTLP data", "signal", signal, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger().Warn("OTLP endpoint rejected the export", "signal", signal, "status", resp.Status)
+	}
+}
+
+// parseTraceParent extracts the trace and parent span IDs of a W3C traceparent header.
+func parseTraceParent(value string) (traceID, spanID string) {
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", ""
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", ""
+	}
+	return strings.ToLower(parts[1]), strings.ToLower(parts[2])
+}
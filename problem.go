@@ -0,0 +1,233 @@
+package turnstile
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// error response formats
+const (
+	errorFormatJSON      = "json"
+	errorFormatProblem   = "problem"
+	errorFormatNegotiate = "negotiate"
+	// errorFormatHTML is the result of negotiating with a browser, it cannot be configured
+	errorFormatHTML = "html"
+)
+
+// problemTypePrefix prefixes the reason in the type URI of problem details.
+const problemTypePrefix = "urn:turnstile:"
+
+// reasonTitles are the problem titles of rejection reasons.
+var reasonTitles = map[Reason]string{
+	ReasonMissingToken:       "Missing Turnstile token",
+	ReasonEmptyToken:         "Empty Turnstile token",
+	ReasonMalformedRequest:   "Malformed request",
+	ReasonVerificationFailed: "Turnstile verification failed",
+	ReasonVerificationError:  "Turnstile verification unavailable",
+	ReasonMaintenance:        "Temporarily unavailable",
+	ReasonHookRejected:       "Request rejected",
+	ReasonBlockedIP:          "Access denied",
+	ReasonBanned:             "Too many failed verifications",
+}
+
+// problemDetails is an RFC 7807 problem with the turnstile extension members.
+type problemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Reason   Reason `json:"reason"`
+	// ErrorCodes are the error codes returned by siteverify
+	ErrorCodes []string `json:"error_codes,omitempty"`
+	RequestID  string   `json:"request_id,omitempty"`
+}
+
+func parseErrorFormat(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", errorFormatJSON:
+		return errorFormatJSON, nil
+	case errorFormatProblem:
+		return errorFormatProblem, nil
+	case errorFormatNegotiate:
+		return errorFormatNegotiate, nil
+	default:
+		return "", fmt.Errorf("invalid errorformat: %s", value)
+	}
+}
+
+// writeRejection writes the error response of a rejected request: the
+// interstitial, the redirect to the challenge page, the single-page app
+// contract, its error template, or the configured format.
+func (a *turnstile) writeRejection(rw http.ResponseWriter, req *http.Request, router *Router, d *decision) {
+	if d.Interstitial && a.interstitial.write(rw, req, router, d.Status) {
+		return
+	}
+	if d.Redirect {
+		a.redirect.write(rw, req)
+		return
+	}
+	if d.RetryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(int((d.RetryAfter+time.Second-1)/time.Second)))
+	}
+	d = a.clientView(rw, req, d)
+	if d.SPA {
+		a.spa.write(rw, req, d)
+		return
+	}
+	format := router.errorFormat
+	if format == "" {
+		format = a.errorFormat
+	}
+	negotiated := ""
+	if format == errorFormatNegotiate {
+		format = negotiateErrorFormat(req.Header.Get("Accept"))
+		negotiated = format
+	}
+	if a.errorTemplates.write(rw, req, router, d, negotiated) {
+		return
+	}
+	switch format {
+	case errorFormatProblem:
+		writeProblem(rw, req, d)
+	case errorFormatHTML:
+		writeHTMLError(rw, req, d)
+	default:
+		errorHandler(rw, req, d.Status, d.Message)
+	}
+}
+
+// clientView returns the decision as shown to the client: localized and
+// without siteverify details unless they are exposed. Logs keep the original.
+func (a *turnstile) clientView(rw http.ResponseWriter, req *http.Request, d *decision) *decision {
+	if a.localizer == nil && a.exposeErrorDetails {
+		return d
+	}
+	view := *d
+	if !a.exposeErrorDetails {
+		view.ErrorCodes = nil
+		switch d.Reason {
+		case ReasonVerificationFailed:
+			view.Message = "Verification failed"
+		case ReasonVerificationError:
+			view.Message = "Failed to verify token"
+		}
+	}
+	if a.localizer != nil {
+		language := a.localizer.language(req.Header.Get("Accept-Language"))
+		view.Message = a.localizer.message(language, &view)
+		rw.Header().Set("Content-Language", language)
+	}
+	return &view
+}
+
+// writeProblem writes d as RFC 7807 problem details.
+func writeProblem(rw http.ResponseWriter, req *http.Request, d *decision) {
+	problem := problemDetails{
+		Type:       problemTypePrefix + string(d.Reason),
+		Title:      reasonTitles[d.Reason],
+		Status:     d.Status,
+		Detail:     d.Message,
+		Instance:   req.URL.Path,
+		Reason:     d.Reason,
+		ErrorCodes: d.ErrorCodes,
+		RequestID:  requestIDFromContext(req.Context()),
+	}
+	if problem.Title == "" {
+		problem.Title = http.StatusText(d.Status)
+	}
+	rw.Header().Set("Content-Type", "application/problem+json")
+	rw.WriteHeader(d.Status)
+	_ = json.NewEncoder(rw).Encode(problem)
+}
+
+// negotiatedFormats are the formats a client can negotiate, in the order
+// preferred when the client accepts several of them equally.
+var negotiatedFormats = []struct {
+	format    string
+	mediaType string
+}{
+	{errorFormatJSON, "application/json"},
+	{errorFormatProblem, "application/problem+json"},
+	{errorFormatHTML, "text/html"},
+}
+
+// negotiateErrorFormat returns the format the Accept header prefers, JSON
+// when it accepts none of them.
+func negotiateErrorFormat(accept string) string {
+	best, bestQuality := errorFormatJSON, 0.0
+	for _, candidate := range negotiatedFormats {
+		if quality := acceptQuality(accept, candidate.mediaType); quality > bestQuality {
+			best, bestQuality = candidate.format, quality
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality the Accept header assigns to mediaType,
+// the most specific matching range wins.
+func acceptQuality(accept, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, accepted := range strings.Split(accept, ",") {
+		accepted, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		s := -1
+		switch accepted {
+		case mediaType:
+			s = 2
+		case mainType + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
+
+var htmlErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Detail}}</p>
+{{- if .RequestID}}
+<p><small>Reference: {{.RequestID}}</small></p>
+{{- end}}
+</body>
+</html>
+`))
+
+// writeHTMLError writes d as a minimal HTML page for browsers.
+func writeHTMLError(rw http.ResponseWriter, req *http.Request, d *decision) {
+	title := reasonTitles[d.Reason]
+	if title == "" {
+		title = http.StatusText(d.Status)
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(d.Status)
+	_ = htmlErrorPage.Execute(rw, problemDetails{
+		Title:     title,
+		Status:    d.Status,
+		Detail:    d.Message,
+		RequestID: requestIDFromContext(req.Context()),
+	})
+}
@@ -0,0 +1,83 @@
+package turnstile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const defaultProfileEnv = "TURNSTILE_PROFILE"
+
+// resolveProfile returns a copy of config with the profile selected by the
+// profile environment variable applied, or config itself when no profile is selected.
+func resolveProfile(config *Config) (*Config, error) {
+	if len(config.Clear) > 0 {
+		return nil, errors.New("clear is only valid within profiles")
+	}
+	envName := config.ProfileEnv
+	if envName == "" {
+		envName = defaultProfileEnv
+	}
+	name := os.Getenv(envName)
+	if name == "" {
+		return config, nil
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q selected by %s", name, envName)
+	}
+
+	resolved := *config
+	if profile != nil {
+		if err := applyProfile(&resolved, profile); err != nil {
+			return nil, fmt.Errorf("invalid profile %q: %w", name, err)
+		}
+	}
+	logger().Info("using configuration profile", "profile", name)
+	return &resolved, nil
+}
+
+// applyProfile overrides every option of base that is set in profile.
+// Options left at their zero value in the profile keep the base value unless
+// the profile lists them in clear, which resets them to their zero value.
+func applyProfile(base, profile *Config) error {
+	dst := reflect.ValueOf(base).Elem()
+	src := reflect.ValueOf(profile).Elem()
+	overridable := func(field reflect.StructField) bool {
+		return field.IsExported() && field.Name != "Profiles" && field.Name != "ProfileEnv" && field.Name != "Clear"
+	}
+
+	fields := make(map[string]int, src.NumField())
+	for i := 0; i < src.NumField(); i++ {
+		if field := src.Type().Field(i); overridable(field) {
+			fields[strings.Split(field.Tag.Get("yaml"), ",")[0]] = i
+		}
+	}
+	var problems configErrors
+	for _, name := range profile.Clear {
+		i, ok := fields[strings.ToLower(strings.TrimSpace(name))]
+		switch {
+		case !ok:
+			problems.add(fmt.Errorf("clear: unknown option %q", name))
+		case !src.Field(i).IsZero():
+			problems.add(fmt.Errorf("clear: %s is also set by the profile", name))
+		default:
+			dst.Field(i).Set(reflect.Zero(dst.Field(i).Type()))
+		}
+	}
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	for i := 0; i < src.NumField(); i++ {
+		if !overridable(src.Type().Field(i)) {
+			continue
+		}
+		if value := src.Field(i); !value.IsZero() {
+			dst.Field(i).Set(value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package turnstile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// policies applied when the siteverify rate limit is exceeded
+const (
+	rateLimitPolicyQueue  = "queue"
+	rateLimitPolicyOpen   = "open"
+	rateLimitPolicyClosed = "closed"
+)
+
+const defaultRateLimitMaxWait = time.Second
+
+// errVerifyRateLimited is the verification error of requests over the siteverify rate limit.
+var errVerifyRateLimited = errors.New("Verification rate limit exceeded")
+
+// VerifyRateLimitConfig bounds the siteverify calls of the middleware with a token bucket.
+type VerifyRateLimitConfig struct {
+	// Rate is the number of calls per second
+	Rate int `yaml:"rate"`
+	// Burst is the number of calls that may be made at once, if not provided, rate will be used
+	Burst int `yaml:"burst"`
+	// Policy is "queue" to wait up to maxwait for a call, "open" to admit or "closed" to reject requests
+	// over the limit, if not provided, queue will be used
+	Policy string `yaml:"policy"`
+	// MaxWait bounds how long a queued request waits before it is rejected, if not provided, 1s will be used
+	MaxWait string `yaml:"maxwait"`
+}
+
+// verifyLimiter is a token bucket refilled at rate tokens per second up to burst.
+type verifyLimiter struct {
+	rate    float64
+	burst   float64
+	policy  string
+	maxWait time.Duration
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newVerifyLimiter returns nil when siteverify calls are not limited.
+func newVerifyLimiter(config *Config) (*verifyLimiter, error) {
+	limit := config.VerifyRateLimit
+	if limit == nil {
+		return nil, nil
+	}
+	if limit.Rate <= 0 {
+		return nil, errors.New("verifyratelimit.rate must be positive")
+	}
+	burst := limit.Burst
+	switch {
+	case burst == 0:
+		burst = limit.Rate
+	case burst < 0:
+		return nil, errors.New("verifyratelimit.burst cannot be negative")
+	}
+	l := &verifyLimiter{
+		rate:    float64(limit.Rate),
+		burst:   float64(burst),
+		policy:  strings.ToLower(limit.Policy),
+		maxWait: defaultRateLimitMaxWait,
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+	switch l.policy {
+	case "":
+		l.policy = rateLimitPolicyQueue
+	case rateLimitPolicyQueue, rateLimitPolicyOpen, rateLimitPolicyClosed:
+	default:
+		return nil, fmt.Errorf("invalid verifyratelimit.policy: %s", limit.Policy)
+	}
+	if limit.MaxWait != "" {
+		maxWait, err := time.ParseDuration(limit.MaxWait)
+		if err != nil || maxWait <= 0 {
+			return nil, fmt.Errorf("invalid verifyratelimit.maxwait: %s", limit.MaxWait)
+		}
+		l.maxWait = maxWait
+	}
+	return l, nil
+}
+
+// take reserves a siteverify call, waiting for it under the queue policy.
+// It returns errVerifyRateLimited when no call is available in time.
+func (l *verifyLimiter) take(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	l.mu.Lock()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	if wait > 0 && (l.policy != rateLimitPolicyQueue || wait > l.maxWait) {
+		// give the reservation back, the request does not call siteverify
+		l.tokens++
+		l.mu.Unlock()
+		return errVerifyRateLimited
+	}
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return errVerifyRateLimited
+	}
+}
+
+// errVerifySaturated is the verification error of requests finding every siteverify slot taken.
+var errVerifySaturated = errors.New("Too many concurrent verifications")
+
+// verifySlots is a semaphore bounding the concurrent siteverify calls.
+type verifySlots struct {
+	slots chan struct{}
+	// queueTimeout is how long a request waits for a slot, 0 rejects it right away
+	queueTimeout time.Duration
+}
+
+// newVerifySlots returns nil when concurrent verifications are not bounded.
+func newVerifySlots(config *Config) (*verifySlots, error) {
+	if config.MaxConcurrentVerifications == 0 {
+		if config.VerificationQueueTimeout != "" {
+			return nil, errors.New("verificationqueuetimeout requires maxconcurrentverifications")
+		}
+		return nil, nil
+	}
+	if config.MaxConcurrentVerifications < 0 {
+		return nil, errors.New("maxconcurrentverifications cannot be negative")
+	}
+	s := &verifySlots{slots: make(chan struct{}, config.MaxConcurrentVerifications)}
+	if config.VerificationQueueTimeout != "" {
+		timeout, err := time.ParseDuration(config.VerificationQueueTimeout)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid verificationqueuetimeout: %s", config.VerificationQueueTimeout)
+		}
+		s.queueTimeout = timeout
+	}
+	return s, nil
+}
+
+// acquire takes a slot, waiting up to the queue timeout, and returns
+// errVerifySaturated when none became free. Every acquired slot must be released.
+func (s *verifySlots) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if s.queueTimeout == 0 {
+		return errVerifySaturated
+	}
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errVerifySaturated
+	case <-ctx.Done():
+		return errVerifySaturated
+	}
+}
+
+func (s *verifySlots) release() {
+	if s != nil {
+		<-s.slots
+	}
+}
@@ -0,0 +1,132 @@
+package turnstile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// minRedactedSecretLength keeps short values, which could be ordinary words,
+// from being redacted everywhere they appear.
+const minRedactedSecretLength = 8
+
+// tokenPattern matches Turnstile response tokens and similar opaque
+// credentials: long runs of base64url characters and dots.
+var tokenPattern = regexp.MustCompile(`[A-Za-z0-9_\-.]{80,}`)
+
+// secretRedactor replaces every known secret and anything shaped like a
+// token in log output with a short hash, so records stay correlatable
+// without revealing the value.
+type secretRedactor struct {
+	mu      sync.Mutex
+	secrets map[string]bool
+	// replacer replaces every secret, it is rebuilt when a secret is added
+	replacer atomic.Value
+}
+
+// redactor holds every secret loaded by any middleware instance of the process.
+var redactor = newSecretRedactor()
+
+func newSecretRedactor() *secretRedactor {
+	r := &secretRedactor{secrets: map[string]bool{}}
+	r.replacer.Store(strings.NewReplacer())
+	return r
+}
+
+// add registers a secret that must never appear in logs.
+func (r *secretRedactor) add(secret string) {
+	if len(secret) < minRedactedSecretLength {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.secrets[secret] {
+		return
+	}
+	r.secrets[secret] = true
+	pairs := make([]string, 0, 2*len(r.secrets))
+	for s := range r.secrets {
+		pairs = append(pairs, s, redacted(s))
+	}
+	r.replacer.Store(strings.NewReplacer(pairs...))
+}
+
+// redact returns value with secrets and tokens replaced.
+func (r *secretRedactor) redact(value string) string {
+	value = r.replacer.Load().(*strings.Replacer).Replace(value)
+	if len(value) < 80 {
+		return value
+	}
+	return tokenPattern.ReplaceAllStringFunc(value, redacted)
+}
+
+// redacted returns the placeholder of value: a prefix of its SHA-256 hash.
+func redacted(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "[redacted:" + hex.EncodeToString(sum[:4]) + "]"
+}
+
+// redactingHandler redacts the message and every attribute of log records
+// before passing them to the next handler.
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redactedRecord := slog.NewRecord(record.Time, record.Level, redactor.redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redactedRecord.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redactedRecord)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redactedAttrs[i] = redactAttr(attr)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redactedAttrs)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name)}
+}
+
+// redactAttr redacts the value of attr. Values other than strings, groups and
+// numbers are formatted first, so secrets inside errors are caught too.
+func redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, redactor.redact(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redactedGroup := make([]any, len(group))
+		for i, member := range group {
+			redactedGroup[i] = redactAttr(member)
+		}
+		return slog.Group(attr.Key, redactedGroup...)
+	case slog.KindAny:
+		if values, ok := value.Any().([]string); ok {
+			redactedValues := make([]string, len(values))
+			for i := range values {
+				redactedValues[i] = redactor.redact(values[i])
+			}
+			return slog.Any(attr.Key, redactedValues)
+		}
+		return slog.String(attr.Key, redactor.redact(fmt.Sprint(value.Any())))
+	default:
+		return slog.Attr{Key: attr.Key, Value: value}
+	}
+}
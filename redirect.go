@@ -0,0 +1,243 @@
+package turnstile
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRedirectCallbackPath = "/turnstile/callback"
+	defaultRedirectReturnParam  = "return"
+	defaultRedirectReturnTTL    = 10 * time.Minute
+	maxRedirectCallbackLen      = 16 << 10
+	// returnSignaturePrefix keeps return URL signatures apart from session cookie signatures
+	returnSignaturePrefix = "turnstile-return:"
+)
+
+// RedirectConfig sends browsers without a token to a challenge page, for
+// server-rendered apps that cannot embed the widget on every page.
+type RedirectConfig struct {
+	// ChallengeURL is the page embedding the widget, e.g. /challenge or https://auth.example.com/challenge
+	ChallengeURL string `yaml:"challengeurl"`
+	// CallbackPath is the endpoint the challenge page posts the token and the return parameter to,
+	// if not provided, /turnstile/callback will be used
+	CallbackPath string `yaml:"callbackpath"`
+	// ReturnParam is the parameter carrying the signed return URL, if not provided, return will be used
+	ReturnParam string `yaml:"returnparam"`
+	// ReturnTTL bounds how long a signed return URL is accepted, if not provided, 10m will be used
+	ReturnTTL string `yaml:"returnttl"`
+}
+
+// returnClaims is the payload of a signed return URL.
+type returnClaims struct {
+	// URL is the request URI the browser is sent back to
+	URL       string `json:"url"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// redirectFlow redirects browser navigations without a token to the
+// challenge page and issues a session once the page posts a valid token back.
+type redirectFlow struct {
+	challengeURL *url.URL
+	callbackPath string
+	returnParam  string
+	ttl          time.Duration
+	formKey      string
+	sessions     *sessionManager
+}
+
+// newRedirectFlow returns nil when the redirect flow is not configured.
+func newRedirectFlow(config *Config, sessions *sessionManager) (*redirectFlow, error) {
+	if config.Redirect == nil {
+		return nil, nil
+	}
+	if sessions == nil {
+		return nil, errors.New("redirect requires sessionttl, browsers pass with a verification session")
+	}
+	if config.Interstitial {
+		return nil, errors.New("redirect and interstitial cannot both be enabled")
+	}
+	if config.Redirect.ChallengeURL == "" {
+		return nil, errors.New("redirect.challengeurl cannot be empty")
+	}
+	challengeURL, err := url.Parse(config.Redirect.ChallengeURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect.challengeurl: %w", err)
+	}
+	r := &redirectFlow{
+		challengeURL: challengeURL,
+		callbackPath: config.Redirect.CallbackPath,
+		returnParam:  config.Redirect.ReturnParam,
+		ttl:          defaultRedirectReturnTTL,
+		formKey:      config.FormKey,
+		sessions:     sessions,
+	}
+	if r.callbackPath == "" {
+		r.callbackPath = defaultRedirectCallbackPath
+	}
+	if !strings.HasPrefix(r.callbackPath, "/") {
+		return nil, fmt.Errorf("redirect.callbackpath must start with /")
+	}
+	if r.returnParam == "" {
+		r.returnParam = defaultRedirectReturnParam
+	}
+	if r.formKey == "" {
+		r.formKey = defaultFormKey
+	}
+	if config.Redirect.ReturnTTL != "" {
+		r.ttl, err = time.ParseDuration(config.Redirect.ReturnTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect.returnttl: %w", err)
+		}
+		if r.ttl <= 0 {
+			return nil, fmt.Errorf("redirect.returnttl must be positive")
+		}
+	}
+	return r, nil
+}
+
+// applies reports whether the rejection of req for a missing token can be
+// answered with a redirect: a browser navigation that can be repeated by
+// following a link.
+func (r *redirectFlow) applies(req *http.Request) bool {
+	if r == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// write redirects to the challenge page with the signed URI of req.
+func (r *redirectFlow) write(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+	http.Redirect(rw, req, r.challengeLocation(r.signReturn(req.URL.RequestURI()), ""), http.StatusFound)
+}
+
+// challengeLocation returns the challenge page URL carrying the signed
+// return URL and, after a failed attempt, the reason as the error parameter.
+func (r *redirectFlow) challengeLocation(signedReturn string, reason Reason) string {
+	location := *r.challengeURL
+	query := location.Query()
+	query.Set(r.returnParam, signedReturn)
+	if reason != "" {
+		query.Set("error", string(reason))
+	}
+	location.RawQuery = query.Encode()
+	return location.String()
+}
+
+func (r *redirectFlow) signReturn(uri string) string {
+	payload, _ := json.Marshal(returnClaims{URL: uri, ExpiresAt: time.Now().Add(r.ttl).Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(r.sessions.sign(returnSignaturePrefix+encoded))
+}
+
+// openReturn returns the URI of a signed return URL that has not expired.
+func (r *redirectFlow) openReturn(value string) (string, error) {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", errors.New("malformed return URL")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, r.sessions.sign(returnSignaturePrefix+encoded)) {
+		return "", errors.New("invalid return URL signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("malformed return URL")
+	}
+	var claims returnClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", errors.New("malformed return URL")
+	}
+	if time.Now().Unix() > claims.ExpiresAt {
+		return "", errors.New("return URL expired")
+	}
+	// only request URIs on this host are signed, never follow anything else
+	if !strings.HasPrefix(claims.URL, "/") || strings.HasPrefix(claims.URL, "//") {
+		return "", errors.New("invalid return URL")
+	}
+	return claims.URL, nil
+}
+
+// serveRedirectCallback verifies the token posted by the challenge page and
+// sends the browser back to the page it was redirected from with a session.
+// A failed attempt is sent back to the challenge page to try again.
+func (a *turnstile) serveRedirectCallback(rw http.ResponseWriter, req *http.Request) {
+	r := a.redirect
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		errorHandler(rw, req, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	req.Body = http.MaxBytesReader(rw, req.Body, maxRedirectCallbackLen)
+	if err := req.ParseForm(); err != nil {
+		errorHandler(rw, req, http.StatusBadRequest, "Malformed request")
+		return
+	}
+	signedReturn := req.PostForm.Get(r.returnParam)
+	uri, err := r.openReturn(signedReturn)
+	if err != nil {
+		errorHandler(rw, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+
+	// the token is verified like one sent to the router protecting the return URL
+	target := req.Clone(req.Context())
+	target.Method = http.MethodGet
+	var router *Router
+	if target.URL, err = url.ParseRequestURI(uri); err == nil {
+		router, _ = a.routes.load().match(target)
+	}
+	if router == nil {
+		errorHandler(rw, req, http.StatusBadRequest, "invalid return URL")
+		return
+	}
+	start := time.Now()
+	d := a.decideCallback(rw, req, router, req.PostForm.Get(r.formKey))
+	a.report(rw, req, router, d, start)
+	switch {
+	case d.Allowed || a.mode.shadow.Load():
+		// in shadow mode the protected page is forwarded without a session anyway
+		http.Redirect(rw, req, uri, http.StatusSeeOther)
+	case d.Reason == ReasonBlockedIP || d.Reason == ReasonBanned:
+		a.writeRejection(rw, req, router, d)
+	default:
+		a.tarpit.wait(req, d.Tarpit)
+		http.Redirect(rw, req, r.challengeLocation(signedReturn, d.Reason), http.StatusSeeOther)
+	}
+}
+
+// decideCallback determines whether the token posted to the callback earns a
+// session, applying the client checks, verification limits, tarpit and bans
+// of decide. Only a verified token is allowed, as a session outlives the
+// outage or grace period that would admit it elsewhere.
+func (a *turnstile) decideCallback(rw http.ResponseWriter, req *http.Request, router *Router, token string) *decision {
+	banKey := a.bans.banKey(req)
+	if d := a.screen(req, banKey); d != nil {
+		return d
+	}
+	if token == "" {
+		return reject(ReasonMissingToken, http.StatusBadRequest, ErrTokenMissing.Error())
+	}
+	resp, err := a.siteverify(req, router, token)
+	if d := a.throttled(err); d != nil {
+		return d
+	}
+	switch {
+	case err != nil:
+		d := reject(ReasonVerificationError, http.StatusInternalServerError, err.Error())
+		d.Err = err
+		return d
+	case !resp.Success:
+		return a.verificationFailed(req, resp, banKey)
+	}
+	return a.verified(rw, req, resp, banKey)
+}
@@ -0,0 +1,121 @@
+package turnstile
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSiteverify stands in for the Cloudflare endpoint and only accepts "valid-token".
+func fakeSiteverify(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		resp := map[string]interface{}{"success": true}
+		if req.PostForm.Get("response") != "valid-token" {
+			resp = map[string]interface{}{"success": false, "error-codes": []string{"invalid-input-response"}}
+		}
+		_ = json.NewEncoder(rw).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newRedirectTurnstile(t *testing.T) *turnstile {
+	t.Helper()
+	config := CreateConfig()
+	config.TurnstileSecret = "secret"
+	config.VerifyURL = fakeSiteverify(t).URL
+	config.LogLevel = "error"
+	config.SessionTTL = "10m"
+	config.SessionSecret = "session-test-secret"
+	config.Redirect = &RedirectConfig{ChallengeURL: "/challenge"}
+	config.Routers = []Router{{Method: http.MethodGet, Path: "/account/**"}}
+	handler, err := New(context.Background(), http.NotFoundHandler(), config, "redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler.(*turnstile)
+}
+
+// signedReturnClaims signs claims the way signReturn does, with data to sign
+// computed from the encoded claims.
+func signedReturnClaims(r *redirectFlow, claims returnClaims, data func(encoded string) string) string {
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(r.sessions.sign(data(encoded)))
+}
+
+func TestOpenReturn(t *testing.T) {
+	r := newRedirectTurnstile(t).redirect
+	valid := r.signReturn("/account/settings?tab=1")
+	encoded, signature, _ := strings.Cut(valid, ".")
+	inAMinute := time.Now().Add(time.Minute).Unix()
+	withPrefix := func(encoded string) string { return returnSignaturePrefix + encoded }
+	session, err := r.sessions.encode(&sessionClaims{IssuedAt: time.Now().Unix(), ExpiresAt: inAMinute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, value, want string
+	}{
+		{"valid", valid, "/account/settings?tab=1"},
+		{"tampered signature", encoded + "." + strings.Repeat("A", len(signature)), ""},
+		{"tampered claims", base64.RawURLEncoding.EncodeToString([]byte(`{"url":"/account/other","exp":9999999999}`)) + "." + signature, ""},
+		{"missing signature", encoded, ""},
+		{"expired", signedReturnClaims(r, returnClaims{URL: "/account", ExpiresAt: time.Now().Add(-time.Second).Unix()}, withPrefix), ""},
+		{"protocol-relative URL", signedReturnClaims(r, returnClaims{URL: "//evil.example/account", ExpiresAt: inAMinute}, withPrefix), ""},
+		{"absolute URL", signedReturnClaims(r, returnClaims{URL: "https://evil.example/", ExpiresAt: inAMinute}, withPrefix), ""},
+		{"signed like a session cookie", signedReturnClaims(r, returnClaims{URL: "/account", ExpiresAt: inAMinute}, func(encoded string) string { return encoded }), ""},
+		{"session cookie", session, ""},
+	}
+	for _, tt := range tests {
+		got, err := r.openReturn(tt.value)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("%s: openReturn = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestRedirectCallback(t *testing.T) {
+	a := newRedirectTurnstile(t)
+	signedReturn := a.redirect.signReturn("/account/settings")
+	post := func(form url.Values) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, a.redirect.callbackPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	tests := []struct {
+		name     string
+		req      *http.Request
+		status   int
+		location string
+		session  bool
+	}{
+		{"GET", httptest.NewRequest(http.MethodGet, a.redirect.callbackPath+"?return="+url.QueryEscape(signedReturn), nil), http.StatusMethodNotAllowed, "", false},
+		{"valid token", post(url.Values{"return": {signedReturn}, defaultFormKey: {"valid-token"}}), http.StatusSeeOther, "/account/settings", true},
+		{"missing token", post(url.Values{"return": {signedReturn}}), http.StatusSeeOther, a.redirect.challengeLocation(signedReturn, ReasonMissingToken), false},
+		{"invalid token", post(url.Values{"return": {signedReturn}, defaultFormKey: {"forged"}}), http.StatusSeeOther, a.redirect.challengeLocation(signedReturn, ReasonVerificationFailed), false},
+		{"tampered return URL", post(url.Values{"return": {signedReturn + "A"}, defaultFormKey: {"valid-token"}}), http.StatusBadRequest, "", false},
+		{"unprotected return URL", post(url.Values{"return": {a.redirect.signReturn("/public")}, defaultFormKey: {"valid-token"}}), http.StatusBadRequest, "", false},
+	}
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		a.ServeHTTP(rw, tt.req)
+		if rw.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rw.Code, tt.status)
+		}
+		if location := rw.Header().Get("Location"); location != tt.location {
+			t.Errorf("%s: location = %q, want %q", tt.name, location, tt.location)
+		}
+		if session := len(rw.Result().Cookies()) > 0; session != tt.session {
+			t.Errorf("%s: session issued = %v, want %v", tt.name, session, tt.session)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package turnstile
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	defaultRequestIDHeader = "X-Request-ID"
+	// maxRequestIDLength bounds propagated request IDs, longer values are replaced
+	maxRequestIDLength = 128
+)
+
+type requestIDContextKey struct{}
+
+// withRequestID propagates the request ID carried in header by req, or
+// generates one, and returns req with the ID in its header and context.
+// The ID is also sent back to the client in the response header.
+func withRequestID(rw http.ResponseWriter, req *http.Request, header string) *http.Request {
+	id := req.Header.Get(header)
+	if !validRequestID(id) {
+		generated, err := newUUID()
+		if err != nil {
+			return req
+		}
+		id = generated
+		req.Header.Set(header, id)
+	}
+	rw.Header().Set(header, id)
+	return req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, id))
+}
+
+// validRequestID reports whether id may be propagated: a bounded run of
+// printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFromContext returns the request ID of ctx, or "".
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// requestIDHandler adds the request ID of the context to every log record
+// logged with it.
+type requestIDHandler struct {
+	next slog.Handler
+}
+
+func (h *requestIDHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		record = record.Clone()
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &requestIDHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *requestIDHandler) WithGroup(name string) slog.Handler {
+	return &requestIDHandler{next: h.next.WithGroup(name)}
+}
@@ -0,0 +1,49 @@
+package turnstile
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// responseWriter is the base of every response-wrapping writer of the plugin.
+// It forwards the optional http.Flusher, http.Hijacker and http.Pusher
+// interfaces to the wrapped writer, so streaming backends, server-sent events
+// and websockets keep working behind the middleware.
+type responseWriter struct {
+	http.ResponseWriter
+}
+
+var (
+	_ http.Flusher  = responseWriter{}
+	_ http.Hijacker = responseWriter{}
+	_ http.Pusher   = responseWriter{}
+)
+
+// Flush forwards to the wrapped writer when it supports flushing.
+func (w responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack forwards to the wrapped writer, or fails with http.ErrNotSupported.
+func (w responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Push forwards to the wrapped writer, or fails with http.ErrNotSupported.
+func (w responseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := w.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap exposes the wrapped writer to http.ResponseController.
+func (w responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,82 @@
+package turnstile
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fullWriter implements every optional interface and records the calls.
+type fullWriter struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+	pushed   string
+}
+
+func (w *fullWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func (w *fullWriter) Push(target string, _ *http.PushOptions) error {
+	w.pushed = target
+	return nil
+}
+
+// plainWriter implements http.ResponseWriter only.
+type plainWriter struct {
+	header http.Header
+}
+
+func (w *plainWriter) Header() http.Header         { return w.header }
+func (w *plainWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *plainWriter) WriteHeader(int)             {}
+
+func TestResponseWriterPassthrough(t *testing.T) {
+	underlying := &fullWriter{ResponseRecorder: httptest.NewRecorder()}
+	w := newBodyRewriter(underlying, func(http.Header) bool { return false }, nil)
+
+	w.Flush()
+	if !underlying.Flushed {
+		t.Error("Flush was not forwarded")
+	}
+	if _, _, err := w.Hijack(); err != nil || !underlying.hijacked {
+		t.Errorf("Hijack was not forwarded: %v", err)
+	}
+	if err := w.Push("/app.js", nil); err != nil || underlying.pushed != "/app.js" {
+		t.Errorf("Push was not forwarded: %v", err)
+	}
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		t.Errorf("ResponseController could not flush: %v", err)
+	}
+}
+
+func TestResponseWriterNotSupported(t *testing.T) {
+	w := responseWriter{&plainWriter{header: http.Header{}}}
+
+	w.Flush()
+	if _, _, err := w.Hijack(); err != http.ErrNotSupported {
+		t.Errorf("Hijack: got %v, want http.ErrNotSupported", err)
+	}
+	if err := w.Push("/app.js", nil); err != http.ErrNotSupported {
+		t.Errorf("Push: got %v, want http.ErrNotSupported", err)
+	}
+}
+
+func TestBodyRewriterDoesNotFlushBufferedResponse(t *testing.T) {
+	underlying := httptest.NewRecorder()
+	w := newBodyRewriter(underlying, isHTMLResponse, func(body []byte) []byte { return body })
+	w.Header().Set("Content-Type", "text/html")
+
+	_, _ = w.Write([]byte("<html></html>"))
+	w.Flush()
+	if underlying.Flushed || underlying.Body.Len() != 0 {
+		t.Fatal("buffered response was flushed before finish")
+	}
+	w.finish()
+	if underlying.Body.String() != "<html></html>" {
+		t.Errorf("got body %q", underlying.Body.String())
+	}
+}
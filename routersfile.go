@@ -0,0 +1,118 @@
+package turnstile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// routersFileInterval is how often the routers file is checked for changes.
+const routersFileInterval = 5 * time.Second
+
+// liveRoutes holds the route matcher in use. It is replaced as a whole when
+// the routers file changes, so a request always sees one consistent set.
+type liveRoutes struct {
+	current atomic.Value
+}
+
+func newLiveRoutes(matcher *routeMatcher) *liveRoutes {
+	l := &liveRoutes{}
+	l.current.Store(matcher)
+	return l
+}
+
+func (l *liveRoutes) load() *routeMatcher {
+	return l.current.Load().(*routeMatcher)
+}
+
+// routersFile is a JSON file of routers protected in addition to the inline
+// routers, reloaded when it changes.
+type routersFile struct {
+	path string
+	// config is the configuration the routers are compiled with, its Routers are the inline routers
+	config Config
+	// modTime and size identify the loaded version, they are only touched by reload
+	modTime time.Time
+	size    int64
+}
+
+// newRoutersFile returns nil when no routers file is configured.
+func newRoutersFile(config *Config) *routersFile {
+	if config.RoutersFile == "" {
+		return nil
+	}
+	return &routersFile{path: config.RoutersFile, config: *config}
+}
+
+// load reads the file and returns the route matcher of the inline and file routers.
+func (f *routersFile) load() (*routeMatcher, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routersfile: %w", err)
+	}
+	// an invalid version is remembered too, so it is reported once rather than on every check
+	f.modTime, f.size = info.ModTime(), info.Size()
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routersfile: %w", err)
+	}
+	routers, err := parseRouters(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routersfile %s: %w", f.path, err)
+	}
+	config := f.config
+	config.Routers = append(append([]Router{}, f.config.Routers...), routers...)
+	matcher, err := newRouteMatcher(&config)
+	if err != nil {
+		return nil, err
+	}
+	return matcher, nil
+}
+
+// parseRouters accepts either an array of routers or an object with a
+// routers array, using the same keys as the plugin configuration.
+func parseRouters(content []byte) ([]Router, error) {
+	content = bytes.TrimSpace(content)
+	if len(content) > 0 && content[0] == '[' {
+		var routers []Router
+		if err := json.Unmarshal(content, &routers); err != nil {
+			return nil, err
+		}
+		return routers, nil
+	}
+	var file struct {
+		Routers []Router `json:"routers"`
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	return file.Routers, nil
+}
+
+// changed reports whether the file was modified since it was loaded.
+func (f *routersFile) changed() bool {
+	info, err := os.Stat(f.path)
+	return err == nil && (!info.ModTime().Equal(f.modTime) || info.Size() != f.size)
+}
+
+// watch reloads the routers every routersFileInterval until ctx is done. A
+// file that cannot be read or holds invalid routers keeps the current routes.
+func (f *routersFile) watch(ctx context.Context, routes *liveRoutes, metrics *metrics) {
+	background.schedule(ctx, "routers-file-watch", routersFileInterval, func() {
+		if !f.changed() {
+			return
+		}
+		matcher, err := f.load()
+		if err != nil {
+			logger().Error("keeping the current routers, failed to reload the routers file", "file", f.path, "error", err)
+			return
+		}
+		metrics.registerRoutes(matcher)
+		routes.current.Store(matcher)
+		logger().Info("reloaded routers", "file", f.path)
+	})
+}
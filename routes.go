@@ -0,0 +1,310 @@
+package turnstile
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// routeMatcher resolves the router protecting a request. It is built once in
+// New() from pre-compiled routers and never modified afterwards.
+type routeMatcher struct {
+	// routers are ordered by priority, the first matching router wins
+	routers  *routeTree
+	excluded *routeTree
+	// fallback protects every request not matching a router in protect-all mode
+	fallback *Router
+	// bypassPreflight leaves CORS preflights unprotected
+	bypassPreflight bool
+	// bypassMethods holds the upper-cased methods that are never protected
+	bypassMethods map[string]bool
+}
+
+func newRouteMatcher(config *Config) (*routeMatcher, error) {
+	var problems configErrors
+	options := pathOptions{caseSensitive: config.CaseSensitive, strictTrailingSlash: config.StrictTrailingSlash}
+	routers, err := resolveGroups(config.Routers, config.Groups)
+	problems.add(err)
+	multipartMemory := config.MultipartMemory
+	switch {
+	case multipartMemory == 0:
+		multipartMemory = defaultMultipartMemory
+	case multipartMemory < 0:
+		problems.add(errors.New("multipartmemory cannot be negative"))
+	}
+	maxFormBytes := int64(defaultMaxFormBytes)
+	if config.MaxBodyBytes > 0 {
+		maxFormBytes = config.MaxBodyBytes
+	}
+	for i := range routers {
+		routers[i].applyFormKey(config.FormKey, config.FormKeys)
+		routers[i].multipartMemory = multipartMemory
+		routers[i].maxFormBytes = maxFormBytes
+	}
+	routers, err = compileRouters(routers, options)
+	problems.add(err)
+	expressions := features(config.Features).enabled(featureExpressionPolicies)
+	for i := range routers {
+		if legacyHeaderAndForm(&routers[i]) {
+			logger().Warn("headerkey with formkey is deprecated, list header and form in tokensources instead", "router", routers[i].label())
+			routers[i].tokenSources = []TokenSource{SourceHeader, SourceForm}
+		}
+		problems.add(validateRouter(&routers[i], true))
+		if routers[i].TokenExpr != "" && !expressions {
+			problems.add(fmt.Errorf("router %s: tokenexpr requires the expressionpolicies feature flag", routers[i].label()))
+		}
+	}
+	excluded, err := compileRouters(config.ExcludeRouters, options)
+	problems.add(err)
+	for i := range excluded {
+		problems.add(validateRouter(&excluded[i], false))
+	}
+	bypassMethods, err := compileBypassMethods(config.BypassMethods)
+	problems.add(err)
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+
+	// the first matching router wins, so order them deterministically by priority
+	sort.SliceStable(routers, func(i, j int) bool {
+		return routers[i].Priority > routers[j].Priority
+	})
+	m := &routeMatcher{
+		routers:         newRouteTree(routers),
+		excluded:        newRouteTree(excluded),
+		bypassPreflight: config.BypassPreflight,
+		bypassMethods:   bypassMethods,
+	}
+	if config.ProtectAll {
+		fallback := Router{multipartMemory: multipartMemory, maxFormBytes: maxFormBytes}
+		fallback.applyFormKey(config.FormKey, config.FormKeys)
+		compiled, err := compileRouters([]Router{fallback}, options)
+		if err != nil {
+			return nil, err
+		}
+		m.fallback = &compiled[0]
+	}
+	return m, nil
+}
+
+// match returns the router protecting req, if any.
+func (m *routeMatcher) match(req *http.Request) (*Router, bool) {
+	if m.bypassPreflight && isPreflight(req) || m.bypassMethods[strings.ToUpper(req.Method)] {
+		return nil, false
+	}
+	if _, excluded := m.excluded.match(req); excluded {
+		return nil, false
+	}
+	if router, ok := m.routers.match(req); ok {
+		return router, true
+	}
+	if m.fallback != nil {
+		return m.fallback, true
+	}
+	return nil, false
+}
+
+// isPreflight reports whether req is a CORS preflight, which browsers send
+// without credentials or custom headers and thus without a token.
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// all returns every router requests can be handled by, the fallback included.
+func (m *routeMatcher) all() []*Router {
+	routers := make([]*Router, 0, len(m.routers.routers)+1)
+	for i := range m.routers.routers {
+		routers = append(routers, &m.routers.routers[i])
+	}
+	if m.fallback != nil {
+		routers = append(routers, m.fallback)
+	}
+	return routers
+}
+
+func (r *Router) isMatch(req *http.Request) bool {
+	if !r.matchesMethod(req.Method) {
+		return false
+	}
+	if r.Host != "" && !matchHost(r.Host, req.Host) {
+		return false
+	}
+	if !matchHeaders(r.headers, req) {
+		return false
+	}
+	if len(r.query) > 0 && !matchQuery(r.query, req.URL.Query()) {
+		return false
+	}
+
+	if r.pathRegexp != nil {
+		if !r.pathRegexp.MatchString(req.URL.Path) {
+			return false
+		}
+	} else if !r.path.match(req.URL.Path) {
+		return false
+	}
+
+	// exclusions are evaluated after the positive match
+	for i := range r.excludePaths {
+		if r.excludePaths[i].match(req.URL.Path) {
+			return false
+		}
+	}
+	// the operation is read from the body, so it is checked last
+	return r.graphql.matches(req)
+}
+
+// pathSegment is a pre-normalized segment of a path template.
+type pathSegment struct {
+	value string
+	// any is set for {parameter} and * segments
+	any bool
+}
+
+// pathOptions control how path templates and request paths are normalized
+// before they are compared.
+type pathOptions struct {
+	caseSensitive bool
+	// strictTrailingSlash makes a trailing slash significant, /login no longer matches /login/
+	strictTrailingSlash bool
+}
+
+// pathPattern is a path template split into segments once at New(), so
+// matching a request walks its path without allocating.
+type pathPattern struct {
+	segments []pathSegment
+	// prefix is set for templates ending in **, which match any number of remaining segments
+	prefix bool
+	// trailingSlash records whether the template ends in a slash
+	trailingSlash bool
+	options       pathOptions
+}
+
+func compilePath(pattern string, options pathOptions) pathPattern {
+	p := pathPattern{trailingSlash: hasTrailingSlash(pattern), options: options}
+	if !options.caseSensitive {
+		pattern = strings.ToLower(pattern)
+	}
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	// a trailing ** matches any number of remaining segments, including none
+	if last := len(parts) - 1; parts[last] == "**" {
+		parts, p.prefix = parts[:last], true
+	}
+	p.segments = make([]pathSegment, len(parts))
+	for i, part := range parts {
+		// a parameter (wrapped in {}) or a single segment wildcard matches any value
+		p.segments[i] = pathSegment{
+			value: part,
+			any:   part == "*" || strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"),
+		}
+	}
+	return p
+}
+
+// match reports whether the request path matches the template. Leading and,
+// unless strictTrailingSlash is set, trailing slashes are ignored on both sides.
+func (p *pathPattern) match(path string) bool {
+	// a ** template matches any remainder, a trailing slash included
+	if p.options.strictTrailingSlash && !p.prefix && hasTrailingSlash(path) != p.trailingSlash {
+		return false
+	}
+	path = strings.Trim(path, "/")
+	i := 0
+	for {
+		segment, rest, more := strings.Cut(path, "/")
+		if i == len(p.segments) {
+			// request segments remain
+			return p.prefix
+		}
+		if !p.segments[i].any && !p.equal(segment, p.segments[i].value) {
+			return false
+		}
+		i++
+		if !more {
+			return i == len(p.segments)
+		}
+		path = rest
+	}
+}
+
+func (p *pathPattern) equal(segment, value string) bool {
+	if p.options.caseSensitive {
+		return segment == value
+	}
+	return strings.EqualFold(segment, value)
+}
+
+// hasTrailingSlash reports whether path ends in a slash, the root path does not.
+func hasTrailingSlash(path string) bool {
+	return len(path) > 1 && path[len(path)-1] == '/'
+}
+
+// matchHost reports whether host (which may include a port) matches pattern.
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return len(host) > len(suffix)+1 && host[len(host)-len(suffix)-1] == '.' &&
+			strings.EqualFold(host[len(host)-len(suffix):], suffix)
+	}
+	return strings.EqualFold(host, pattern)
+}
+
+func (r *Router) matchesMethod(method string) bool {
+	if r.methods == nil {
+		return true
+	}
+	for _, m := range r.methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileBypassMethods returns the set of bypassed methods, nil when none are configured.
+func compileBypassMethods(configured []string) (map[string]bool, error) {
+	if len(configured) == 0 {
+		return nil, nil
+	}
+	var problems configErrors
+	methods := make(map[string]bool, len(configured))
+	for _, m := range configured {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		switch m {
+		case "":
+			problems.add(fmt.Errorf("bypassmethods cannot contain an empty method"))
+		case "*", "ANY":
+			problems.add(fmt.Errorf("bypassmethods cannot contain %s, use excluderouters to leave paths unprotected", m))
+		default:
+			methods[m] = true
+		}
+	}
+	return methods, problems.err()
+}
+
+// compileMethods merges Method into Methods, any method is matched when the
+// list is empty or contains "*" or ANY.
+func compileMethods(r *Router) []string {
+	configured := r.Methods
+	if r.Method != "" {
+		configured = append([]string{r.Method}, configured...)
+	}
+	methods := make([]string, 0, len(configured))
+	for _, m := range configured {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "*" || m == "ANY" {
+			return nil
+		}
+		methods = append(methods, m)
+	}
+	if len(methods) == 0 {
+		return nil
+	}
+	return methods
+}
@@ -0,0 +1,152 @@
+package turnstile
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// routeTree indexes routers by their path template so a request only evaluates
+// the routers whose template can match its path, instead of scanning every
+// router. Routers are referenced by their position in the priority-ordered
+// slice, so the lowest matching position still wins. Routers matched by a
+// regular expression cannot be indexed and are always evaluated.
+type routeTree struct {
+	routers []Router
+	root    *routeNode
+	// regexp holds the positions of routers matched by pathregexp
+	regexp []int
+}
+
+// routeNode is the node reached after consuming a number of path segments.
+// Every position list is in ascending order.
+type routeNode struct {
+	// literal children are keyed by their lowercased segment
+	literal map[string]*routeNode
+	// param is the child for {parameter} and * segments
+	param *routeNode
+	// exact routers match when the path ends at this node
+	exact []int
+	// prefix routers end in ** and match any number of remaining segments
+	prefix []int
+}
+
+func newRouteTree(routers []Router) *routeTree {
+	t := &routeTree{routers: routers, root: &routeNode{}}
+	for i := range routers {
+		if routers[i].pathRegexp != nil {
+			t.regexp = append(t.regexp, i)
+			continue
+		}
+		node := t.root
+		for _, segment := range routers[i].path.segments {
+			node = node.child(segment)
+		}
+		if routers[i].path.prefix {
+			node.prefix = append(node.prefix, i)
+		} else {
+			node.exact = append(node.exact, i)
+		}
+	}
+	return t
+}
+
+func (n *routeNode) child(segment pathSegment) *routeNode {
+	if segment.any {
+		if n.param == nil {
+			n.param = &routeNode{}
+		}
+		return n.param
+	}
+	if n.literal == nil {
+		n.literal = make(map[string]*routeNode)
+	}
+	next, ok := n.literal[segment.value]
+	if !ok {
+		next = &routeNode{}
+		n.literal[segment.value] = next
+	}
+	return next
+}
+
+// match returns the first router, in priority order, matching req.
+func (t *routeTree) match(req *http.Request) (*Router, bool) {
+	best := len(t.routers)
+	t.evaluate(t.regexp, req, &best)
+	t.walk(t.root, strings.Trim(req.URL.Path, "/"), true, req, &best)
+	if best == len(t.routers) {
+		return nil, false
+	}
+	return &t.routers[best], true
+}
+
+// walk evaluates the routers of every node the remaining path can reach.
+// A path always has at least one segment, "/" is a single empty segment.
+func (t *routeTree) walk(n *routeNode, path string, remaining bool, req *http.Request, best *int) {
+	t.evaluate(n.prefix, req, best)
+	if !remaining {
+		t.evaluate(n.exact, req, best)
+		return
+	}
+	segment, rest, more := strings.Cut(path, "/")
+	if n.literal != nil {
+		if next := n.lookup(segment); next != nil {
+			t.walk(next, rest, more, req, best)
+		}
+	}
+	if n.param != nil {
+		t.walk(n.param, rest, more, req, best)
+	}
+}
+
+// lookup returns the literal child matching segment case-insensitively.
+func (n *routeNode) lookup(segment string) *routeNode {
+	if next, ok := n.literal[segment]; ok {
+		return next
+	}
+	if isLowerASCII(segment) {
+		return nil
+	}
+	if isASCII(segment) {
+		return n.literal[strings.ToLower(segment)]
+	}
+	// Unicode case folding is not a plain lowercase mapping
+	for value, next := range n.literal {
+		if strings.EqualFold(value, segment) {
+			return next
+		}
+	}
+	return nil
+}
+
+// evaluate fully matches the routers at positions lower than best, the
+// first match of the ascending list is the only one that can improve best.
+func (t *routeTree) evaluate(positions []int, req *http.Request, best *int) {
+	for _, i := range positions {
+		if i >= *best {
+			return
+		}
+		if t.routers[i].isMatch(req) {
+			*best = i
+			return
+		}
+	}
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func isLowerASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= utf8.RuneSelf || 'A' <= c && c <= 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package turnstile
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// linearMatch is the scan the route tree replaces, the first router in
+// priority order matching req wins.
+func linearMatch(routers []Router, method, target string) string {
+	req := httptest.NewRequest(method, target, nil)
+	for i := range routers {
+		if routers[i].isMatch(req) {
+			return routers[i].label()
+		}
+	}
+	return ""
+}
+
+func TestRouteTreeMatchesLinearScan(t *testing.T) {
+	config := CreateConfig()
+	config.Routers = []Router{
+		{Method: "POST", Path: "/api/users/{id}"},
+		{Method: "POST", Path: "/api/users/me", Priority: 10},
+		{Method: "POST", Path: "/api/**"},
+		{Method: "GET", Path: "/Login"},
+		{Method: "POST", PathRegexp: "/api/v[0-9]+/.*", Priority: 5},
+		{Method: "POST", Path: "/files/*/raw"},
+		{Method: "POST", Path: "/files/{name}/raw", Priority: 1},
+		{Method: "PUT", Path: "/"},
+		{Methods: []string{"*"}, Path: "/straße"},
+	}
+	m, err := newRouteMatcher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, target, want string
+	}{
+		// a higher priority beats configured order
+		{"POST", "/api/users/me", "POST /api/users/me"},
+		{"POST", "/api/users/42", "POST /api/users/{id}"},
+		{"POST", "/api/users/42/avatar", "POST /api/**"},
+		{"POST", "/api", "POST /api/**"},
+		{"POST", "/api/v2/users/42", "POST /api/v[0-9]+/.*"},
+		{"POST", "/api/v2/users/me", "POST /api/v[0-9]+/.*"},
+		{"POST", "/files/a/raw", "POST /files/{name}/raw"},
+		{"POST", "/files/a/b/raw", ""},
+		{"GET", "/login", "GET /Login"},
+		{"GET", "/LOGIN/", "GET /Login"},
+		{"POST", "/login", ""},
+		{"PUT", "/", "PUT /"},
+		{"PUT", "/x", ""},
+		{"DELETE", "/STRASSE", ""},
+		{"DELETE", "/STRAßE", "* /straße"},
+		{"GET", "/unknown", ""},
+	}
+	for _, tt := range tests {
+		linear := linearMatch(m.routers.routers, tt.method, tt.target)
+		got := ""
+		if router, ok := m.routers.match(httptest.NewRequest(tt.method, tt.target, nil)); ok {
+			got = router.label()
+		}
+		if got != tt.want || linear != tt.want {
+			t.Errorf("%s %s: tree matched %q, linear scan %q, want %q", tt.method, tt.target, got, linear, tt.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package turnstile
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// secretFileInterval is how often a secret file is checked for changes.
+const secretFileInterval = 10 * time.Second
+
+// secretSource provides the current siteverify secret.
+type secretSource interface {
+	secret() string
+}
+
+// watchedSecret is a secretSource refreshed in the background.
+type watchedSecret interface {
+	secretSource
+	watch(ctx context.Context)
+}
+
+// staticSecret is a secret configured inline.
+type staticSecret string
+
+func (s staticSecret) secret() string {
+	return string(s)
+}
+
+// newSecretSource returns the source of the turnstile secret configured by
+// one of turnstilesecret, turnstilesecretfile, vault or secretref. It returns nil when neither
+// is set but per-host secrets are, every protected host then needs its own.
+func newSecretSource(config *Config) (secretSource, error) {
+	configured := 0
+	for _, set := range []bool{config.TurnstileSecret != "", config.TurnstileSecretFile != "", config.Vault != nil, config.SecretRef != ""} {
+		if set {
+			configured++
+		}
+	}
+	switch {
+	case configured > 1:
+		return nil, fmt.Errorf("turnstilesecret, turnstilesecretfile, vault and secretref are mutually exclusive")
+	case config.SecretRef != "":
+		return loadCloudSecret(config.SecretRef)
+	case config.Vault != nil:
+		return loadVaultSecret(config.Vault)
+	case config.TurnstileSecretFile != "":
+		return loadSecretFile(config.TurnstileSecretFile)
+	case config.TurnstileSecret != "":
+		value, err := resolveSecretRef("turnstilesecret", config.TurnstileSecret)
+		if err != nil {
+			return nil, err
+		}
+		return staticSecret(value), nil
+	case len(config.Secrets) > 0:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("turnstilesecret cannot be empty")
+	}
+}
+
+// newRouterSecret returns the secret overriding the host secret for r, or nil
+// when r does not set one.
+func newRouterSecret(r *Router) (secretSource, error) {
+	if r.Secret == "" {
+		return nil, nil
+	}
+	value, err := resolveSecretRef("secret", r.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return staticSecret(value), nil
+}
+
+// hostSecret is the secret of the site served on hosts matching pattern.
+type hostSecret struct {
+	pattern string
+	secret  secretSource
+}
+
+// hostSecrets selects the secret of the site a request is for, so one
+// middleware instance can protect several sites with their own widgets.
+type hostSecrets struct {
+	exact map[string]secretSource
+	// wildcards are "*." patterns, most specific first
+	wildcards []hostSecret
+	fallback  secretSource
+}
+
+// newHostSecrets returns the per-host secrets of config with fallback used
+// for every other host.
+func newHostSecrets(config *Config, fallback secretSource) (*hostSecrets, error) {
+	h := &hostSecrets{exact: make(map[string]secretSource), fallback: fallback}
+	patterns := make([]string, 0, len(config.Secrets))
+	for pattern := range config.Secrets {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	var problems configErrors
+	for _, pattern := range patterns {
+		value, err := resolveSecretRef("secrets."+pattern, config.Secrets[pattern])
+		if err != nil {
+			problems.add(err)
+			continue
+		}
+		if value == "" {
+			problems.add(fmt.Errorf("secrets.%s cannot be empty", pattern))
+			continue
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			h.wildcards = append(h.wildcards, hostSecret{pattern: pattern, secret: staticSecret(value)})
+		} else {
+			h.exact[strings.ToLower(pattern)] = staticSecret(value)
+		}
+	}
+	sort.SliceStable(h.wildcards, func(i, j int) bool {
+		return len(h.wildcards[i].pattern) > len(h.wildcards[j].pattern)
+	})
+	return h, problems.err()
+}
+
+// forHost returns the secret for host, which may include a port, or nil when
+// neither a per-host nor a default secret is configured for it.
+func (h *hostSecrets) forHost(host string) secretSource {
+	if len(h.exact) == 0 && len(h.wildcards) == 0 {
+		return h.fallback
+	}
+	name := host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		name = hostname
+	}
+	if secret, ok := h.exact[strings.ToLower(strings.TrimSuffix(name, "."))]; ok {
+		return secret
+	}
+	for _, wildcard := range h.wildcards {
+		if matchHost(wildcard.pattern, host) {
+			return wildcard.secret
+		}
+	}
+	return h.fallback
+}
+
+// resolveSecretRef resolves a "${env:NAME}" reference in the value of a
+// secret option, so the literal secret never appears in the configuration.
+// "${NAME}" is short for "${env:NAME}", other values are returned unchanged.
+// The resolved secret is registered for redaction from logs.
+func resolveSecretRef(option, value string) (string, error) {
+	ref, ok := strings.CutPrefix(value, "${")
+	if !ok || !strings.HasSuffix(ref, "}") {
+		redactor.add(value)
+		return value, nil
+	}
+	scheme, name, ok := strings.Cut(strings.TrimSuffix(ref, "}"), ":")
+	if !ok {
+		scheme, name = "env", scheme
+	}
+	switch scheme {
+	case "env":
+		resolved := strings.TrimSpace(os.Getenv(name))
+		if resolved == "" {
+			return "", fmt.Errorf("invalid %s: environment variable %s is not set", option, name)
+		}
+		redactor.add(resolved)
+		return resolved, nil
+	default:
+		return "", fmt.Errorf("invalid %s: unsupported secret reference scheme %q", option, scheme)
+	}
+}
+
+// secretFile is a secret mounted as a file, e.g. a Docker or Kubernetes
+// secret, that is re-read when the file changes so it can be rotated without
+// touching the dynamic configuration.
+type secretFile struct {
+	path    string
+	current atomic.Value
+	// modTime and size identify the loaded version, they are only touched by reload
+	modTime time.Time
+	size    int64
+}
+
+func loadSecretFile(path string) (*secretFile, error) {
+	s := &secretFile{path: path}
+	if err := s.reload(); err != nil {
+		return nil, fmt.Errorf("invalid turnstilesecretfile: %w", err)
+	}
+	return s, nil
+}
+
+func (s *secretFile) secret() string {
+	return s.current.Load().(string)
+}
+
+// watch re-reads the file every secretFileInterval until ctx is done.
+func (s *secretFile) watch(ctx context.Context) {
+	background.schedule(ctx, "secret-file-watch", secretFileInterval, func() {
+		if err := s.reload(); err != nil {
+			logger().Warn("keeping the current secret, failed to reload the secret file", "file", s.path, "error", err)
+		}
+	})
+}
+
+// reload reads the file when it changed since the last load. The previous
+// secret is kept when the file is missing or empty, e.g. while a secret
+// volume is being updated.
+func (s *secretFile) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if s.current.Load() != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return fmt.Errorf("%s is empty", s.path)
+	}
+	redactor.add(value)
+	s.current.Store(value)
+	s.modTime, s.size = info.ModTime(), info.Size()
+	return nil
+}
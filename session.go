@@ -0,0 +1,334 @@
+package turnstile
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSessionCookieName = "turnstile_session"
+	defaultSessionMaxAge     = 24 * time.Hour
+)
+
+// session IP binding modes
+const (
+	sessionIPBindingOff    = "off"
+	sessionIPBindingStrict = "strict"
+	sessionIPBindingPrefix = "prefix"
+)
+
+// sessionClaims is the payload carried by the verification session cookie.
+type sessionClaims struct {
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+	// IP is the client address or network the session is bound to, empty when binding is off
+	IP string `json:"ip,omitempty"`
+}
+
+// sessionManager issues and validates the signed cookie that lets a client skip
+// re-verification after it has passed a Turnstile challenge once.
+type sessionManager struct {
+	key  []byte
+	ttl  time.Duration
+	aead cipher.AEAD
+	// ipBinding is one of the sessionIPBinding modes
+	ipBinding string
+	// sliding refreshes the expiry on every session pass, never beyond maxAge after issue
+	sliding bool
+	maxAge  time.Duration
+	// cookie holds the configured cookie attributes, Value and MaxAge are filled in on issue
+	cookie http.Cookie
+	// header is the request header carrying clearances issued by the attestation
+	// exchange, empty when the exchange is disabled
+	header string
+}
+
+// newSessionManager returns nil when sessions are not configured. Without a
+// session secret, the key is derived from the turnstile secret at startup.
+func newSessionManager(config *Config, secret secretSource) (*sessionManager, error) {
+	if config.SessionTTL == "" {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(config.SessionTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sessionttl: %w", err)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("sessionttl must be positive")
+	}
+
+	sessionSecret, err := resolveSecretRef("sessionsecret", config.SessionSecret)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(sessionSecret)
+	if len(key) == 0 && secret != nil {
+		// derive a key from the turnstile secret so that every instance sharing
+		// the same configuration accepts the same cookies
+		mac := hmac.New(sha256.New, []byte(secret.secret()))
+		mac.Write([]byte("turnstile-session"))
+		key = mac.Sum(nil)
+	}
+	if len(key) == 0 && len(config.Secrets) > 0 {
+		return nil, fmt.Errorf("sessionsecret is required when only per-host secrets are configured")
+	}
+
+	sameSite, err := parseSameSite(config.SessionCookieSameSite)
+	if err != nil {
+		return nil, err
+	}
+	cookieName := config.SessionCookieName
+	if cookieName == "" {
+		cookieName = defaultSessionCookieName
+	}
+	cookiePath := config.SessionCookiePath
+	if cookiePath == "" {
+		cookiePath = "/"
+	}
+	ipBinding := strings.ToLower(config.SessionIPBinding)
+	switch ipBinding {
+	case "":
+		ipBinding = sessionIPBindingOff
+	case sessionIPBindingOff, sessionIPBindingStrict, sessionIPBindingPrefix:
+	default:
+		return nil, fmt.Errorf("invalid sessionipbinding: %s", config.SessionIPBinding)
+	}
+
+	maxAge := ttl
+	if config.SessionMaxAge != "" {
+		maxAge, err = time.ParseDuration(config.SessionMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sessionmaxage: %w", err)
+		}
+		if maxAge < ttl {
+			return nil, fmt.Errorf("sessionmaxage cannot be shorter than sessionttl")
+		}
+	} else if config.SessionSliding {
+		maxAge = defaultSessionMaxAge
+		if maxAge < ttl {
+			maxAge = ttl
+		}
+	}
+
+	manager := &sessionManager{
+		key:       key,
+		ttl:       ttl,
+		ipBinding: ipBinding,
+		sliding:   config.SessionSliding,
+		maxAge:    maxAge,
+		cookie: http.Cookie{
+			Name:     cookieName,
+			Domain:   config.SessionCookieDomain,
+			Path:     cookiePath,
+			Secure:   config.SessionCookieSecure,
+			HttpOnly: config.SessionCookieHTTPOnly,
+			SameSite: sameSite,
+		},
+	}
+
+	if config.Attestation != nil {
+		manager.header = config.Attestation.Header
+		if manager.header == "" {
+			manager.header = defaultClearanceHeader
+		}
+	}
+
+	if config.SessionEncrypt {
+		// use a dedicated key so the encryption key never equals the signing key
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("turnstile-session-encryption"))
+		block, err := aes.NewCipher(mac.Sum(nil))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session cipher: %w", err)
+		}
+		manager.aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session cipher: %w", err)
+		}
+	}
+
+	return manager, nil
+}
+
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid sessioncookiesamesite: %s", value)
+	}
+}
+
+// validate returns the claims of the request's session cookie if it is unexpired.
+func (s *sessionManager) validate(req *http.Request) (*sessionClaims, bool) {
+	return s.validateWithin(req, 0)
+}
+
+// isValidWithin reports whether the request carries a session cookie that
+// expired no longer than extension ago.
+func (s *sessionManager) isValidWithin(req *http.Request, extension time.Duration) bool {
+	_, ok := s.validateWithin(req, extension)
+	return ok
+}
+
+func (s *sessionManager) validateWithin(req *http.Request, extension time.Duration) (*sessionClaims, bool) {
+	var value string
+	if cookie, err := req.Cookie(s.cookie.Name); err == nil {
+		value = cookie.Value
+	} else if s.header != "" {
+		value = req.Header.Get(s.header)
+	}
+	if value == "" {
+		return nil, false
+	}
+	claims, err := s.decode(value)
+	if err != nil {
+		return nil, false
+	}
+	if !time.Now().Before(time.Unix(claims.ExpiresAt, 0).Add(extension)) {
+		return nil, false
+	}
+	if claims.IP != s.boundIP(req) {
+		return nil, false
+	}
+	return claims, true
+}
+
+// boundIP returns the value a session issued for req is bound to.
+func (s *sessionManager) boundIP(req *http.Request) string {
+	if s.ipBinding == sessionIPBindingOff {
+		return ""
+	}
+	return s.bindIP(clientIP(req))
+}
+
+// bindIP returns the value a session issued for a client at ip is bound to.
+func (s *sessionManager) bindIP(ip net.IP) string {
+	if s.ipBinding == sessionIPBindingOff || ip == nil {
+		return ""
+	}
+	if s.ipBinding == sessionIPBindingPrefix {
+		ip = ipPrefix(ip)
+	}
+	return ip.String()
+}
+
+// issue sets a fresh session cookie for req on the response.
+func (s *sessionManager) issue(rw http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	s.write(rw, &sessionClaims{
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.ttl).Unix(),
+		IP:        s.boundIP(req),
+	})
+}
+
+// refresh extends a valid session by ttl when sliding expiration is enabled,
+// never beyond maxAge after the session was first issued.
+func (s *sessionManager) refresh(rw http.ResponseWriter, claims *sessionClaims) {
+	if !s.sliding {
+		return
+	}
+	expiresAt := time.Now().Add(s.ttl)
+	if limit := time.Unix(claims.IssuedAt, 0).Add(s.maxAge); expiresAt.After(limit) {
+		expiresAt = limit
+	}
+	if expiresAt.Unix() <= claims.ExpiresAt {
+		return
+	}
+	s.write(rw, &sessionClaims{
+		IssuedAt:  claims.IssuedAt,
+		ExpiresAt: expiresAt.Unix(),
+		IP:        claims.IP,
+	})
+}
+
+func (s *sessionManager) write(rw http.ResponseWriter, claims *sessionClaims) {
+	value, err := s.encode(claims)
+	if err != nil {
+		return
+	}
+	cookie := s.cookie
+	cookie.Value = value
+	cookie.MaxAge = int(time.Until(time.Unix(claims.ExpiresAt, 0)).Seconds())
+	http.SetCookie(rw, &cookie)
+}
+
+func (s *sessionManager) encode(claims *sessionClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	if s.aead != nil {
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, payload, nil)), nil
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.sign(encoded)), nil
+}
+
+func (s *sessionManager) decode(value string) (*sessionClaims, error) {
+	payload, err := s.open(value)
+	if err != nil {
+		return nil, err
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed session cookie")
+	}
+	return &claims, nil
+}
+
+// open returns the authenticated payload of a cookie value.
+func (s *sessionManager) open(value string) ([]byte, error) {
+	if s.aead != nil {
+		sealed, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(sealed) < s.aead.NonceSize() {
+			return nil, errors.New("malformed session cookie")
+		}
+		nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+		payload, err := s.aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return nil, errors.New("invalid session cookie")
+		}
+		return payload, nil
+	}
+
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, errors.New("malformed session cookie")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, s.sign(encoded)) {
+		return nil, errors.New("invalid session signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("malformed session cookie")
+	}
+	return payload, nil
+}
+
+func (s *sessionManager) sign(data string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,186 @@
+package turnstile
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSessions(t *testing.T, configure func(config *Config)) *sessionManager {
+	t.Helper()
+	config := CreateConfig()
+	config.SessionTTL = "10m"
+	config.SessionSecret = "session-test-secret"
+	if configure != nil {
+		configure(config)
+	}
+	sessions, err := newSessionManager(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessions
+}
+
+// sessionRequest returns a request from remoteIP carrying the session cookie value.
+func sessionRequest(sessions *sessionManager, value, remoteIP string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = net.JoinHostPort(remoteIP, "51234")
+	if value != "" {
+		req.AddCookie(&http.Cookie{Name: sessions.cookie.Name, Value: value})
+	}
+	return req
+}
+
+// encodeClaims returns the cookie value of claims, failing the test on error.
+func encodeClaims(t *testing.T, sessions *sessionManager, claims *sessionClaims) string {
+	t.Helper()
+	value, err := sessions.encode(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestSessionTamper(t *testing.T) {
+	signed := newTestSessions(t, nil)
+	encrypted := newTestSessions(t, func(config *Config) { config.SessionEncrypt = true })
+	otherKey := newTestSessions(t, func(config *Config) { config.SessionSecret = "another-session-secret" })
+
+	now := time.Now()
+	claims := &sessionClaims{IssuedAt: now.Unix(), ExpiresAt: now.Add(10 * time.Minute).Unix()}
+	value := encodeClaims(t, signed, claims)
+	encoded, signature, _ := strings.Cut(value, ".")
+	longer, _ := json.Marshal(&sessionClaims{IssuedAt: claims.IssuedAt, ExpiresAt: now.Add(time.Hour).Unix()})
+	sealed := encodeClaims(t, encrypted, claims)
+	flipped := []byte(sealed)
+	flipped[len(flipped)-2] ^= 1
+
+	tests := []struct {
+		name     string
+		sessions *sessionManager
+		value    string
+		want     bool
+	}{
+		{"signed", signed, value, true},
+		{"extended expiry under the old signature", signed, base64.RawURLEncoding.EncodeToString(longer) + "." + signature, false},
+		{"signature of other claims", signed, encoded + "." + strings.Repeat("A", len(signature)), false},
+		{"missing signature", signed, encoded, false},
+		{"signed with another key", otherKey, value, false},
+		{"garbage", signed, "not-a-session", false},
+		{"encrypted", encrypted, sealed, true},
+		{"flipped ciphertext bit", encrypted, string(flipped), false},
+		{"signed cookie in encrypted mode", encrypted, value, false},
+		{"truncated ciphertext", encrypted, sealed[:8], false},
+	}
+	for _, tt := range tests {
+		_, ok := tt.sessions.validate(sessionRequest(tt.sessions, tt.value, "192.0.2.10"))
+		if ok != tt.want {
+			t.Errorf("%s: valid = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	sessions := newTestSessions(t, nil)
+	now := time.Now()
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		extension time.Duration
+		want      bool
+	}{
+		{"unexpired", now.Add(time.Minute), 0, true},
+		{"expired", now.Add(-time.Second), 0, false},
+		{"expired within the grace extension", now.Add(-time.Minute), 5 * time.Minute, true},
+		{"expired before the grace extension", now.Add(-10 * time.Minute), 5 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		value := encodeClaims(t, sessions, &sessionClaims{IssuedAt: now.Add(-time.Hour).Unix(), ExpiresAt: tt.expiresAt.Unix()})
+		if ok := sessions.isValidWithin(sessionRequest(sessions, value, "192.0.2.10"), tt.extension); ok != tt.want {
+			t.Errorf("%s: valid = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestSessionIPBinding(t *testing.T) {
+	tests := []struct {
+		binding, issuedTo, presentedFrom string
+		want                             bool
+	}{
+		{"off", "192.0.2.10", "198.51.100.7", true},
+		{"strict", "192.0.2.10", "192.0.2.10", true},
+		{"strict", "192.0.2.10", "192.0.2.11", false},
+		{"prefix", "192.0.2.10", "192.0.2.200", true},
+		{"prefix", "192.0.2.10", "192.0.3.10", false},
+		{"prefix", "2001:db8:1:2::10", "2001:db8:1:2:ffff::1", true},
+		{"prefix", "2001:db8:1:2::10", "2001:db8:1:3::10", false},
+	}
+	for _, tt := range tests {
+		sessions := newTestSessions(t, func(config *Config) { config.SessionIPBinding = tt.binding })
+		rw := httptest.NewRecorder()
+		sessions.issue(rw, sessionRequest(sessions, "", tt.issuedTo))
+		cookies := rw.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("%s: issue set %d cookies", tt.binding, len(cookies))
+		}
+		_, ok := sessions.validate(sessionRequest(sessions, cookies[0].Value, tt.presentedFrom))
+		if ok != tt.want {
+			t.Errorf("%s binding, issued to %s, presented from %s: valid = %v, want %v", tt.binding, tt.issuedTo, tt.presentedFrom, ok, tt.want)
+		}
+	}
+}
+
+func TestSessionSlidingCap(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		sliding  bool
+		issuedAt time.Time
+		// expiresAt of the refreshed cookie, zero when no cookie is set
+		want time.Time
+	}{
+		{"fixed expiry", false, now.Add(-5 * time.Minute), time.Time{}},
+		{"slides by the ttl", true, now.Add(-5 * time.Minute), now.Add(10 * time.Minute)},
+		{"capped at the max age", true, now.Add(-55 * time.Minute), now.Add(-55 * time.Minute).Add(time.Hour)},
+		{"max age reached", true, now.Add(-time.Hour), time.Time{}},
+	}
+	for _, tt := range tests {
+		sessions := newTestSessions(t, func(config *Config) {
+			config.SessionSliding = tt.sliding
+			config.SessionMaxAge = "1h"
+		})
+		claims := &sessionClaims{IssuedAt: tt.issuedAt.Unix(), ExpiresAt: now.Add(time.Minute).Unix()}
+		if limit := tt.issuedAt.Add(time.Hour); limit.Before(now.Add(time.Minute)) {
+			claims.ExpiresAt = limit.Unix()
+		}
+		rw := httptest.NewRecorder()
+		sessions.refresh(rw, claims)
+		cookies := rw.Result().Cookies()
+		if tt.want.IsZero() {
+			if len(cookies) != 0 {
+				t.Errorf("%s: refresh set a cookie", tt.name)
+			}
+			continue
+		}
+		if len(cookies) != 1 {
+			t.Errorf("%s: refresh set %d cookies", tt.name, len(cookies))
+			continue
+		}
+		refreshed, err := sessions.decode(cookies[0].Value)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// the expiry is truncated to seconds
+		if diff := refreshed.ExpiresAt - tt.want.Unix(); diff < -1 || diff > 1 {
+			t.Errorf("%s: expires at %v, want %v", tt.name, time.Unix(refreshed.ExpiresAt, 0), tt.want)
+		}
+		if refreshed.IssuedAt != claims.IssuedAt {
+			t.Errorf("%s: refresh moved the issue time", tt.name)
+		}
+	}
+}
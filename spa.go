@@ -0,0 +1,87 @@
+package turnstile
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// retryRefreshToken tells single-page apps to run the widget again and retry.
+const retryRefreshToken = "refresh-token"
+
+// spaRejection is the body of rejections answered with the SPA contract.
+type spaRejection struct {
+	Error  string `json:"error"`
+	Reason Reason `json:"reason"`
+	// Retry is the hint how the request can succeed
+	Retry      string   `json:"retry"`
+	SiteKey    string   `json:"sitekey"`
+	ErrorCodes []string `json:"error_codes,omitempty"`
+	RequestID  string   `json:"request_id,omitempty"`
+}
+
+// spaContract answers token rejections of programmatic requests with a
+// machine-readable body, so single-page apps can re-run the widget and retry.
+type spaContract struct {
+	siteKey string
+}
+
+// newSPAContract returns nil when the contract is not enabled.
+func newSPAContract(config *Config) (*spaContract, error) {
+	if !config.SPAContract {
+		return nil, nil
+	}
+	if config.SiteKey == "" {
+		return nil, errors.New("spacontract requires sitekey")
+	}
+	return &spaContract{siteKey: config.SiteKey}, nil
+}
+
+// adjust switches d to the contract when req is programmatic and a new token
+// would help: 401 without a token, 403 for a rejected one.
+func (s *spaContract) adjust(req *http.Request, d *decision) {
+	if s == nil || d.Allowed || d.Interstitial || d.Redirect || !isProgrammaticRequest(req) {
+		return
+	}
+	switch d.Reason {
+	case ReasonMissingToken, ReasonEmptyToken:
+		d.Status = http.StatusUnauthorized
+	case ReasonVerificationFailed:
+		d.Status = http.StatusForbidden
+	default:
+		return
+	}
+	d.SPA = true
+}
+
+// isProgrammaticRequest reports whether req was sent by a script rather than
+// a browser navigation: it accepts JSON or carries X-Requested-With.
+func isProgrammaticRequest(req *http.Request) bool {
+	if req.Header.Get("X-Requested-With") != "" {
+		return true
+	}
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accepted); err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *spaContract) write(rw http.ResponseWriter, req *http.Request, d *decision) {
+	if d.Status == http.StatusUnauthorized {
+		rw.Header().Set("WWW-Authenticate", `Turnstile sitekey="`+s.siteKey+`"`)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(d.Status)
+	_ = json.NewEncoder(rw).Encode(spaRejection{
+		Error:      d.Message,
+		Reason:     d.Reason,
+		Retry:      retryRefreshToken,
+		SiteKey:    s.siteKey,
+		ErrorCodes: d.ErrorCodes,
+		RequestID:  requestIDFromContext(req.Context()),
+	})
+}
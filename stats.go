@@ -0,0 +1,70 @@
+package turnstile
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsMinutes is how many minutes of decisions the admin API reports.
+const statsMinutes = 15
+
+// decisionStats counts recent decisions per reason in one-minute buckets.
+type decisionStats struct {
+	buckets [statsMinutes]statsBucket
+	// rotate serializes resetting a bucket when a new minute starts
+	rotate sync.Mutex
+}
+
+type statsBucket struct {
+	// minute is the Unix minute the counts belong to
+	minute atomic.Int64
+	counts []atomic.Uint64
+}
+
+func newDecisionStats() *decisionStats {
+	s := &decisionStats{}
+	for i := range s.buckets {
+		s.buckets[i].counts = make([]atomic.Uint64, len(reasons))
+	}
+	return s
+}
+
+// record counts a decision in the bucket of the current minute.
+func (s *decisionStats) record(reason Reason, now time.Time) {
+	i := reasonIndex(reason)
+	if i < 0 {
+		return
+	}
+	minute := now.Unix() / 60
+	b := &s.buckets[minute%statsMinutes]
+	if b.minute.Load() != minute {
+		s.rotate.Lock()
+		if b.minute.Load() != minute {
+			for j := range b.counts {
+				b.counts[j].Store(0)
+			}
+			b.minute.Store(minute)
+		}
+		s.rotate.Unlock()
+	}
+	b.counts[i].Add(1)
+}
+
+// since returns the decisions per reason within the last minutes, the current minute included.
+func (s *decisionStats) since(minutes int, now time.Time) map[Reason]uint64 {
+	current := now.Unix() / 60
+	counts := make(map[Reason]uint64, len(reasons))
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		if age := current - b.minute.Load(); age < 0 || age >= int64(minutes) {
+			continue
+		}
+		for j := range b.counts {
+			if n := b.counts[j].Load(); n > 0 {
+				counts[reasons[j]] += n
+			}
+		}
+	}
+	return counts
+}
@@ -0,0 +1,162 @@
+package turnstile
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStatsDPrefix  = "turnstile."
+	statsDFlushInterval  = time.Second
+	statsDMaxPacketBytes = 1432
+)
+
+// StatsD formats
+const (
+	statsDFormatPlain   = "statsd"
+	statsDFormatDatadog = "datadog"
+)
+
+// statsDSink emits per-route verification metrics to a StatsD or DogStatsD
+// agent. Lines are buffered and sent in packets of at most one MTU, so
+// requests never wait for the network.
+type statsDSink struct {
+	conn   net.Conn
+	prefix string
+	// datadog selects DogStatsD tags over route names embedded in metric names
+	datadog bool
+	// tags are appended to every DogStatsD line, e.g. ",env:prod"
+	tags string
+
+	mu     sync.Mutex
+	buffer []byte
+}
+
+// newStatsDSink returns nil when no StatsD address is configured.
+func newStatsDSink(config *Config) (*statsDSink, error) {
+	if config.StatsDAddress == "" {
+		return nil, nil
+	}
+	s := &statsDSink{prefix: config.StatsDPrefix}
+	if s.prefix == "" {
+		s.prefix = defaultStatsDPrefix
+	}
+	switch strings.ToLower(config.StatsDFormat) {
+	case "", statsDFormatPlain:
+		if len(config.StatsDTags) > 0 {
+			return nil, fmt.Errorf("statsdtags require statsdformat datadog")
+		}
+	case statsDFormatDatadog:
+		s.datadog = true
+		keys := make([]string, 0, len(config.StatsDTags))
+		for key := range config.StatsDTags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s.tags += "," + key + ":" + datadogTagValue(config.StatsDTags[key])
+		}
+	default:
+		return nil, fmt.Errorf("invalid statsdformat: %s", config.StatsDFormat)
+	}
+	conn, err := net.Dial("udp", config.StatsDAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid statsdaddress: %w", err)
+	}
+	s.conn = conn
+	return s, nil
+}
+
+// observeVerification emits the outcome and latency of a siteverify call.
+func (s *statsDSink) observeVerification(router *Router, resp *VerifyResponse, err error, duration time.Duration) {
+	if s == nil {
+		return
+	}
+	result := "success"
+	switch {
+	case err != nil:
+		result = "error"
+	case !resp.Success:
+		result = "failure"
+	}
+	s.emit(router, "verifications", "result", result, "1|c")
+	s.emit(router, "siteverify.latency", "", "", strconv.FormatFloat(float64(duration.Microseconds())/1000, 'f', 3, 64)+"|ms")
+}
+
+// observeDecision emits the decision and the time taken to make it.
+func (s *statsDSink) observeDecision(router *Router, d *decision) {
+	if s == nil {
+		return
+	}
+	s.emit(router, "decisions", "reason", string(d.Reason), "1|c")
+	s.emit(router, "decision.latency", "", "", strconv.FormatFloat(float64(d.Duration.Microseconds())/1000, 'f', 3, 64)+"|ms")
+}
+
+// emit buffers one line, e.g. "turnstile.verifications:1|c|#route:POST /login,result:success".
+// Without DogStatsD tags, the route and the tag value become part of the metric name.
+func (s *statsDSink) emit(router *Router, name, tag, value, sample string) {
+	var line string
+	if s.datadog {
+		line = s.prefix + name + ":" + sample + "|#route:" + datadogTagValue(router.label())
+		if tag != "" {
+			line += "," + tag + ":" + datadogTagValue(value)
+		}
+		line += s.tags
+	} else {
+		line = s.prefix + "route." + statsDName(router.label()) + "." + name
+		if tag != "" {
+			line += "." + statsDName(value)
+		}
+		line += ":" + sample
+	}
+
+	s.mu.Lock()
+	var packet []byte
+	if len(s.buffer) > 0 && len(s.buffer)+1+len(line) > statsDMaxPacketBytes {
+		packet, s.buffer = s.buffer, nil
+	}
+	if len(s.buffer) > 0 {
+		s.buffer = append(s.buffer, '\n')
+	}
+	s.buffer = append(s.buffer, line...)
+	s.mu.Unlock()
+
+	if packet != nil {
+		background.submit("statsd-send", func() { s.send(packet) })
+	}
+}
+
+// flush sends the buffered lines.
+func (s *statsDSink) flush() {
+	s.mu.Lock()
+	packet := s.buffer
+	s.buffer = nil
+	s.mu.Unlock()
+	if len(packet) > 0 {
+		s.send(packet)
+	}
+}
+
+func (s *statsDSink) send(packet []byte) {
+	if _, err := s.conn.Write(packet); err != nil {
+		logger().Warn("failed to send StatsD metrics", "error", err)
+	}
+}
+
+var statsDNameReplacer = strings.NewReplacer(" ", "_", "/", "_", ".", "_", ":", "_", "|", "_", "@", "_", "#", "_", "*", "any", "{", "", "}", "")
+
+// statsDName turns a route label into a metric name segment, e.g. "POST /login" into "POST__login".
+func statsDName(value string) string {
+	return statsDNameReplacer.Replace(value)
+}
+
+var datadogTagReplacer = strings.NewReplacer(",", "_", "|", "_", "\n", "_")
+
+func datadogTagValue(value string) string {
+	return datadogTagReplacer.Replace(value)
+}
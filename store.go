@@ -0,0 +1,85 @@
+package turnstile
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// counterStore keeps per-client request counters for abuse tracking.
+type counterStore interface {
+	// increment counts one event for key and returns the number of events
+	// within the sliding window ending now
+	increment(key string, window time.Duration) int64
+	// flush drops every counter
+	flush()
+}
+
+const storeJanitorInterval = time.Minute
+
+// memoryStore is an in-process counterStore approximating sliding windows
+// with the weighted counts of the current and previous fixed window.
+type memoryStore struct {
+	mu       sync.Mutex
+	counters map[string]*windowCounter
+}
+
+type windowCounter struct {
+	window   time.Duration
+	start    time.Time
+	current  int64
+	previous int64
+}
+
+func newMemoryStore(ctx context.Context) *memoryStore {
+	s := &memoryStore{counters: map[string]*windowCounter{}}
+	background.schedule(ctx, "store-janitor", storeJanitorInterval, s.expire)
+	return s
+}
+
+func (s *memoryStore) increment(key string, window time.Duration) int64 {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok || c.window != window {
+		c = &windowCounter{window: window, start: now.Truncate(window)}
+		s.counters[key] = c
+	}
+	c.advance(now)
+	c.current++
+
+	elapsed := float64(now.Sub(c.start)) / float64(window)
+	return c.current + int64(float64(c.previous)*(1-elapsed))
+}
+
+// advance moves the counter to the fixed window containing now.
+func (c *windowCounter) advance(now time.Time) {
+	start := now.Truncate(c.window)
+	switch {
+	case start.Equal(c.start):
+	case start.Sub(c.start) == c.window:
+		c.previous, c.current, c.start = c.current, 0, start
+	default:
+		c.previous, c.current, c.start = 0, 0, start
+	}
+}
+
+func (s *memoryStore) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters = map[string]*windowCounter{}
+}
+
+// expire drops counters that have not been touched for two windows.
+func (s *memoryStore) expire() {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, c := range s.counters {
+		if now.Sub(c.start) >= 2*c.window {
+			delete(s.counters, key)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package turnstile
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultTarpitAfter    = 3
+	defaultTarpitDelay    = time.Second
+	defaultTarpitMaxDelay = 10 * time.Second
+	defaultTarpitWindow   = 10 * time.Minute
+	// tarpitJitter is the fraction a delay randomly varies by, so clients cannot time it
+	tarpitJitter = 0.25
+)
+
+// TarpitConfig delays the rejections of clients repeatedly failing
+// verification, raising the cost of guessing tokens.
+type TarpitConfig struct {
+	// After is the number of failed verifications of a client IP within window before rejections are delayed,
+	// if not provided, 3 will be used
+	After int64 `yaml:"after"`
+	// Delay is the delay of the first delayed rejection, doubled with every further failure, if not provided, 1s will be used
+	Delay string `yaml:"delay"`
+	// MaxDelay caps the delay, if not provided, 10s will be used
+	MaxDelay string `yaml:"maxdelay"`
+	// Window is the sliding window failures are counted in, if not provided, 10m will be used
+	Window string `yaml:"window"`
+}
+
+type tarpit struct {
+	after    int64
+	delay    time.Duration
+	maxDelay time.Duration
+	window   time.Duration
+}
+
+// newTarpit returns nil when the tarpit is not configured.
+func newTarpit(config *Config) (*tarpit, error) {
+	if config.Tarpit == nil {
+		return nil, nil
+	}
+	t := &tarpit{
+		after:    config.Tarpit.After,
+		delay:    defaultTarpitDelay,
+		maxDelay: defaultTarpitMaxDelay,
+		window:   defaultTarpitWindow,
+	}
+	switch {
+	case t.after == 0:
+		t.after = defaultTarpitAfter
+	case t.after < 0:
+		return nil, errors.New("tarpit.after cannot be negative")
+	}
+	var problems configErrors
+	for _, option := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"delay", config.Tarpit.Delay, &t.delay},
+		{"maxdelay", config.Tarpit.MaxDelay, &t.maxDelay},
+		{"window", config.Tarpit.Window, &t.window},
+	} {
+		if option.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(option.value)
+		if err != nil || duration <= 0 {
+			problems.add(fmt.Errorf("invalid tarpit.%s: %s", option.name, option.value))
+			continue
+		}
+		*option.dst = duration
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	if t.maxDelay < t.delay {
+		return nil, errors.New("tarpit.maxdelay cannot be shorter than tarpit.delay")
+	}
+	return t, nil
+}
+
+// observeFailure counts a failed verification of the client of req and
+// returns the delay of its rejection, 0 while it is below the threshold.
+func (a *turnstile) observeFailure(req *http.Request) time.Duration {
+	t := a.tarpit
+	if t == nil {
+		return 0
+	}
+	ip := clientIP(req)
+	if ip == nil {
+		return 0
+	}
+	failures := a.store.increment("tarpit|"+ip.String(), t.window)
+	if failures <= t.after {
+		return 0
+	}
+	delay := t.delay
+	for i := t.after + 1; i < failures && delay < t.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.maxDelay {
+		delay = t.maxDelay
+	}
+	return time.Duration(float64(delay) * (1 + tarpitJitter*(2*rand.Float64()-1)))
+}
+
+// wait holds the response of req for delay, or until the client goes away.
+func (t *tarpit) wait(req *http.Request, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+}
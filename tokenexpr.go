@@ -0,0 +1,294 @@
+package turnstile
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A token expression computes the token from the request when none of the
+// built-in sources fits, e.g.
+//
+//	after(header("X-Captcha"), "v1:") ?? json("/meta/captcha") ?? cookie("cf_token")
+//
+// Operands are calls and string literals, and "a ?? b" evaluates to b when a
+// evaluates to the empty string.
+
+// exprFunc is a function callable from a token expression.
+type exprFunc struct {
+	arity int
+	call  func(req *http.Request, router *Router, args []string) (string, error)
+}
+
+// exprFuncs are the functions of token expressions. Request accessors return
+// the empty string for absent values, string functions return it when their
+// separator is not found, so a value of the wrong shape is never taken as a token.
+var exprFuncs = map[string]exprFunc{
+	"header": {1, func(req *http.Request, _ *Router, args []string) (string, error) {
+		return req.Header.Get(args[0]), nil
+	}},
+	"query": {1, func(req *http.Request, _ *Router, args []string) (string, error) {
+		return req.URL.Query().Get(args[0]), nil
+	}},
+	"cookie": {1, func(req *http.Request, _ *Router, args []string) (string, error) {
+		cookie, err := req.Cookie(args[0])
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	}},
+	"form": {1, exprForm},
+	"json": {1, exprJSON},
+	"trim": {1, func(_ *http.Request, _ *Router, args []string) (string, error) {
+		return strings.TrimSpace(args[0]), nil
+	}},
+	"after": {2, func(_ *http.Request, _ *Router, args []string) (string, error) {
+		_, after, found := strings.Cut(args[0], args[1])
+		if !found {
+			return "", nil
+		}
+		return after, nil
+	}},
+	"before": {2, func(_ *http.Request, _ *Router, args []string) (string, error) {
+		before, _, found := strings.Cut(args[0], args[1])
+		if !found {
+			return "", nil
+		}
+		return before, nil
+	}},
+	"split": {3, func(_ *http.Request, _ *Router, args []string) (string, error) {
+		index, err := strconv.Atoi(args[2])
+		if err != nil || index < 0 {
+			return "", nil
+		}
+		fields := strings.Split(args[0], args[1])
+		if index >= len(fields) {
+			return "", nil
+		}
+		return fields[index], nil
+	}},
+}
+
+// exprForm reads a field of the urlencoded or multipart form, restoring the body.
+func exprForm(req *http.Request, router *Router, args []string) (string, error) {
+	form, err := readPostForm(req, router.multipartMemory, router.maxFormBytes)
+	if err != nil {
+		return "", err
+	}
+	return form.Get(args[0]), nil
+}
+
+// exprJSON reads the string at a JSON pointer of a JSON body, restoring the body.
+func exprJSON(req *http.Request, _ *Router, args []string) (string, error) {
+	pointer, err := parseJSONPointer(args[0])
+	if err != nil || pointer == nil {
+		return "", nil
+	}
+	if req.Body == nil || req.Body == http.NoBody || !isJSON(req) {
+		return "", nil
+	}
+	body, err := peekBody(req, maxJSONBodyBytes)
+	if err != nil {
+		return "", err
+	}
+	if !json.Valid(body) {
+		return "", ErrFormInvalid
+	}
+	raw := json.RawMessage(body)
+	for _, name := range pointer {
+		var ok bool
+		if raw, ok = jsonChild(raw, name); !ok {
+			return "", nil
+		}
+	}
+	var value string
+	if json.Unmarshal(raw, &value) != nil {
+		return "", nil
+	}
+	return value, nil
+}
+
+// exprNode is a compiled token expression.
+type exprNode interface {
+	eval(req *http.Request, router *Router) (string, error)
+}
+
+type exprLiteral string
+
+func (l exprLiteral) eval(*http.Request, *Router) (string, error) {
+	return string(l), nil
+}
+
+type exprCall struct {
+	fn   exprFunc
+	args []exprNode
+}
+
+func (c *exprCall) eval(req *http.Request, router *Router) (string, error) {
+	args := make([]string, len(c.args))
+	for i, arg := range c.args {
+		value, err := arg.eval(req, router)
+		if err != nil {
+			return "", err
+		}
+		args[i] = value
+	}
+	return c.fn.call(req, router, args)
+}
+
+// exprCoalesce evaluates to its first non-empty operand.
+type exprCoalesce []exprNode
+
+func (c exprCoalesce) eval(req *http.Request, router *Router) (string, error) {
+	for _, operand := range c {
+		value, err := operand.eval(req, router)
+		if err != nil || value != "" {
+			return value, err
+		}
+	}
+	return "", nil
+}
+
+// tokenExpression extracts the token of a router with tokenexpr.
+type tokenExpression struct {
+	root exprNode
+	// readsBody is set when the expression calls form or json
+	readsBody bool
+}
+
+// compileTokenExpr returns nil when expr is empty.
+func compileTokenExpr(expr string) (*tokenExpression, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	p := &exprParser{input: expr}
+	root, err := p.parseCoalesce()
+	if err == nil && p.skipSpace() < len(p.input) {
+		err = p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid tokenexpr: %w", err)
+	}
+	return &tokenExpression{root: root, readsBody: p.readsBody}, nil
+}
+
+// token evaluates the expression, an empty result is a missing token.
+func (e *tokenExpression) token(req *http.Request, router *Router) Extraction {
+	token, err := e.root.eval(req, router)
+	if err != nil {
+		return failed(SourceExpression, err)
+	}
+	return extracted(SourceExpression, strings.TrimSpace(token))
+}
+
+// exprParser is a recursive descent parser of token expressions.
+type exprParser struct {
+	input     string
+	pos       int
+	readsBody bool
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at offset %d", fmt.Sprintf(format, args...), p.pos)
+}
+
+// skipSpace advances past white space and returns the new position.
+func (p *exprParser) skipSpace() int {
+	for p.pos < len(p.input) && strings.ContainsRune(" \t\r\n", rune(p.input[p.pos])) {
+		p.pos++
+	}
+	return p.pos
+}
+
+// consume advances past token when the input continues with it.
+func (p *exprParser) consume(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseCoalesce() (exprNode, error) {
+	var operands exprCoalesce
+	for {
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		if !p.consume("??") {
+			break
+		}
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return operands, nil
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	if p.skipSpace() == len(p.input) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	c := p.input[p.pos]
+	switch {
+	case c == '"' || c == '`':
+		quoted, err := strconv.QuotedPrefix(p.input[p.pos:])
+		if err != nil {
+			return nil, p.errorf("unterminated string")
+		}
+		p.pos += len(quoted)
+		value, _ := strconv.Unquote(quoted)
+		return exprLiteral(value), nil
+	case c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.input) && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+			p.pos++
+		}
+		return exprLiteral(p.input[start:p.pos]), nil
+	case c >= 'a' && c <= 'z':
+		start := p.pos
+		for p.pos < len(p.input) && p.input[p.pos] >= 'a' && p.input[p.pos] <= 'z' {
+			p.pos++
+		}
+		return p.parseCall(p.input[start:p.pos])
+	}
+	return nil, p.errorf("unexpected %q", string(c))
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	fn, ok := exprFuncs[name]
+	if !ok {
+		return nil, p.errorf("unknown function %s", name)
+	}
+	if name == "form" || name == "json" {
+		p.readsBody = true
+	}
+	if !p.consume("(") {
+		return nil, p.errorf("expected ( after %s", name)
+	}
+	call := &exprCall{fn: fn}
+	if !p.consume(")") {
+		for {
+			arg, err := p.parseCoalesce()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if p.consume(")") {
+				break
+			}
+			if !p.consume(",") {
+				return nil, p.errorf("expected , or ) in call of %s", name)
+			}
+		}
+	}
+	if len(call.args) != fn.arity {
+		return nil, fmt.Errorf("%s takes %d arguments", name, fn.arity)
+	}
+	return call, nil
+}
@@ -0,0 +1,150 @@
+package turnstile
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompileTokenExprErrors(t *testing.T) {
+	tests := []struct {
+		expr, err string
+	}{
+		{`header("X-Token"`, "expected , or ) in call of header"},
+		{`header "X-Token"`, "expected ( after header"},
+		{`lookup("X-Token")`, "unknown function lookup"},
+		{`header("X-Token", "extra")`, "header takes 1 arguments"},
+		{`after(header("X-Token"))`, "after takes 2 arguments"},
+		{`header("X-Token`, "unterminated string"},
+		{`header("X-Token") ??`, "unexpected end of expression"},
+		{`?? header("X-Token")`, `unexpected "?"`},
+		{`header("X-Token") cookie("c")`, `unexpected "cookie(\"c\")"`},
+		{`Header("X-Token")`, `unexpected "H"`},
+	}
+	for _, tt := range tests {
+		_, err := compileTokenExpr(tt.expr)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want it to contain %q", tt.expr, err, tt.err)
+		}
+	}
+	if e, err := compileTokenExpr(""); e != nil || err != nil {
+		t.Errorf("empty expression: got %v, %v, want nil, nil", e, err)
+	}
+}
+
+func TestTokenExprEval(t *testing.T) {
+	tests := []struct {
+		name, expr string
+		prepare    func(req *http.Request)
+		body       string
+		want       string
+		err        error
+		readsBody  bool
+	}{
+		{
+			name: "header",
+			expr: `header("X-Captcha")`,
+			prepare: func(req *http.Request) {
+				req.Header.Set("X-Captcha", "token")
+			},
+			want: "token",
+		},
+		{
+			name: "fallback past an absent header",
+			expr: `header("X-Captcha") ?? cookie("cf_token") ?? query("t")`,
+			prepare: func(req *http.Request) {
+				req.AddCookie(&http.Cookie{Name: "cf_token", Value: "from-cookie"})
+			},
+			want: "from-cookie",
+		},
+		{
+			name: "first non-empty operand wins",
+			expr: `query("a") ?? query("b") ?? query("c")`,
+			prepare: func(req *http.Request) {
+				req.URL.RawQuery = "a=&b=second&c=third"
+			},
+			want: "second",
+		},
+		{
+			name: "fallback past a missing separator",
+			expr: "after(header(`X-Captcha`), \"v1:\") ?? `literal`",
+			prepare: func(req *http.Request) {
+				req.Header.Set("X-Captcha", "v2:token")
+			},
+			want: "literal",
+		},
+		{
+			name: "nested string functions",
+			expr: `trim(split(before(header("X-Captcha"), ";"), ",", 1))`,
+			prepare: func(req *http.Request) {
+				req.Header.Set("X-Captcha", "a, token ,c;rest")
+			},
+			want: "token",
+		},
+		{
+			name: "out of range field",
+			expr: `split(header("X-Captcha"), ",", 5)`,
+			prepare: func(req *http.Request) {
+				req.Header.Set("X-Captcha", "a,b")
+			},
+			err: ErrTokenMissing,
+		},
+		{
+			name:      "json pointer",
+			expr:      `header("X-Captcha") ?? json("/meta/captcha")`,
+			body:      `{"meta":{"captcha":"from-json"}}`,
+			want:      "from-json",
+			readsBody: true,
+		},
+		{
+			name:      "malformed json stops the fallback",
+			expr:      `json("/meta/captcha") ?? "literal"`,
+			body:      `{"meta":`,
+			err:       ErrFormInvalid,
+			readsBody: true,
+		},
+		{
+			name:      "form field",
+			expr:      `form("cf-turnstile-response")`,
+			body:      "cf-turnstile-response=from-form",
+			want:      "from-form",
+			readsBody: true,
+		},
+		{
+			name: "nothing found",
+			expr: `header("X-Captcha") ?? cookie("cf_token")`,
+			err:  ErrTokenMissing,
+		},
+	}
+	for _, tt := range tests {
+		e, err := compileTokenExpr(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if e.readsBody != tt.readsBody {
+			t.Errorf("%s: readsBody = %v, want %v", tt.name, e.readsBody, tt.readsBody)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(tt.body))
+		switch {
+		case strings.HasPrefix(tt.body, "{"):
+			req.Header.Set("Content-Type", "application/json")
+		case tt.body != "":
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if tt.prepare != nil {
+			tt.prepare(req)
+		}
+		router := &Router{multipartMemory: defaultMultipartMemory, maxFormBytes: defaultMaxFormBytes}
+		extraction := e.token(req, router)
+		if extraction.Source != SourceExpression || extraction.Token != tt.want || extraction.Err != tt.err {
+			t.Errorf("%s: got %+v, want token %q, error %v", tt.name, extraction, tt.want, tt.err)
+		}
+		// the body reaches the backend as sent
+		if body, _ := io.ReadAll(req.Body); string(body) != tt.body {
+			t.Errorf("%s: body = %q, want %q", tt.name, body, tt.body)
+		}
+	}
+}
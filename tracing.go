@@ -0,0 +1,233 @@
+package turnstile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// span kinds of the OTLP trace data model
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+)
+
+// span status codes of the OTLP trace data model
+const statusCodeError = 2
+
+// OTLP/HTTP JSON encoding of the traces data model.
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+// span is an in-flight span, exported when it ends. A nil span records nothing.
+type span struct {
+	tracer *tracer
+	data   otlpSpan
+	start  time.Time
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the span carried by ctx, or nil.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// child starts a span below s.
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.newSpan(name, kind, s.data.TraceID, s.data.SpanID)
+}
+
+func (s *span) setAttributes(attributes ...otlpKeyValue) {
+	if s != nil {
+		s.data.Attributes = append(s.data.Attributes, attributes...)
+	}
+}
+
+func (s *span) setError(message string) {
+	if s != nil {
+		s.data.Status = otlpStatus{Code: statusCodeError, Message: message}
+	}
+}
+
+// traceParent returns the W3C traceparent header making s the parent of downstream spans.
+func (s *span) traceParent() string {
+	return "00-" + s.data.TraceID + "-" + s.data.SpanID + "-01"
+}
+
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.data.StartTimeUnixNano = strconv.FormatInt(s.start.UnixNano(), 10)
+	s.data.EndTimeUnixNano = strconv.FormatInt(time.Now().UnixNano(), 10)
+	s.tracer.queue(s.data)
+}
+
+// tracer records spans of the verification path and ships them in batches
+// to an OTLP/HTTP traces endpoint.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	resource []otlpKeyValue
+	client   *http.Client
+	// sampleRatio is the share of requests without a sampled trace context that start a new trace
+	sampleRatio float64
+
+	mu      sync.Mutex
+	pending []otlpSpan
+}
+
+// newTracer returns nil when no traces endpoint is configured.
+func newTracer(ctx context.Context, config *Config, name string) *tracer {
+	if config.OTLPTracesEndpoint == "" {
+		return nil
+	}
+	t := &tracer{
+		endpoint:    config.OTLPTracesEndpoint,
+		headers:     config.OTLPHeaders,
+		resource:    otlpResourceAttributes(config, name),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		sampleRatio: config.OTLPTracesSampleRatio,
+	}
+	background.schedule(ctx, "otlp-traces-flush", otlpFlushInterval, t.flush)
+	return t
+}
+
+// start starts the span of a protected request. The span continues the
+// sampled trace context of the request, requests without one start a new
+// trace with the configured sample ratio. It returns nil for requests that
+// are not traced.
+func (t *tracer) start(req *http.Request, router *Router) *span {
+	if t == nil {
+		return nil
+	}
+	traceID, parentID := parseTraceParent(req.Header.Get("traceparent"))
+	switch {
+	case traceID != "" && !traceSampled(req.Header.Get("traceparent")):
+		return nil
+	case traceID == "":
+		if t.sampleRatio <= 0 || randomRatio() >= t.sampleRatio {
+			return nil
+		}
+		traceID = randomHex(16)
+	}
+	s := t.newSpan("turnstile "+router.label(), spanKindInternal, traceID, parentID)
+	s.setAttributes(
+		otlpString("turnstile.route", router.label()),
+		otlpString("http.request.method", req.Method),
+		otlpString("url.path", req.URL.Path),
+	)
+	return s
+}
+
+func (t *tracer) newSpan(name string, kind int, traceID, parentID string) *span {
+	return &span{
+		tracer: t,
+		start:  time.Now(),
+		data:   otlpSpan{TraceID: traceID, SpanID: randomHex(8), ParentSpanID: parentID, Name: name, Kind: kind},
+	}
+}
+
+func (t *tracer) queue(data otlpSpan) {
+	t.mu.Lock()
+	if len(t.pending) >= otlpMaxPending {
+		t.pending = t.pending[1:]
+	}
+	t.pending = append(t.pending, data)
+	full := len(t.pending) >= otlpBatchSize
+	t.mu.Unlock()
+
+	if full {
+		background.submit("otlp-traces-flush", t.flush)
+	}
+}
+
+// flush sends all pending spans in a single request.
+func (t *tracer) flush() {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: t.resource},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: otlpScopeName},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		logger().Error("failed to encode OTLP traces", "error", err)
+		return
+	}
+	postOTLP(t.client, t.endpoint, t.headers, payload, "traces")
+}
+
+// traceSampled reports whether the sampled flag of a W3C traceparent header is set.
+func traceSampled(value string) bool {
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 {
+		return false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	return err == nil && flags&1 == 1
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// randomRatio returns a uniformly distributed value in [0, 1).
+func randomRatio() float64 {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	var v uint64
+	for _, x := range b {
+		v = v<<8 | uint64(x)
+	}
+	return float64(v>>11) / float64(uint64(1)<<53)
+}
@@ -0,0 +1,228 @@
+package turnstile
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseTransformer modifies the response to a request that passed
+// verification. Wrap returns the writer handed to the next handler and a
+// finish function called once the next handler has returned.
+type ResponseTransformer interface {
+	Wrap(rw http.ResponseWriter, req *http.Request) (http.ResponseWriter, func())
+}
+
+// ResponseTransformerFactory creates a transformer from its router options.
+type ResponseTransformerFactory func(options map[string]string) (ResponseTransformer, error)
+
+var (
+	transformersMu sync.RWMutex
+	transformers   = map[string]ResponseTransformerFactory{
+		"setheader":  newSetHeaderTransformer,
+		"setcookie":  newSetCookieTransformer,
+		"htmlinject": newHTMLInjectTransformer,
+	}
+)
+
+// RegisterResponseTransformer makes a transformer available to routers under name,
+// registering an existing name replaces it.
+func RegisterResponseTransformer(name string, factory ResponseTransformerFactory) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	transformers[strings.ToLower(name)] = factory
+}
+
+// TransformerConfig configures a response transformer of a router.
+type TransformerConfig struct {
+	Name    string            `yaml:"name"`
+	Options map[string]string `yaml:"options"`
+}
+
+func buildTransformers(configs []TransformerConfig) ([]ResponseTransformer, error) {
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+	result := make([]ResponseTransformer, 0, len(configs))
+	for _, config := range configs {
+		factory, ok := transformers[strings.ToLower(config.Name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer: %s", config.Name)
+		}
+		transformer, err := factory(config.Options)
+		if err != nil {
+			return nil, fmt.Errorf("transformer %s: %w", config.Name, err)
+		}
+		result = append(result, transformer)
+	}
+	return result, nil
+}
+
+// headerTransformer mutates the response headers before the next handler runs.
+type headerTransformer func(header http.Header)
+
+func (t headerTransformer) Wrap(rw http.ResponseWriter, _ *http.Request) (http.ResponseWriter, func()) {
+	t(rw.Header())
+	return rw, func() {}
+}
+
+// newSetHeaderTransformer sets the header given by the name and value options.
+func newSetHeaderTransformer(options map[string]string) (ResponseTransformer, error) {
+	name, value := options["name"], options["value"]
+	if name == "" {
+		return nil, fmt.Errorf("name option is required")
+	}
+	return headerTransformer(func(header http.Header) {
+		header.Set(name, value)
+	}), nil
+}
+
+// newSetCookieTransformer sets the cookie given by the name, value, path,
+// domain and maxage options, e.g. to mark analytics sessions as verified.
+func newSetCookieTransformer(options map[string]string) (ResponseTransformer, error) {
+	cookie := &http.Cookie{
+		Name:   options["name"],
+		Value:  options["value"],
+		Path:   options["path"],
+		Domain: options["domain"],
+	}
+	if cookie.Name == "" {
+		return nil, fmt.Errorf("name option is required")
+	}
+	if maxAge := options["maxage"]; maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxage: %w", err)
+		}
+		cookie.MaxAge = int(d.Seconds())
+	}
+	value := cookie.String()
+	if value == "" {
+		return nil, fmt.Errorf("invalid cookie %s", cookie.Name)
+	}
+	return headerTransformer(func(header http.Header) {
+		header.Add("Set-Cookie", value)
+	}), nil
+}
+
+// htmlInjectTransformer inserts a fragment into HTML responses.
+type htmlInjectTransformer struct {
+	fragment []byte
+	// marker is the tag the fragment is inserted after (or before, for closing tags)
+	marker []byte
+}
+
+// newHTMLInjectTransformer injects the fragment option after the opening body
+// tag, or before the tag given by the before option (e.g. "</body>").
+func newHTMLInjectTransformer(options map[string]string) (ResponseTransformer, error) {
+	if options["fragment"] == "" {
+		return nil, fmt.Errorf("fragment option is required")
+	}
+	marker := "<body"
+	if before := options["before"]; before != "" {
+		marker = before
+	}
+	return &htmlInjectTransformer{
+		fragment: []byte(options["fragment"]),
+		marker:   []byte(strings.ToLower(marker)),
+	}, nil
+}
+
+func (t *htmlInjectTransformer) Wrap(rw http.ResponseWriter, _ *http.Request) (http.ResponseWriter, func()) {
+	writer := newBodyRewriter(rw, isHTMLResponse, t.inject)
+	return writer, writer.finish
+}
+
+func (t *htmlInjectTransformer) inject(body []byte) []byte {
+	index := bytes.Index(bytes.ToLower(body), t.marker)
+	if index < 0 {
+		return body
+	}
+	if bytes.HasPrefix(t.marker, []byte("<body")) {
+		// insert after the end of the opening body tag
+		end := bytes.IndexByte(body[index:], '>')
+		if end < 0 {
+			return body
+		}
+		index += end + 1
+	}
+	result := make([]byte, 0, len(body)+len(t.fragment))
+	result = append(result, body[:index]...)
+	result = append(result, t.fragment...)
+	return append(result, body[index:]...)
+}
+
+func isHTMLResponse(header http.Header) bool {
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "text/html"
+}
+
+// bodyRewriter buffers responses selected by match so rewrite can modify the
+// complete body, other responses are passed through untouched.
+type bodyRewriter struct {
+	responseWriter
+	match   func(http.Header) bool
+	rewrite func([]byte) []byte
+
+	status      int
+	wroteHeader bool
+	buffering   bool
+	buf         bytes.Buffer
+}
+
+func newBodyRewriter(rw http.ResponseWriter, match func(http.Header) bool, rewrite func([]byte) []byte) *bodyRewriter {
+	return &bodyRewriter{responseWriter: responseWriter{rw}, match: match, rewrite: rewrite}
+}
+
+func (w *bodyRewriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	w.buffering = status == http.StatusOK && w.match(w.Header())
+	if !w.buffering {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *bodyRewriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		return w.buf.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush forwards to the wrapped writer unless the response is being buffered for rewriting.
+func (w *bodyRewriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.buffering {
+		w.responseWriter.Flush()
+	}
+}
+
+// finish writes the rewritten buffered body.
+func (w *bodyRewriter) finish() {
+	if !w.buffering {
+		return
+	}
+	body := w.rewrite(w.buf.Bytes())
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	_, _ = w.ResponseWriter.Write(body)
+}
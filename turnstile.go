@@ -1,217 +1,1126 @@
 package turnstile
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"net"
 	"net/http"
-	"net/url"
-	"os"
+	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+//go:generate sh -c "go run ./cmd/turnstile-schema schema > turnstile.schema.json"
+
+const defaultVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+
 // Router is a struct that represents a router in the configuration file.
 type Router struct {
+	// Methods lists the HTTP methods the router matches, "*" or ANY matches any method,
+	// if neither methods nor method is provided, any method will be matched
+	Methods []string `yaml:"methods"`
+	// Method is a single HTTP method, kept for compatibility, it is merged into Methods
 	Method string `yaml:"method"`
 	Path   string `yaml:"path"`
+	// ExcludePaths are path templates excluded from the router even when Path or PathRegexp matches
+	ExcludePaths []string `yaml:"excludepaths"`
+	// Group is the name of the router group whose settings this router inherits
+	Group string `yaml:"group"`
+	// Priority orders overlapping routers, higher priorities are matched first, routers with equal priority keep their configured order
+	Priority int `yaml:"priority"`
+	// Host restricts the router to a virtual host, a leading "*." matches any subdomain
+	Host string `yaml:"host"`
+	// Headers are conditions on request headers, all of them must match
+	Headers []Matcher `yaml:"headers"`
+	// Query are conditions on query parameters, all of them must match
+	Query []Matcher `yaml:"query"`
+	// PathRegexp matches the whole request path against a regular expression instead of Path
+	PathRegexp string `yaml:"pathregexp"`
 	// HeaderKey is the key of the header to check for the token, if not provided, the form key will be used
 	HeaderKey string `yaml:"headerkey"`
 	// FormKey is the key of the form to check for the token, if not provided, the default value cf-turnstile-response will be used
 	FormKey string `yaml:"formkey"`
-}
-
-func (r *Router) isMatch(req *http.Request) bool {
-	if !strings.EqualFold(req.Method, r.Method) {
-		return false
-	}
-
-	requestPath := strings.ToLower(req.URL.Path)
+	// FormKeys are further form keys checked in order after FormKey, e.g. g-recaptcha-response while
+	// migrating from reCAPTCHA widgets
+	FormKeys []string `yaml:"formkeys"`
+	// CookieKey is the name of the cookie to check for the token, if not provided, the form key will be used
+	// by the cookie token source
+	CookieKey string `yaml:"cookiekey"`
+	// QueryKey is the name of the query parameter to check for the token, so links can carry it without a body,
+	// if not provided, the form key will be used by the query token source
+	QueryKey string `yaml:"querykey"`
+	// JSONKey is the JSON pointer of the token in application/json bodies, e.g. /captcha/token, if not provided,
+	// the form key as a top-level field will be used by the jsonbody token source
+	JSONKey string `yaml:"jsonkey"`
+	// GraphQL reads the token from a variable of GraphQL requests and can restrict the router to some operations
+	GraphQL *GraphQLConfig `yaml:"graphql"`
+	// AuthScheme reads the token from the Authorization header with this scheme, e.g. Turnstile for
+	// "Authorization: Turnstile <token>", the authorization token source uses Turnstile if not provided
+	AuthScheme string `yaml:"authscheme"`
+	// TokenExpr computes the token with an expression over headers, query parameters, cookies, forms and
+	// JSON bodies, e.g. after(header("X-Captcha"), "v1:") ?? json("/meta/captcha"), it requires the
+	// expressionpolicies feature flag
+	TokenExpr string `yaml:"tokenexpr"`
+	// TokenInHeaderOnly guarantees the body is never read nor limited, so large uploads stream through
+	// untouched, it requires a token source outside the body
+	TokenInHeaderOnly bool `yaml:"tokeninheaderonly"`
+	// TokenFirstPart declares that multipart requests carry the token as their first part,
+	// so the body is only read up to that part instead of being buffered entirely
+	TokenFirstPart bool `yaml:"tokenfirstpart"`
+	// Envelope reads the token from a claim of a JWS/JWT the frontend wraps its form data in
+	Envelope *EnvelopeConfig `yaml:"envelope"`
+	// TokenSources lists where the token is looked for, in order: header, form, query, cookie, jsonbody,
+	// graphql or authorization, if not provided, the header when HeaderKey is set, the cookie when CookieKey
+	// is set, the query when QueryKey is set, the JSON body when JSONKey is set, the GraphQL variables when
+	// GraphQL is set, the Authorization header when AuthScheme is set and the form otherwise will be used
+	TokenSources []string `yaml:"tokensources"`
+	// Secret is the secret of the widget used on this router's forms, if not provided, the secret of the
+	// request host will be used
+	Secret string `yaml:"secret"`
+	// IdentityKey lists the components identifying a client for the velocity trigger: ip, ua, session or header:<name>,
+	// if not provided, the client IP will be used
+	IdentityKey []string `yaml:"identitykey"`
 
-	routerParts := strings.Split(strings.Trim(r.Path, "/"), "/")
-	requestParts := strings.Split(strings.Trim(requestPath, "/"), "/")
+	// PreClearance skips token verification for requests carrying a Turnstile pre-clearance cookie
+	PreClearance bool `yaml:"preclearance"`
+	// Velocity only challenges clients exceeding a request rate on the router, slower clients pass unchallenged
+	Velocity *VelocityConfig `yaml:"velocity"`
+	// Action is what the router does with matching requests, challenge (default) or maintenance
+	Action string `yaml:"action"`
+	// Maintenance is the static response returned by the maintenance action
+	Maintenance *MaintenanceResponse `yaml:"maintenance"`
+	// Transformers modify the response of requests that passed verification
+	Transformers []TransformerConfig `yaml:"transformers"`
+	// UnverifiedBackend is the URL of an alternate backend serving requests allowed without
+	// verification, if not provided, they will be forwarded to the primary backend
+	UnverifiedBackend string `yaml:"unverifiedbackend"`
+	// UnverifiedReasons select the decision reasons sent to the unverified backend,
+	// if not provided, fail-open and grace will be used
+	UnverifiedReasons []string `yaml:"unverifiedreasons"`
+	// ErrorFormat is the format of this router's rejections: json, problem or negotiate,
+	// if not provided, the global errorformat will be used
+	ErrorFormat string `yaml:"errorformat"`
 
-	if len(routerParts) != len(requestParts) {
-		return false
-	}
-
-	for i := 0; i < len(routerParts); i++ {
-		// Check if this part is a parameter (wrapped in {})
-		if strings.HasPrefix(routerParts[i], "{") && strings.HasSuffix(routerParts[i], "}") {
-			continue // Skip parameter comparison
-		}
-		// Otherwise, check for exact match
-		if routerParts[i] != requestParts[i] {
-			return false
-		}
-	}
-	return true
+	action string
+	// methods holds the upper-cased methods, nil matches any method
+	methods      []string
+	path         pathPattern
+	excludePaths []pathPattern
+	headers      []Matcher
+	query        []Matcher
+	pathRegexp   *regexp.Regexp
+	envelope     *envelope
+	tokenSources []TokenSource
+	// formKeys holds FormKey followed by FormKeys
+	formKeys []string
+	// jsonPointer holds the unescaped reference tokens of JSONKey
+	jsonPointer  []string
+	graphql      *graphQL
+	tokenExpr    *tokenExpression
+	secret       secretSource
+	velocity     *velocity
+	identity     identityKey
+	transformers []ResponseTransformer
+	unverified   *unverifiedBackend
+	// errorFormat is empty when the router uses the global format
+	errorFormat string
+	// metrics are the counters of the router, registered in New()
+	metrics *routeMetrics
+	// multipartMemory bounds the multipart form held in memory, set in newRouteMatcher
+	multipartMemory int64
+	// maxFormBytes bounds the body buffered to read a form, set in newRouteMatcher
+	maxFormBytes int64
 }
 
-func (t *Router) getToken(req *http.Request) (string, error) {
-	if t.HeaderKey != "" {
-		return req.Header.Get(t.HeaderKey), nil
-	}
-	formKey := "cf-turnstile-response"
-	if t.FormKey != "" {
-		formKey = t.FormKey
+// label identifies the router in metrics and logs.
+func (r *Router) label() string {
+	methods := "*"
+	if r.methods != nil {
+		methods = strings.Join(r.methods, ",")
 	}
-	copyReq, err := copyRequest(req)
-	if err != nil {
-		return "", errors.New("failed to copy request")
-	}
-	err = copyReq.ParseForm()
-	if err != nil {
-		return "", errors.New("failed to parse form")
+	path := r.Path
+	if r.PathRegexp != "" {
+		path = r.PathRegexp
 	}
-	token := copyReq.Form.Get(formKey)
-	if token == "" {
-		return "", errors.New("no token provided")
-	}
-	return token, nil
-}
-
-func init() {
-	log.SetOutput(os.Stdout)
+	return methods + " " + r.Host + path
 }
 
 // Config the plugin configuration.
 type Config struct {
 	TurnstileSecret string   `yaml:"turnstilesecret"`
 	Routers         []Router `yaml:"routers"`
+	// RoutersFile is a JSON file of routers protected in addition to routers, it is reloaded when it changes
+	RoutersFile string `yaml:"routersfile"`
+	// TurnstileSecretFile is a file holding the secret instead of turnstilesecret, e.g. a mounted
+	// Docker or Kubernetes secret, it is re-read when it changes
+	TurnstileSecretFile string `yaml:"turnstilesecretfile"`
+	// Vault reads the secret from HashiCorp Vault instead of turnstilesecret
+	Vault *VaultConfig `yaml:"vault"`
+	// SecretRef reads the secret from a cloud secret manager instead of turnstilesecret,
+	// e.g. aws-sm://turnstile?region=eu-west-1 or gcp-sm://projects/p/secrets/turnstile
+	SecretRef string `yaml:"secretref"`
+	// Secrets are the secrets of the sites served on each host, keyed by host, a leading "*." matches any
+	// subdomain, if not provided for a host, turnstilesecret will be used
+	Secrets map[string]string `yaml:"secrets"`
+	// TurnstileSecondarySecret is tried when siteverify rejects the secret as invalid, so the secret
+	// can be rotated without downtime, if not provided, rejected tokens will not be retried
+	TurnstileSecondarySecret string `yaml:"turnstilesecondarysecret"`
+	// VerifyURL is the siteverify endpoint, if not provided, the Cloudflare endpoint will be used
+	VerifyURL string `yaml:"verifyurl"`
+	// VerifyTimeout bounds each siteverify call, if not provided, 5s will be used
+	VerifyTimeout string `yaml:"verifytimeout"`
+	// VerifyRetries is the number of retries after a transport error or 5xx response,
+	// if not provided, 2 will be used, a negative value disables retries
+	VerifyRetries int `yaml:"verifyretries"`
+	// VerifyRateLimit bounds the siteverify calls of the middleware, protecting the quota and latency during floods
+	VerifyRateLimit *VerifyRateLimitConfig `yaml:"verifyratelimit"`
+	// MaxConcurrentVerifications bounds the siteverify calls in flight, requests finding every call taken are
+	// rejected with 429, if not provided, calls will not be bounded
+	MaxConcurrentVerifications int `yaml:"maxconcurrentverifications"`
+	// VerificationQueueTimeout is how long a request waits for a call when maxconcurrentverifications are in flight,
+	// if not provided, it will be rejected right away
+	VerificationQueueTimeout string `yaml:"verificationqueuetimeout"`
+	// FailurePolicy is "closed" to reject or "open" to admit requests while siteverify
+	// cannot be reached, if not provided, closed will be used
+	FailurePolicy string `yaml:"failurepolicy"`
+	// ErrorFormat is "json" for {"error": "..."} bodies, "problem" for RFC 7807 application/problem+json
+	// or "negotiate" to answer browsers with HTML and other clients with JSON, if not provided, json will be used
+	ErrorFormat string `yaml:"errorformat"`
+	// ErrorCodeStatuses maps siteverify error codes to the status of the rejection, e.g. timeout-or-duplicate: 409,
+	// if not provided, rejected tokens will be answered with 400
+	ErrorCodeStatuses map[string]int `yaml:"errorcodestatuses"`
+	// RetryAfter is sent as the Retry-After header of rejections caused by siteverify being unavailable or
+	// rate limited, if not provided, the delay requested by siteverify or 30s will be used
+	RetryAfter string `yaml:"retryafter"`
+	// ExposeErrorDetails sends the siteverify error codes and upstream errors to clients, disable it in production
+	// to keep them in logs only, so attackers can't probe which validation step failed
+	ExposeErrorDetails bool `yaml:"exposeerrordetails"`
+	// Localize translates the messages of rejections to the language preferred by the Accept-Language header
+	Localize bool `yaml:"localize"`
+	// DefaultLanguage is the language of clients preferring no supported language, if not provided, en will be used
+	DefaultLanguage string `yaml:"defaultlanguage"`
+	// ErrorTemplates render rejections, keyed by reason (e.g. verification-failed), status (e.g. "403"),
+	// status class ("4xx") or "default", the most specific key wins
+	ErrorTemplates map[string]*ErrorTemplate `yaml:"errortemplates"`
+	// FormKey is the form field read by routers without a token source, if not provided,
+	// cf-turnstile-response will be used
+	FormKey string `yaml:"formkey"`
+	// FormKeys are further form fields checked in order after FormKey by routers without a token source
+	FormKeys []string `yaml:"formkeys"`
+	// MultipartMemory is the number of bytes of a multipart form held in memory while reading its token,
+	// larger files are spooled to temporary files, if not provided, 32 MiB will be used
+	MultipartMemory int64 `yaml:"multipartmemory"`
+	// MaxBodyBytes bounds the body of protected requests, larger bodies are rejected with 413 instead of
+	// being buffered to read the token, if not provided, bodies will not be limited and forms are read up to 64 MiB
+	MaxBodyBytes int64 `yaml:"maxbodybytes"`
+	// Groups are named router settings inherited by the routers referencing them
+	Groups map[string]*Router `yaml:"groups"`
+	// ProtectAll protects every request, routers then only customize how matching requests are verified
+	ProtectAll bool `yaml:"protectall"`
+	// ExcludeRouters are never protected, they take precedence over routers and protectall
+	ExcludeRouters []Router `yaml:"excluderouters"`
+	// BypassPreflight forwards CORS preflights (OPTIONS with Access-Control-Request-Method) unverified,
+	// they can never carry a token
+	BypassPreflight bool `yaml:"bypasspreflight"`
+	// BypassMethods are forwarded unverified on every router, e.g. [OPTIONS, HEAD]
+	BypassMethods []string `yaml:"bypassmethods"`
+	// TrustedIPs are CIDRs or addresses of clients that skip verification, e.g. health checkers and partner systems
+	TrustedIPs []string `yaml:"trustedips"`
+	// BypassSignature lets internal callers skip verification with a header signed by a shared key
+	BypassSignature *BypassSignatureConfig `yaml:"bypasssignature"`
+	// ClientCerts lets callers presenting a trusted client certificate skip verification
+	ClientCerts *ClientCertConfig `yaml:"clientcerts"`
+	// BypassAPIKeys lets API consumers sending an accepted key skip verification
+	BypassAPIKeys *BypassAPIKeysConfig `yaml:"bypassapikeys"`
+	// VerifiedBots are the search engine crawlers whose GET and HEAD requests skip verification once their
+	// address is confirmed by reverse and forward DNS, one of googlebot, bingbot or applebot
+	VerifiedBots []string `yaml:"verifiedbots"`
+	// Bans rejects client IPs without calling siteverify for a cooldown after consecutive failed verifications
+	Bans *BanConfig `yaml:"bans"`
+	// Tarpit delays the rejections of client IPs repeatedly failing verification
+	Tarpit *TarpitConfig `yaml:"tarpit"`
+	// AuthSession skips verification for requests carrying an application session cookie or header
+	AuthSession *AuthSessionConfig `yaml:"authsession"`
+	// BlockedIPs are CIDRs or addresses of clients that are always rejected, before trustedips and any
+	// siteverify call
+	BlockedIPs []string `yaml:"blockedips"`
+	// BlockedStatus is the status of rejections of blockedips, if not provided, 403 will be used
+	BlockedStatus int `yaml:"blockedstatus"`
+	// CaseSensitive matches path templates case-sensitively, if not provided, paths will be compared case-insensitively
+	CaseSensitive bool `yaml:"casesensitive"`
+	// StrictTrailingSlash distinguishes /login from /login/, if not provided, trailing slashes will be ignored
+	StrictTrailingSlash bool `yaml:"stricttrailingslash"`
+	// SessionTTL enables the verification session cookie when set (e.g. "30m"),
+	// requests bearing a valid cookie skip the siteverify call
+	SessionTTL string `yaml:"sessionttl"`
+	// SessionSecret is the key used to sign the session cookie, if not provided, a key derived from the turnstile secret will be used
+	SessionSecret string `yaml:"sessionsecret"`
+	// SessionEncrypt encrypts the session cookie payload with AES-GCM instead of only signing it
+	SessionEncrypt      bool   `yaml:"sessionencrypt"`
+	SessionCookieName   string `yaml:"sessioncookiename"`
+	SessionCookieDomain string `yaml:"sessioncookiedomain"`
+	SessionCookiePath   string `yaml:"sessioncookiepath"`
+	// SessionCookieSameSite is one of lax, strict or none, if not provided, lax will be used
+	SessionCookieSameSite string `yaml:"sessioncookiesamesite"`
+	SessionCookieSecure   bool   `yaml:"sessioncookiesecure"`
+	SessionCookieHTTPOnly bool   `yaml:"sessioncookiehttponly"`
+	// SessionIPBinding binds sessions to the client IP, one of strict, prefix (/24 or /64) or off, if not provided, off will be used
+	SessionIPBinding string `yaml:"sessionipbinding"`
+	// SessionSliding refreshes the session expiry on every cookie-based pass
+	SessionSliding bool `yaml:"sessionsliding"`
+	// SessionMaxAge is the absolute session lifetime when sliding, if not provided, 24h will be used
+	SessionMaxAge string `yaml:"sessionmaxage"`
+	// GraceFile enables grace mode while the file exists, it may contain an RFC 3339 end time
+	GraceFile string `yaml:"gracefile"`
+	// GraceMaxDuration bounds how long grace mode stays active after the file is created, if not provided, 1h will be used
+	GraceMaxDuration string `yaml:"gracemaxduration"`
+	// GraceSessionExtension is how long after expiry session cookies are still accepted in grace mode, if not provided, the session ttl will be used
+	GraceSessionExtension string `yaml:"gracesessionextension"`
+	// GraceAuditFile is the file admissions under grace mode are appended to, if not provided, they will be logged to stdout
+	GraceAuditFile string `yaml:"graceauditfile"`
+	// MetricsAddress is the address of an optional listener serving metrics at /metrics, e.g. ":8082",
+	// it requires AdminAccess to be enabled
+	MetricsAddress string `yaml:"metricsaddress"`
+	// AdminAccess guards every introspection endpoint
+	AdminAccess AdminAccess `yaml:"adminaccess"`
+	// Mode is "enforce" to apply decisions or "shadow" to only record them and forward every request,
+	// if not provided, enforce will be used
+	Mode string `yaml:"mode"`
+	// AdminAddress is the address of an optional listener serving the admin API, e.g. "127.0.0.1:8083",
+	// it requires AdminAccess to be enabled
+	AdminAddress string `yaml:"adminaddress"`
+	// LogLevel is the minimum level of log records: debug, info, warn or error, if not provided, info will be used
+	LogLevel string `yaml:"loglevel"`
+	// LogFormat is "text" or "json", if not provided, text will be used
+	LogFormat string `yaml:"logformat"`
+	// AuditLog is a file every decision is appended to as a JSON line, or "stdout",
+	// if not provided, no audit log will be written
+	AuditLog string `yaml:"auditlog"`
+	// Events publishes every decision to NATS or Kafka
+	Events *EventsConfig `yaml:"events"`
+	// Hooks are callbacks for programmatic users of the package, they cannot be set in YAML
+	Hooks *Hooks `yaml:"-"`
+	// Webhook receives signed notifications about failed verifications
+	Webhook *WebhookConfig `yaml:"webhook"`
+	// RequestIDHeader is the header carrying the request ID, it is propagated when present and generated otherwise,
+	// if not provided, X-Request-ID will be used
+	RequestIDHeader string `yaml:"requestidheader"`
+	// DecisionHeader is the response header carrying the decision and its reason, e.g. X-Turnstile-Decision,
+	// if not provided, no header will be sent
+	DecisionHeader string `yaml:"decisionheader"`
+	// Features switches experimental subsystems on by name, unknown names are rejected
+	Features map[string]bool `yaml:"features"`
+	// Profiles are named sets of overrides, the profile named by the ProfileEnv environment variable is applied
+	Profiles map[string]*Config `yaml:"profiles"`
+	// ProfileEnv is the environment variable selecting the profile, if not provided, TURNSTILE_PROFILE will be used
+	ProfileEnv string `yaml:"profileenv"`
+	// Clear lists the options a profile resets to false, empty or zero, which leaving them out of the profile
+	// cannot express, e.g. exposeerrordetails; it is only valid within profiles
+	Clear []string `yaml:"clear"`
+	// SiteKey is the public sitekey of the widget, it is required by features rendering the widget
+	SiteKey string `yaml:"sitekey"`
+	// Interstitial serves a challenge page instead of an error to browsers sending no token to form-based routers,
+	// it requires sitekey and the interstitial feature
+	Interstitial bool `yaml:"interstitial"`
+	// Redirect sends browsers that sent no token to a challenge page and back once it is solved,
+	// it requires sessionttl
+	Redirect *RedirectConfig `yaml:"redirect"`
+	// SPAContract answers token rejections of requests accepting JSON or carrying X-Requested-With with
+	// 401 or 403 and a body telling single-page apps to refresh the token, it requires sitekey
+	SPAContract bool `yaml:"spacontract"`
+	// Injection adds the widget to the forms of HTML pages of the backend, it requires sitekey and the injection feature
+	Injection *InjectionConfig `yaml:"injection"`
+	// Attestation enables the endpoint exchanging app attestation verdicts for clearances
+	Attestation *AttestationConfig `yaml:"attestation"`
+	// PreClearanceCookie is the name of the pre-clearance cookie, if not provided, cf_clearance will be used
+	PreClearanceCookie string `yaml:"preclearancecookie"`
+	// CloudflareIPs are the edge ranges pre-clearance cookies are trusted from, if not provided, the published Cloudflare ranges will be used
+	CloudflareIPs []string `yaml:"cloudflareips"`
+	// OTLPLogsEndpoint is the OTLP/HTTP logs endpoint decision records are exported to, e.g. http://collector:4318/v1/logs
+	OTLPLogsEndpoint string `yaml:"otlplogsendpoint"`
+	// StatsDAddress is the UDP address of a StatsD or DogStatsD agent per-route metrics are sent to, e.g. localhost:8125
+	StatsDAddress string `yaml:"statsdaddress"`
+	// StatsDPrefix is prepended to every metric name, if not provided, "turnstile." will be used
+	StatsDPrefix string `yaml:"statsdprefix"`
+	// StatsDFormat is "statsd" to embed the route in metric names or "datadog" to send it as a tag,
+	// if not provided, statsd will be used
+	StatsDFormat string `yaml:"statsdformat"`
+	// StatsDTags are added to every metric in the datadog format, e.g. env: production
+	StatsDTags map[string]string `yaml:"statsdtags"`
+	// OTLPTracesEndpoint is the OTLP/HTTP traces endpoint spans of the verification path are exported to,
+	// e.g. http://collector:4318/v1/traces
+	OTLPTracesEndpoint string `yaml:"otlptracesendpoint"`
+	// OTLPTracesSampleRatio is the share of requests without a sampled trace context that start a new trace,
+	// if not provided, only requests continuing a sampled trace will be traced
+	OTLPTracesSampleRatio float64 `yaml:"otlptracessampleratio"`
+	// OTLPHeaders are sent with every OTLP export request, e.g. for authentication
+	OTLPHeaders map[string]string `yaml:"otlpheaders"`
+	// OTLPResourceAttributes are added to the resource describing this Traefik instance
+	OTLPResourceAttributes map[string]string `yaml:"otlpresourceattributes"`
+	// LatencyBudget is the decision latency the middleware may add (e.g. "150ms"), nonessential
+	// features are shed while it is exceeded persistently, if not provided, nothing will be shed
+	LatencyBudget string `yaml:"latencybudget"`
+	// LatencyPercentile is the percentile held to the budget, if not provided, 95 will be used
+	LatencyPercentile int `yaml:"latencypercentile"`
+	// LatencyWindow is the interval the percentile is evaluated over, if not provided, 30s will be used
+	LatencyWindow string `yaml:"latencywindow"`
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
-	return &Config{}
+	return &Config{
+		VerifyTimeout:         defaultVerifyTimeout.String(),
+		VerifyRetries:         defaultVerifyRetries,
+		FailurePolicy:         failurePolicyClosed,
+		FormKey:               defaultFormKey,
+		SessionCookieSecure:   true,
+		SessionCookieHTTPOnly: true,
+		ExposeErrorDetails:    true,
+		BypassPreflight:       true,
+	}
 }
 
 // Demo a Demo plugin.
 type turnstile struct {
-	next             http.Handler
-	secret           string
-	protectedRouters []Router
+	next     http.Handler
+	verifier *verifier
+	secrets  *hostSecrets
+	// failOpen admits requests when siteverify cannot be reached
+	failOpen     bool
+	routes       *liveRoutes
+	sessions     *sessionManager
+	attestation  *attestationExchange
+	grace        *graceMode
+	metrics      *metrics
+	preClearance *preClearance
+	otlpLogs     *otlpLogExporter
+	audit        *auditLog
+	webhook      *webhookNotifier
+	events       *eventPublisher
+	hooks        *Hooks
+	tracer       *tracer
+	statsD       *statsDSink
+	store        counterStore
+	latency      *latencyGuard
+	features     features
+	// mode and stats are shared with the admin API
+	mode  *enforcementMode
+	stats *decisionStats
+	// decisionHeader is the response header name for decisions, empty disables it
+	decisionHeader string
+	// requestIDHeader is the header carrying the request ID
+	requestIDHeader string
+	// errorFormat is the format of rejection responses without a template
+	errorFormat    string
+	errorTemplates errorTemplates
+	localizer      *localizer
+	// exposeErrorDetails sends siteverify error codes to clients
+	exposeErrorDetails bool
+	// errorCodeStatuses maps siteverify error codes to rejection statuses
+	errorCodeStatuses map[string]int
+	// trustedIPs are the networks of clients that skip verification
+	trustedIPs []*net.IPNet
+	// signedBypass admits requests signed with the bypass key, nil when it is not configured
+	signedBypass *signedBypass
+	// clientCerts admits requests with a trusted client certificate, nil when it is not configured
+	clientCerts *clientCertBypass
+	// apiKeys admits requests with an accepted API key, nil when none are configured
+	apiKeys *apiKeyBypass
+	// authSession admits signed-in users of the application, nil when it is not configured
+	authSession *authSession
+	// bots admits verified search engine crawlers, nil when none are configured
+	bots *verifiedBots
+	// bans rejects clients after consecutive failed verifications, nil when they are not configured
+	bans *banList
+	// tarpit delays rejections of repeatedly failing clients, nil when it is not configured
+	tarpit *tarpit
+	// verifyLimit bounds the siteverify calls, nil when they are not limited
+	verifyLimit *verifyLimiter
+	// verifySlots bounds the concurrent siteverify calls, nil when they are not bounded
+	verifySlots *verifySlots
+	// blockedIPs are the networks of clients that are always rejected with blockedStatus
+	blockedIPs    []*net.IPNet
+	blockedStatus int
+	// maxBodyBytes bounds the body of protected requests, 0 when it is not bounded
+	maxBodyBytes int64
+	// retryAfter is the delay clients wait after a transient failure unless siteverify requests one
+	retryAfter time.Duration
+	// secretAlertAt is the Unix time of the last alert about a rejected secret, shared by wrapped handlers
+	secretAlertAt *atomic.Int64
+	interstitial  *interstitial
+	redirect      *redirectFlow
+	injector      *injector
+	spa           *spaContract
+	// name is the middleware name given to New, it identifies the instance in logs
+	name string
 }
 
 // New created a new Demo plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	if len(config.TurnstileSecret) == 0 {
-		return nil, fmt.Errorf("turnstilesecret cannot be empty")
+	config, err := resolveProfile(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// every problem is collected so a misconfiguration is reported in full
+	var problems configErrors
+	secret, err := newSecretSource(config)
+	problems.add(err)
+	verifier, err := newVerifier(config, secret)
+	problems.add(err)
+	secrets, err := newHostSecrets(config, secret)
+	problems.add(err)
+	failurePolicy, err := parseFailurePolicy(config.FailurePolicy)
+	problems.add(err)
+	problems.add(validateEndpoint("otlplogsendpoint", config.OTLPLogsEndpoint))
+	problems.add(validateEndpoint("otlptracesendpoint", config.OTLPTracesEndpoint))
+	if config.OTLPTracesSampleRatio < 0 || config.OTLPTracesSampleRatio > 1 {
+		problems.add(fmt.Errorf("otlptracessampleratio must be between 0 and 1"))
+	}
+
+	routersFile := newRoutersFile(config)
+	var routes *routeMatcher
+	if routersFile != nil {
+		routes, err = routersFile.load()
+	} else {
+		routes, err = newRouteMatcher(config)
+	}
+	problems.add(err)
+
+	sessions, err := newSessionManager(config, secret)
+	problems.add(err)
+
+	attestation, err := newAttestationExchange(config, sessions)
+	problems.add(err)
+
+	grace, err := newGraceMode(config)
+	problems.add(err)
+
+	preClearance, err := newPreClearance(config)
+	problems.add(err)
+
+	adminGuard, err := newAdminGuard(config.AdminAccess)
+	problems.add(err)
+
+	latency, err := newLatencyGuard(config)
+	problems.add(err)
+
+	features, err := newFeatures(config.Features)
+	problems.add(err)
+
+	interstitial, err := newInterstitial(config, features)
+	problems.add(err)
+
+	redirect, err := newRedirectFlow(config, sessions)
+	problems.add(err)
+
+	injector, err := newInjector(config, features)
+	problems.add(err)
+
+	spa, err := newSPAContract(config)
+	problems.add(err)
+
+	mode, err := newEnforcementMode(config.Mode)
+	problems.add(err)
+
+	logSettings, err := parseLogSettings(config)
+	problems.add(err)
+
+	statsD, err := newStatsDSink(config)
+	problems.add(err)
+
+	audit, err := newAuditLog(config)
+	problems.add(err)
+
+	webhook, err := newWebhookNotifier(config, name)
+	problems.add(err)
+
+	events, err := newEventPublisher(config)
+	problems.add(err)
+
+	errorFormat, err := parseErrorFormat(config.ErrorFormat)
+	problems.add(err)
+
+	errorTemplates, err := newErrorTemplates(config.ErrorTemplates)
+	problems.add(err)
+
+	errorCodeStatuses, err := parseErrorCodeStatuses(config.ErrorCodeStatuses)
+	problems.add(err)
+
+	localizer, err := newLocalizer(config)
+	problems.add(err)
+
+	retryAfter, err := parseRetryAfterSetting(config.RetryAfter)
+	problems.add(err)
+
+	trustedIPs, err := parseCIDRs(config.TrustedIPs)
+	if err != nil {
+		problems.add(fmt.Errorf("invalid trustedips: %w", err))
+	}
+	signedBypass, err := newSignedBypass(config)
+	problems.add(err)
+	clientCerts, err := newClientCertBypass(config)
+	problems.add(err)
+	apiKeys, err := newAPIKeyBypass(config)
+	problems.add(err)
+	authSession, err := newAuthSession(config)
+	problems.add(err)
+	bots, err := newVerifiedBots(config)
+	problems.add(err)
+	bans, err := newBanList(config)
+	problems.add(err)
+	tarpit, err := newTarpit(config)
+	problems.add(err)
+	verifyLimit, err := newVerifyLimiter(config)
+	problems.add(err)
+	verifySlots, err := newVerifySlots(config)
+	problems.add(err)
+	blockedIPs, err := parseCIDRs(config.BlockedIPs)
+	if err != nil {
+		problems.add(fmt.Errorf("invalid blockedips: %w", err))
+	}
+	blockedStatus := config.BlockedStatus
+	switch {
+	case blockedStatus == 0:
+		blockedStatus = http.StatusForbidden
+	case blockedStatus < 400 || blockedStatus > 599:
+		problems.add(fmt.Errorf("invalid blockedstatus: %d is not an error status", blockedStatus))
+	}
+	if config.MaxBodyBytes < 0 {
+		problems.add(errors.New("maxbodybytes cannot be negative"))
+	}
+
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+
+	logSettings.apply()
+	features.log()
+
+	requestIDHeader := config.RequestIDHeader
+	if requestIDHeader == "" {
+		requestIDHeader = defaultRequestIDHeader
+	}
+
+	latency.start(ctx)
+	if statsD != nil {
+		background.schedule(ctx, "statsd-flush", statsDFlushInterval, statsD.flush)
+	}
+	if watched, ok := secret.(watchedSecret); ok {
+		watched.watch(ctx)
+	}
+	metrics := newMetrics()
+	metrics.latency = latency
+	metrics.registerRoutes(routes)
+	liveRoutes := newLiveRoutes(routes)
+	if routersFile != nil {
+		routersFile.watch(ctx, liveRoutes, metrics)
+	}
+	store := newMemoryStore(ctx)
+	stats := newDecisionStats()
+	webhook.start(ctx, stats)
+	events.start(ctx)
+	bots.start(ctx)
+	bans.start(ctx)
+	if config.AdminAddress != "" {
+		api := &adminAPI{routes: liveRoutes, mode: mode, store: store, stats: stats}
+		mux := api.handler()
+		if config.MetricsAddress == config.AdminAddress {
+			mux.Handle("/metrics", metrics)
+		}
+		if err := adminGuard.serveAdmin("adminaddress", config.AdminAddress, name, mux); err != nil {
+			return nil, fmt.Errorf("failed to start admin listener: %w", err)
+		}
+	}
+	if config.MetricsAddress != "" && config.MetricsAddress != config.AdminAddress {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		if err := adminGuard.serveAdmin("metricsaddress", config.MetricsAddress, name, mux); err != nil {
+			return nil, fmt.Errorf("failed to start metrics listener: %w", err)
+		}
 	}
 
 	return &turnstile{
-		next:             next,
-		secret:           config.TurnstileSecret,
-		protectedRouters: config.Routers,
+		next:           next,
+		verifier:       verifier,
+		secrets:        secrets,
+		failOpen:       failurePolicy == failurePolicyOpen,
+		routes:         liveRoutes,
+		sessions:       sessions,
+		attestation:    attestation,
+		grace:          grace,
+		metrics:        metrics,
+		preClearance:   preClearance,
+		otlpLogs:       newOTLPLogExporter(ctx, config, name),
+		audit:          audit,
+		webhook:        webhook,
+		events:         events,
+		hooks:          config.Hooks,
+		tracer:         newTracer(ctx, config, name),
+		statsD:         statsD,
+		name:           name,
+		store:          store,
+		mode:           mode,
+		stats:          stats,
+		latency:        latency,
+		features:       features,
+		decisionHeader: config.DecisionHeader,
+
+		requestIDHeader: requestIDHeader,
+		errorFormat:     errorFormat,
+		errorTemplates:  errorTemplates,
+		localizer:       localizer,
+
+		exposeErrorDetails: config.ExposeErrorDetails,
+
+		errorCodeStatuses: errorCodeStatuses,
+		retryAfter:        retryAfter,
+		trustedIPs:        trustedIPs,
+		signedBypass:      signedBypass,
+		clientCerts:       clientCerts,
+		apiKeys:           apiKeys,
+		authSession:       authSession,
+		bots:              bots,
+		bans:              bans,
+		tarpit:            tarpit,
+		verifyLimit:       verifyLimit,
+		verifySlots:       verifySlots,
+		blockedIPs:        blockedIPs,
+		blockedStatus:     blockedStatus,
+		maxBodyBytes:      config.MaxBodyBytes,
+		secretAlertAt:     new(atomic.Int64),
+		interstitial:      interstitial,
+		redirect:          redirect,
+		injector:          injector,
+		spa:               spa,
+	}, nil
+}
+
+// Middleware validates config once and returns a function wrapping handlers
+// with the middleware, for applications using the package as a library. Every
+// wrapped handler shares the sessions, metrics and counters of one instance.
+func Middleware(ctx context.Context, config *Config, name string) (func(http.Handler) http.Handler, error) {
+	handler, err := New(ctx, nil, config, name)
+	if err != nil {
+		return nil, err
+	}
+	instance := handler.(*turnstile)
+	return func(next http.Handler) http.Handler {
+		wrapped := *instance
+		wrapped.next = next
+		return &wrapped
 	}, nil
 }
 
+// compileRouters returns a copy of routers with their derived settings prepared.
+func compileRouters(configured []Router, options pathOptions) ([]Router, error) {
+	routers := make([]Router, len(configured))
+	copy(routers, configured)
+	var problems configErrors
+	for i := range routers {
+		problems.add(compileRouter(&routers[i], options))
+	}
+	return routers, problems.err()
+}
+
+// compileRouter prepares the derived settings of r, reporting every invalid option.
+func compileRouter(r *Router, options pathOptions) error {
+	var problems configErrors
+	var err error
+	r.methods = compileMethods(r)
+	r.path = compilePath(r.Path, options)
+	r.excludePaths = make([]pathPattern, len(r.ExcludePaths))
+	for j, exclude := range r.ExcludePaths {
+		r.excludePaths[j] = compilePath(exclude, options)
+	}
+	if r.action, err = compileAction(r); err != nil {
+		problems.add(err)
+	}
+	if r.PathRegexp != "" {
+		if r.pathRegexp, err = regexp.Compile("^(?:" + r.PathRegexp + ")$"); err != nil {
+			problems.add(fmt.Errorf("invalid pathregexp: %w", err))
+		}
+	}
+	if r.headers, err = compileMatchers(r.Headers); err != nil {
+		problems.add(err)
+	}
+	if r.query, err = compileMatchers(r.Query); err != nil {
+		problems.add(err)
+	}
+	if r.envelope, err = newEnvelope(r.Envelope); err != nil {
+		problems.add(err)
+	}
+	r.formKeys = compileFormKeys(r)
+	if r.tokenSources, err = compileTokenSources(r.TokenSources); err != nil {
+		problems.add(err)
+	}
+	if r.jsonPointer, err = parseJSONPointer(r.JSONKey); err != nil {
+		problems.add(err)
+	}
+	if r.graphql, err = newGraphQL(r.GraphQL); err != nil {
+		problems.add(err)
+	}
+	if r.tokenExpr, err = compileTokenExpr(r.TokenExpr); err != nil {
+		problems.add(err)
+	}
+	if r.secret, err = newRouterSecret(r); err != nil {
+		problems.add(err)
+	}
+	if r.velocity, err = newVelocity(r.Velocity); err != nil {
+		problems.add(err)
+	}
+	if r.identity, err = parseIdentityKey(r.IdentityKey); err != nil {
+		problems.add(err)
+	}
+	if r.transformers, err = buildTransformers(r.Transformers); err != nil {
+		problems.add(err)
+	}
+	if r.unverified, err = newUnverifiedBackend(r); err != nil {
+		problems.add(err)
+	}
+	if r.ErrorFormat != "" {
+		if r.errorFormat, err = parseErrorFormat(r.ErrorFormat); err != nil {
+			problems.add(err)
+		}
+	}
+	return problems.wrap("router " + r.label())
+}
+
 // checks for a specific header in the response, extracts its value,
 // sends a notification POST request, and logs the result.
 func (a *turnstile) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	router, ok := a.isProtectedPath(req)
+	req = withRequestID(rw, req, a.requestIDHeader)
+	if a.attestation != nil && req.URL.Path == a.attestation.path {
+		a.attestation.ServeHTTP(rw, req)
+		return
+	}
+	if a.redirect != nil && req.URL.Path == a.redirect.callbackPath {
+		a.serveRedirectCallback(rw, req)
+		return
+	}
+	router, ok := a.routes.load().match(req)
 	if !ok {
+		if a.injector.matches(req) {
+			a.injector.serve(a.next, rw, req)
+			return
+		}
 		a.next.ServeHTTP(rw, req)
 		return
 	}
 
-	token, err := router.getToken(req)
-	if err != nil {
-		errorHandler(rw, http.StatusBadRequest, err.Error())
-		return
+	requestSpan := a.tracer.start(req, router)
+	if requestSpan != nil {
+		defer requestSpan.end()
+		req = req.WithContext(context.WithValue(req.Context(), spanContextKey{}, requestSpan))
 	}
 
-	form := url.Values{}
-	form.Add("secret", a.secret)
-	form.Add("response", token)
-	// create request with form data
-	myreq, err := http.NewRequest("POST", "https://challenges.cloudflare.com/turnstile/v0/siteverify", strings.NewReader(form.Encode()))
-	myreq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	if err != nil {
-		errorHandler(rw, http.StatusInternalServerError, "Failed to create verification request")
-		return
+	start := time.Now()
+	d := a.decide(rw, req, router)
+	a.spa.adjust(req, d)
+	a.report(rw, req, router, d, start)
+	if requestSpan != nil {
+		requestSpan.setAttributes(
+			otlpString("turnstile.decision", d.outcome()),
+			otlpString("turnstile.reason", string(d.Reason)),
+			otlpInt("turnstile.duration_ms", d.Duration.Milliseconds()),
+			otlpString("turnstile.request_id", requestIDFromContext(req.Context())),
+		)
+		// spans of the backend become children of the middleware span
+		req.Header.Set("traceparent", requestSpan.traceParent())
 	}
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(myreq)
-	if err != nil {
-		errorHandler(rw, http.StatusInternalServerError, "Failed to verify token")
+	if d.Reason == ReasonMaintenance {
+		router.Maintenance.write(rw)
 		return
 	}
-	defer resp.Body.Close()
-
-	// Read the response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		errorHandler(rw, http.StatusInternalServerError, "Failed to read verification response")
+	if !d.Allowed {
+		if a.mode.shadow.Load() {
+			// shadow mode records rejections without enforcing them
+			a.next.ServeHTTP(rw, req)
+			return
+		}
+		a.tarpit.wait(req, d.Tarpit)
+		a.writeRejection(rw, req, router, d)
+		if req.Body != nil {
+			// the body is not forwarded, closing it recycles the buffers read for the token
+			_ = req.Body.Close()
+		}
 		return
 	}
-
-	// Parse the response
-	var turnstileResp turnstileResponse
-	if err := json.Unmarshal(body, &turnstileResp); err != nil {
-		errorHandler(rw, http.StatusInternalServerError, "Failed to parse verification response")
+	if d.Reason.unverified() {
+		// requests admitted under grace mode, below the velocity trigger or
+		// while siteverify is unreachable are not verified
+		if router.unverified.serves(d.Reason) {
+			router.unverified.proxy.ServeHTTP(rw, req)
+			return
+		}
+		a.next.ServeHTTP(rw, req)
 		return
 	}
-	// Check if verification was successful
-	if !turnstileResp.Success {
-		errorHandler(rw, http.StatusBadRequest, fmt.Sprintf("Verification failed: %s", turnstileResp.ErrorCodes))
-		return
+	a.forward(rw, req, router)
+}
+
+// decide determines whether a request to a protected router is allowed.
+// It may set session cookies on rw but never writes the response itself.
+func (a *turnstile) decide(rw http.ResponseWriter, req *http.Request, router *Router) *decision {
+	banKey := a.bans.banKey(req)
+	if d := a.screen(req, banKey); d != nil {
+		return d
+	}
+	if router.action == actionMaintenance {
+		return reject(ReasonMaintenance, http.StatusServiceUnavailable, "Temporarily unavailable")
+	}
+	if len(a.trustedIPs) > 0 && containsIP(a.trustedIPs, clientIP(req)) {
+		return allow(ReasonTrustedIP)
+	}
+	if a.signedBypass.allows(req) {
+		return allow(ReasonSignedBypass)
+	}
+	if a.clientCerts.allows(req) {
+		return allow(ReasonClientCert)
+	}
+	if a.apiKeys.allows(req) {
+		return allow(ReasonAPIKey)
+	}
+	if a.authSession.allows(req) {
+		return allow(ReasonAuthSession)
+	}
+	if a.bots.allows(req) {
+		return allow(ReasonVerifiedBot)
+	}
+	if err := a.hooks.match(req, router); err != nil {
+		return reject(ReasonHookRejected, http.StatusForbidden, err.Error())
+	}
+
+	if a.sessions != nil {
+		if claims, ok := a.sessions.validate(req); ok {
+			a.sessions.refresh(rw, claims)
+			return allow(ReasonSession)
+		}
+		if a.grace != nil && a.grace.isActive() && a.sessions.isValidWithin(req, a.grace.extension) {
+			a.grace.audit(req, "session", nil, nil)
+			return allow(ReasonGrace)
+		}
+	}
+
+	if router.PreClearance && a.preClearance.isCleared(req) {
+		return allow(ReasonPreClearance)
+	}
+
+	if router.velocity != nil && a.isLowVelocity(router, a.clientIdentity(router, req)) {
+		return allow(ReasonLowVelocity)
 	}
-	a.next.ServeHTTP(rw, req)
 
+	if a.maxBodyBytes > 0 && !router.TokenInHeaderOnly && req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength > a.maxBodyBytes {
+			// the declared length is known to exceed the limit, do not read anything
+			return reject(ReasonMalformedRequest, http.StatusRequestEntityTooLarge, ErrBodyTooLarge.Error())
+		}
+		req.Body = http.MaxBytesReader(rw, req.Body, a.maxBodyBytes)
+	}
+
+	extraction := router.extractToken(req)
+	router.metrics.observeExtraction(extraction)
+	if extraction.Err != nil {
+		status := http.StatusBadRequest
+		if extraction.Err == ErrBodyTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		d := reject(extraction.reason(), status, extraction.Err.Error())
+		if extraction.Err == ErrTokenMissing && a.interstitial.applies(req, router) {
+			d.Status, d.Message, d.Interstitial = http.StatusForbidden, "Challenge required", true
+		}
+		if extraction.Err == ErrTokenMissing && a.redirect.applies(req) {
+			d.Status, d.Message, d.Redirect = http.StatusFound, "Challenge required", true
+		}
+		return d
+	}
+
+	turnstileResp, err := a.siteverify(req, router, extraction.Token)
+	if d := a.throttled(err); d != nil {
+		if errors.Is(err, errVerifyRateLimited) && a.verifyLimit.policy == rateLimitPolicyOpen {
+			d = allow(ReasonFailOpen)
+			d.Err = err
+		}
+		return d
+	}
+	if a.grace != nil && a.grace.isActive() {
+		// during announced maintenance new tokens are admitted in shadow,
+		// the verification outcome is only recorded in the audit trail
+		a.grace.audit(req, "token", turnstileResp, err)
+		d := allow(ReasonGrace)
+		d.Err = err
+		if turnstileResp != nil {
+			d.ErrorCodes = turnstileResp.ErrorCodes
+			d.ChallengeTS = turnstileResp.ChallengeTS
+		}
+		return d
+	}
+	if err != nil {
+		d := reject(ReasonVerificationError, http.StatusInternalServerError, err.Error())
+		d.RetryAfter = retryAfterOf(err, a.retryAfter)
+		if a.failOpen {
+			d = allow(ReasonFailOpen)
+		}
+		d.Err = err
+		return d
+	}
+	if !turnstileResp.Success {
+		return a.verificationFailed(req, turnstileResp, banKey)
+	}
+	return a.verified(rw, req, turnstileResp, banKey)
 }
 
-func errorHandler(rw http.ResponseWriter, code int, msg string) {
-	rw.Header().Set("Content-Type", "application/json")
-	rw.WriteHeader(code)
-	_ = json.NewEncoder(rw).Encode(map[string]string{"error": msg})
+// screen rejects clients listed in blockedips or banned after failed
+// verifications, nil when neither applies. Bans apply before anything
+// admitting a request without a token.
+func (a *turnstile) screen(req *http.Request, banKey string) *decision {
+	if len(a.blockedIPs) > 0 && containsIP(a.blockedIPs, clientIP(req)) {
+		return reject(ReasonBlockedIP, a.blockedStatus, "Access denied")
+	}
+	if remaining := a.bans.remaining(banKey); remaining > 0 {
+		d := reject(ReasonBanned, a.bans.status, "Too many failed verifications")
+		d.RetryAfter = remaining
+		return d
+	}
+	return nil
 }
 
-func (a *turnstile) isProtectedPath(req *http.Request) (*Router, bool) {
-	for _, router := range a.protectedRouters {
-		if router.isMatch(req) {
-			return &router, true
+// siteverify verifies token with the secret of router within verifyratelimit
+// and maxconcurrentverifications, recording the call in metrics and traces.
+// A throttled call returns errVerifyRateLimited or errVerifySaturated
+// without reaching siteverify.
+func (a *turnstile) siteverify(req *http.Request, router *Router, token string) (*VerifyResponse, error) {
+	if err := a.verifyLimit.take(req.Context()); err != nil {
+		return nil, err
+	}
+	if err := a.verifySlots.acquire(req.Context()); err != nil {
+		return nil, err
+	}
+	secret := router.secret
+	if secret == nil {
+		secret = a.secrets.forHost(req.Host)
+	}
+	verifySpan := spanFromContext(req.Context()).child("turnstile siteverify", spanKindClient)
+	verifyStart := time.Now()
+	turnstileResp, err := a.verifier.verify(req.Context(), secret, token)
+	verifyDuration := time.Since(verifyStart)
+	a.verifySlots.release()
+	router.metrics.observeVerification(turnstileResp, err, verifyDuration)
+	a.statsD.observeVerification(router, turnstileResp, err, verifyDuration)
+	switch {
+	case err != nil:
+		verifySpan.setError(err.Error())
+	case !turnstileResp.Success:
+		verifySpan.setAttributes(otlpStrings("turnstile.error_codes", turnstileResp.ErrorCodes))
+	}
+	verifySpan.end()
+	if turnstileResp != nil && !turnstileResp.Success {
+		router.metrics.observeErrorCodes(turnstileResp.ErrorCodes)
+		if turnstileResp.hasErrorCode(errorCodeInvalidSecret) {
+			a.alertInvalidSecret(req, router)
 		}
 	}
-	return nil, false
+	return turnstileResp, err
 }
 
-type turnstileResponse struct {
-	Success     bool     `json:"success"`
-	ErrorCodes  []string `json:"error-codes"`
-	ChallengeTS string   `json:"challenge_ts"`
-	Hostname    string   `json:"hostname"`
+// throttled returns the rejection of a verification refused by siteverify,
+// nil for any other error.
+func (a *turnstile) throttled(err error) *decision {
+	var d *decision
+	switch {
+	case errors.Is(err, errVerifyRateLimited):
+		d = reject(ReasonVerificationError, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, errVerifySaturated):
+		d = reject(ReasonVerificationError, http.StatusTooManyRequests, err.Error())
+	default:
+		return nil
+	}
+	d.RetryAfter = time.Second
+	d.Err = err
+	return d
 }
 
-func copyRequest(req *http.Request) (*http.Request, error) {
-	// Read the request body
-	bodyBytes, err := io.ReadAll(req.Body)
-	if err != nil {
-		return nil, err
+// verificationFailed rejects a token refused by siteverify, counting the
+// failure towards the client's tarpit and ban unless siteverify is at fault.
+func (a *turnstile) verificationFailed(req *http.Request, turnstileResp *VerifyResponse, banKey string) *decision {
+	status := errorCodeStatus(a.errorCodeStatuses, turnstileResp.ErrorCodes)
+	d := reject(ReasonVerificationFailed, status, fmt.Sprintf("Verification failed: %s", turnstileResp.ErrorCodes))
+	d.ErrorCodes = turnstileResp.ErrorCodes
+	d.ChallengeTS = turnstileResp.ChallengeTS
+	switch {
+	case turnstileResp.hasErrorCode(errorCodeInternalError):
+		d.RetryAfter = a.retryAfter
+	case turnstileResp.hasErrorCode(errorCodeInvalidSecret):
+		// a rejected secret is not the client's fault
+	default:
+		d.Tarpit = a.observeFailure(req)
+		if a.bans.fail(banKey) {
+			logger().WarnContext(req.Context(), "client banned after consecutive failed verifications",
+				"client_ip", banKey, "cooldown", a.bans.cooldown.String())
+		}
 	}
+	return d
+}
 
-	// Restore the original request's body for further use
-	err = req.Body.Close()
-	if err != nil {
-		return nil, err
+// verified admits a request with a verified token, issuing a session when sessions are enabled.
+func (a *turnstile) verified(rw http.ResponseWriter, req *http.Request, turnstileResp *VerifyResponse, banKey string) *decision {
+	a.bans.succeed(banKey)
+	if a.sessions != nil {
+		a.sessions.issue(rw, req)
 	}
-	req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	d := allow(ReasonVerified)
+	d.ChallengeTS = turnstileResp.ChallengeTS
+	return d
+}
 
-	// Create a new request with the same body
-	newReq, err := http.NewRequest(req.Method, req.URL.String(), bytes.NewBuffer(bodyBytes))
-	if err != nil {
-		return nil, err
+// report records the decision on req in logs, metrics, events and the decision header.
+func (a *turnstile) report(rw http.ResponseWriter, req *http.Request, router *Router, d *decision, start time.Time) {
+	d.Duration = time.Since(start)
+	a.latency.observe(d.Duration)
+	a.stats.record(d.Reason, start)
+	router.metrics.observeDecision(d)
+	a.statsD.observeDecision(router, d)
+	a.logDecision(req, router, d)
+	a.record(req, router, d)
+	a.hooks.decided(req, router, d)
+	a.setDecisionHeader(rw, d)
+}
+
+// forward passes a verified request to the next handler through the router's response transformers.
+func (a *turnstile) forward(rw http.ResponseWriter, req *http.Request, router *Router) {
+	finishers := make([]func(), 0, len(router.transformers))
+	for _, transformer := range router.transformers {
+		var finish func()
+		rw, finish = transformer.Wrap(rw, req)
+		finishers = append(finishers, finish)
+	}
+	a.next.ServeHTTP(rw, req)
+	// finish the innermost writer first so outer transformers see its output
+	for i := len(finishers) - 1; i >= 0; i-- {
+		finishers[i]()
 	}
+}
 
-	// Copy headers
-	for name, values := range req.Header {
-		newReq.Header[name] = values
+// clientIdentity returns the abuse-tracking identity of the client sending req.
+func (a *turnstile) clientIdentity(router *Router, req *http.Request) string {
+	cookieName := defaultSessionCookieName
+	if a.sessions != nil {
+		cookieName = a.sessions.cookie.Name
 	}
+	return router.identity.derive(req, cookieName)
+}
 
-	return newReq, nil
+// errorHandler writes a JSON error response, including the request ID of req when it has one.
+func errorHandler(rw http.ResponseWriter, req *http.Request, code int, msg string) {
+	body := map[string]string{"error": msg}
+	if id := requestIDFromContext(req.Context()); id != "" {
+		body["request_id"] = id
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	_ = json.NewEncoder(rw).Encode(body)
 }
@@ -0,0 +1,180 @@
+package turnstile
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// configErrors aggregates every problem found in a configuration, so a
+// misconfiguration is reported in full when the plugin loads instead of one
+// problem per reload.
+type configErrors []error
+
+// add appends err, flattening nested configErrors, nil is ignored.
+func (e *configErrors) add(err error) {
+	var nested configErrors
+	if errors.As(err, &nested) {
+		*e = append(*e, nested...)
+		return
+	}
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// wrap returns the problems prefixed with context, or nil when there are none.
+func (e configErrors) wrap(context string) error {
+	if len(e) == 0 {
+		return nil
+	}
+	wrapped := make(configErrors, len(e))
+	for i, err := range e {
+		wrapped[i] = fmt.Errorf("%s: %w", context, err)
+	}
+	return wrapped
+}
+
+// err returns the problems as an error, or nil when there are none.
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e configErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d configuration problems: %s", len(e), strings.Join(messages, "; "))
+}
+
+// Unwrap lets errors.Is and errors.As inspect every problem.
+func (e configErrors) Unwrap() []error {
+	return e
+}
+
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// validateRouter reports the problems of a compiled router that compiling it
+// does not catch. Token sources are only checked for routers that verify
+// tokens, not for excluded routers.
+func validateRouter(r *Router, verifies bool) error {
+	var problems configErrors
+	switch {
+	case r.Path == "" && r.PathRegexp == "":
+		problems.add(errors.New("path or pathregexp is required"))
+	case r.Path != "" && r.PathRegexp != "":
+		problems.add(errors.New("path and pathregexp are mutually exclusive"))
+	}
+	for _, method := range r.methods {
+		if !knownMethods[method] {
+			problems.add(fmt.Errorf("unknown method %s", method))
+		}
+	}
+	if verifies {
+		switch {
+		case r.Envelope != nil && (len(tokenKeys(r)) > 0 || len(r.TokenSources) > 0):
+			problems.add(errors.New("envelope is mutually exclusive with headerkey, formkey, cookiekey, querykey, jsonkey, graphql, authscheme, tokenexpr, tokenfirstpart and tokensources"))
+		case r.TokenExpr != "" && len(r.TokenSources) > 0:
+			problems.add(errors.New("tokenexpr is mutually exclusive with tokensources, use ?? to try several sources"))
+		case len(r.TokenSources) > 0 || len(r.tokenSources) > 0:
+			if hasSource(r.tokenSources, SourceHeader) != (r.HeaderKey != "") {
+				problems.add(errors.New("tokensources must list header exactly when headerkey is set"))
+			}
+			if hasSource(r.tokenSources, SourceGraphQL) != (r.GraphQL != nil) {
+				problems.add(errors.New("tokensources must list graphql exactly when graphql is set"))
+			}
+		case len(tokenKeys(r)) > 1:
+			problems.add(fmt.Errorf("%s are mutually exclusive, list several sources in tokensources instead", strings.Join(tokenKeys(r), ", ")))
+		}
+		if r.TokenInHeaderOnly && r.readsBody() {
+			problems.add(errors.New("tokeninheaderonly requires a token source outside the body: headerkey, authscheme, cookiekey, querykey or an envelope header"))
+		}
+	}
+	return problems.wrap("router " + r.label())
+}
+
+// tokenKeys returns the options of r that select a single token source.
+func tokenKeys(r *Router) []string {
+	var keys []string
+	if r.HeaderKey != "" {
+		keys = append(keys, "headerkey")
+	}
+	if r.CookieKey != "" {
+		keys = append(keys, "cookiekey")
+	}
+	if r.QueryKey != "" {
+		keys = append(keys, "querykey")
+	}
+	if r.JSONKey != "" {
+		keys = append(keys, "jsonkey")
+	}
+	if r.GraphQL != nil {
+		keys = append(keys, "graphql")
+	}
+	if r.AuthScheme != "" {
+		keys = append(keys, "authscheme")
+	}
+	if r.TokenExpr != "" {
+		keys = append(keys, "tokenexpr")
+	}
+	switch {
+	case r.FormKey != "" || len(r.FormKeys) > 0:
+		keys = append(keys, "formkey")
+	case r.TokenFirstPart:
+		keys = append(keys, "tokenfirstpart")
+	}
+	return keys
+}
+
+// legacyHeaderAndForm reports whether r combines headerkey and formkey without
+// tokensources, which earlier releases documented for mixed usage. Such
+// routers read the header first and fall back to the form.
+func legacyHeaderAndForm(r *Router) bool {
+	keys := tokenKeys(r)
+	return len(r.TokenSources) == 0 && r.Envelope == nil &&
+		len(keys) == 2 && keys[0] == "headerkey" && keys[1] == "formkey"
+}
+
+func hasSource(sources []TokenSource, source TokenSource) bool {
+	for _, s := range sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEndpoint reports whether value, the URL configured for option, is
+// an absolute http(s) URL.
+func validateEndpoint(option, value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", option, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid %s: %s is not an absolute http or https URL", option, value)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package turnstile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultVaultKey     = "secret"
+	defaultVaultRefresh = 5 * time.Minute
+	vaultTimeout        = 10 * time.Second
+)
+
+// VaultConfig reads the Turnstile secret from a HashiCorp Vault KV secret.
+type VaultConfig struct {
+	// Address is the Vault server, e.g. https://vault.example.com:8200
+	Address string `yaml:"address"`
+	// Token authenticates with Vault, it may be a ${env:NAME} reference, if not provided, ${env:VAULT_TOKEN} will be used
+	Token string `yaml:"token"`
+	// Namespace is the Vault Enterprise namespace, if not provided, the root namespace will be used
+	Namespace string `yaml:"namespace"`
+	// Path is the API path of the secret, e.g. secret/data/turnstile for KV v2 or secret/turnstile for KV v1
+	Path string `yaml:"path"`
+	// Key is the field of the secret holding the Turnstile secret, if not provided, secret will be used
+	Key string `yaml:"key"`
+	// Refresh is how often the secret is read again and the token renewed, if not provided, 5m will be used
+	Refresh string `yaml:"refresh"`
+}
+
+// vaultSecret is a secret read from Vault and refreshed in the background, so
+// it can be rotated in Vault without touching the dynamic configuration.
+type vaultSecret struct {
+	url       string
+	renewURL  string
+	token     string
+	namespace string
+	key       string
+	refresh   time.Duration
+	client    *http.Client
+	current   atomic.Value
+}
+
+func loadVaultSecret(config *VaultConfig) (*vaultSecret, error) {
+	if err := validateEndpoint("vault.address", config.Address); err != nil {
+		return nil, err
+	}
+	if config.Address == "" || config.Path == "" {
+		return nil, errors.New("vault.address and vault.path are required")
+	}
+	tokenRef := config.Token
+	if tokenRef == "" {
+		tokenRef = "${env:VAULT_TOKEN}"
+	}
+	token, err := resolveSecretRef("vault.token", tokenRef)
+	if err != nil {
+		return nil, err
+	}
+	address := strings.TrimSuffix(config.Address, "/")
+	s := &vaultSecret{
+		url:       address + "/v1/" + strings.Trim(config.Path, "/"),
+		renewURL:  address + "/v1/auth/token/renew-self",
+		token:     token,
+		namespace: config.Namespace,
+		key:       config.Key,
+		refresh:   defaultVaultRefresh,
+		client:    &http.Client{Timeout: vaultTimeout},
+	}
+	if s.key == "" {
+		s.key = defaultVaultKey
+	}
+	if config.Refresh != "" {
+		if s.refresh, err = time.ParseDuration(config.Refresh); err != nil {
+			return nil, fmt.Errorf("invalid vault.refresh: %w", err)
+		}
+		if s.refresh <= 0 {
+			return nil, errors.New("vault.refresh must be positive")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+	if err := s.reload(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read the secret from vault: %w", err)
+	}
+	return s, nil
+}
+
+func (s *vaultSecret) secret() string {
+	return s.current.Load().(string)
+}
+
+// watch renews the token and reads the secret again every refresh interval
+// until ctx is done. The last secret stays in use while Vault is unreachable.
+func (s *vaultSecret) watch(ctx context.Context) {
+	background.schedule(ctx, "vault-secret-refresh", s.refresh, func() {
+		if err := s.renew(ctx); err != nil {
+			logger().Warn("failed to renew the vault token", "error", err)
+		}
+		if err := s.reload(ctx); err != nil {
+			logger().Warn("keeping the current secret, failed to read it from vault", "error", err)
+		}
+	})
+}
+
+// reload reads the secret, supporting both KV v1 and KV v2 responses.
+func (s *vaultSecret) reload(ctx context.Context) error {
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := s.do(ctx, http.MethodGet, s.url, &body); err != nil {
+		return err
+	}
+	fields := body.Data
+	// KV v2 nests the fields under data.data next to data.metadata
+	if nested, ok := fields["data"]; ok && fields["metadata"] != nil {
+		fields = nil
+		if err := json.Unmarshal(nested, &fields); err != nil {
+			return fmt.Errorf("malformed KV v2 secret: %w", err)
+		}
+	}
+	var value string
+	if raw, ok := fields[s.key]; !ok || json.Unmarshal(raw, &value) != nil {
+		return fmt.Errorf("the secret has no string field %q", s.key)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fmt.Errorf("field %q of the secret is empty", s.key)
+	}
+	redactor.add(value)
+	s.current.Store(value)
+	return nil
+}
+
+// renew extends the TTL of the token, tokens that are not renewable are
+// reported as errors by Vault and only logged.
+func (s *vaultSecret) renew(ctx context.Context) error {
+	return s.do(ctx, http.MethodPost, s.renewURL, nil)
+}
+
+func (s *vaultSecret) do(ctx context.Context, method, url string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	if s.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.namespace)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault returned %s", resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,43 @@
+package turnstile
+
+import (
+	"fmt"
+	"time"
+)
+
+// VelocityConfig only challenges clients sending more than Requests requests within Window.
+type VelocityConfig struct {
+	Requests int64 `yaml:"requests"`
+	// Window is the sliding window requests are counted in, if not provided, 1m will be used
+	Window string `yaml:"window"`
+}
+
+type velocity struct {
+	requests int64
+	window   time.Duration
+}
+
+func newVelocity(config *VelocityConfig) (*velocity, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if config.Requests <= 0 {
+		return nil, fmt.Errorf("velocity requests must be positive")
+	}
+	v := &velocity{requests: config.Requests, window: time.Minute}
+	if config.Window != "" {
+		window, err := time.ParseDuration(config.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid velocity window: %s", config.Window)
+		}
+		v.window = window
+	}
+	return v, nil
+}
+
+// isLowVelocity counts a request of identity on router and reports whether the client is
+// still below the velocity that triggers a challenge.
+func (a *turnstile) isLowVelocity(router *Router, identity string) bool {
+	count := a.store.increment("velocity|"+router.label()+"|"+identity, router.velocity.window)
+	return count <= router.velocity.requests
+}
@@ -0,0 +1,352 @@
+package turnstile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVerifyTimeout = 5 * time.Second
+	defaultVerifyRetries = 2
+	// verifyRetryBackoff is multiplied by the attempt number between retries
+	verifyRetryBackoff = 100 * time.Millisecond
+	// errorCodeInvalidSecret is reported by siteverify for an unknown or revoked secret
+	errorCodeInvalidSecret = "invalid-input-secret"
+	// errorCodeInternalError is reported by siteverify for a transient failure on its side
+	errorCodeInternalError = "internal-error"
+	defaultRetryAfter      = 30 * time.Second
+	// maxRetryAfter caps the delay requested by siteverify
+	maxRetryAfter = time.Hour
+)
+
+// failure policies applied when siteverify cannot be reached
+const (
+	failurePolicyClosed = "closed"
+	failurePolicyOpen   = "open"
+)
+
+// VerifyResponse is the siteverify result for a token.
+type VerifyResponse struct {
+	Success     bool     `json:"success"`
+	ErrorCodes  []string `json:"error-codes"`
+	ChallengeTS string   `json:"challenge_ts"`
+	Hostname    string   `json:"hostname"`
+}
+
+// hasErrorCode reports whether siteverify returned code.
+func (r *VerifyResponse) hasErrorCode(code string) bool {
+	for _, c := range r.ErrorCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamError is a siteverify response worth retrying later, a 5xx or 429.
+type upstreamError struct {
+	message string
+	// retryAfter is the delay requested by siteverify, 0 when it requested none
+	retryAfter time.Duration
+}
+
+func (e *upstreamError) Error() string {
+	return e.message
+}
+
+// verifier calls the siteverify API.
+type verifier struct {
+	url    string
+	secret secretSource
+	// secondary is tried when siteverify rejects secret, nil when no rotation is in progress
+	secondary secretSource
+	client    *http.Client
+	// retries is the number of additional attempts after a transport error or 5xx response
+	retries int
+	// requestIDHeader carries the request ID of the protected request to siteverify
+	requestIDHeader string
+}
+
+func newVerifier(config *Config, secret secretSource) (*verifier, error) {
+	if err := validateEndpoint("verifyurl", config.VerifyURL); err != nil {
+		return nil, err
+	}
+	v := &verifier{
+		url:     config.VerifyURL,
+		secret:  secret,
+		client:  &http.Client{Timeout: defaultVerifyTimeout},
+		retries: config.VerifyRetries,
+
+		requestIDHeader: config.RequestIDHeader,
+	}
+	if v.url == "" {
+		v.url = defaultVerifyURL
+	}
+	if v.requestIDHeader == "" {
+		v.requestIDHeader = defaultRequestIDHeader
+	}
+	if config.TurnstileSecondarySecret != "" {
+		value, err := resolveSecretRef("turnstilesecondarysecret", config.TurnstileSecondarySecret)
+		if err != nil {
+			return nil, err
+		}
+		v.secondary = staticSecret(value)
+	}
+	if config.VerifyTimeout != "" {
+		timeout, err := time.ParseDuration(config.VerifyTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verifytimeout: %w", err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("verifytimeout must be positive")
+		}
+		v.client.Timeout = timeout
+	}
+	switch {
+	case v.retries == 0:
+		v.retries = defaultVerifyRetries
+	case v.retries < 0:
+		// a negative count disables retries, 0 means the default
+		v.retries = 0
+	}
+	return v, nil
+}
+
+// Verifier verifies Turnstile tokens with the secret, siteverify endpoint,
+// timeout and retries of a Config, so applications can verify tokens outside
+// a middleware. Build it once and reuse it: the secret is resolved and cached
+// by the Verifier, and connections to siteverify are kept alive.
+type Verifier struct {
+	verifier *verifier
+}
+
+// NewVerifier returns a Verifier for the settings of config.
+func NewVerifier(config *Config) (*Verifier, error) {
+	secret, err := newSecretSource(config)
+	if err != nil {
+		return nil, err
+	}
+	v, err := newVerifier(config, secret)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{verifier: v}, nil
+}
+
+// Verify verifies token with siteverify.
+func (v *Verifier) Verify(ctx context.Context, token string) (*VerifyResponse, error) {
+	return v.verifier.verify(ctx, nil, token)
+}
+
+// VerifyToken verifies a single token with the settings of config. It builds
+// a new Verifier on every call, resolving the secret again, which suits a
+// static turnstilesecret; with turnstilesecretfile, vault or secretref, build
+// a Verifier once with NewVerifier instead.
+func VerifyToken(ctx context.Context, config *Config, token string) (*VerifyResponse, error) {
+	v, err := NewVerifier(config)
+	if err != nil {
+		return nil, err
+	}
+	return v.Verify(ctx, token)
+}
+
+// verify validates token against the siteverify API with secret, or with the
+// default secret when secret is nil. When siteverify rejects the default
+// secret and a secondary secret is configured, the token is verified again
+// with it, so the secret can be rotated without downtime.
+func (v *verifier) verify(ctx context.Context, secret secretSource, token string) (*VerifyResponse, error) {
+	if secret == nil {
+		secret = v.secret
+	}
+	if secret == nil {
+		return nil, errors.New("No secret configured for this host")
+	}
+	resp, err := v.verifyWith(ctx, secret, token)
+	if err == nil && secret == v.secret && v.secondary != nil && !resp.Success && resp.hasErrorCode(errorCodeInvalidSecret) {
+		return v.verifyWith(ctx, v.secondary, token)
+	}
+	return resp, err
+}
+
+// verifyWith validates token with secret. Transport errors and 5xx responses
+// are retried with the same idempotency key, so siteverify answers a retry
+// instead of reporting the token as already used.
+func (v *verifier) verifyWith(ctx context.Context, secret secretSource, token string) (*VerifyResponse, error) {
+	form := url.Values{}
+	form.Add("secret", secret.secret())
+	form.Add("response", token)
+	if key, err := newUUID(); err == nil {
+		form.Add("idempotency_key", key)
+	}
+	body := form.Encode()
+
+	var resp *VerifyResponse
+	var err error
+	for attempt := 0; attempt <= v.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, errors.New("Failed to verify token")
+			case <-time.After(time.Duration(attempt) * verifyRetryBackoff):
+			}
+		}
+		var retry bool
+		resp, retry, err = v.attempt(ctx, body)
+		if !retry {
+			break
+		}
+	}
+	return resp, err
+}
+
+// attempt performs one siteverify call and reports whether it may be retried.
+func (v *verifier) attempt(ctx context.Context, body string) (*VerifyResponse, bool, error) {
+	// create request with form data
+	myreq, err := http.NewRequestWithContext(ctx, "POST", v.url, strings.NewReader(body))
+	if err != nil {
+		return nil, false, errors.New("Failed to create verification request")
+	}
+	myreq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if id := requestIDFromContext(ctx); id != "" {
+		myreq.Header.Set(v.requestIDHeader, id)
+	}
+
+	// Send the request
+	resp, err := v.client.Do(myreq)
+	if err != nil {
+		return nil, ctx.Err() == nil, errors.New("Failed to verify token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		err := &upstreamError{
+			message:    fmt.Sprintf("Verification API returned %s", resp.Status),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+		// retrying a rate limited call right away only extends the limit
+		return nil, resp.StatusCode != http.StatusTooManyRequests, err
+	}
+
+	// Read the response
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, errors.New("Failed to read verification response")
+	}
+
+	// Parse the response
+	var turnstileResp VerifyResponse
+	if err := json.Unmarshal(data, &turnstileResp); err != nil {
+		return nil, false, errors.New("Failed to parse verification response")
+	}
+	return &turnstileResp, false, nil
+}
+
+// newUUID returns a random UUID, e.g. to identify one verification across retries.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// parseRetryAfter returns the delay of a Retry-After header in seconds or as
+// an HTTP date, or 0 when it is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// parseRetryAfterSetting parses the retryafter option.
+func parseRetryAfterSetting(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultRetryAfter, nil
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid retryafter: %w", err)
+	}
+	if delay < time.Second {
+		return 0, fmt.Errorf("retryafter must be at least 1s")
+	}
+	return delay, nil
+}
+
+// retryAfterOf returns the delay clients are asked to wait after err, the
+// delay requested by siteverify when it sent one, or fallback.
+func retryAfterOf(err error, fallback time.Duration) time.Duration {
+	var upstream *upstreamError
+	if errors.As(err, &upstream) && upstream.retryAfter > 0 {
+		if upstream.retryAfter > maxRetryAfter {
+			return maxRetryAfter
+		}
+		return upstream.retryAfter
+	}
+	return fallback
+}
+
+// parseErrorCodeStatuses validates the statuses siteverify error codes are mapped to.
+func parseErrorCodeStatuses(configured map[string]int) (map[string]int, error) {
+	var problems configErrors
+	for _, code := range sortedCodes(configured) {
+		if status := configured[code]; status < 400 || status > 599 {
+			problems.add(fmt.Errorf("invalid errorcodestatuses.%s: %d is not an error status", code, status))
+		}
+	}
+	return configured, problems.err()
+}
+
+// errorCodeStatus returns the status of the first error code with a mapped
+// status, or 400.
+func errorCodeStatus(statuses map[string]int, codes []string) int {
+	for _, code := range codes {
+		if status, ok := statuses[code]; ok {
+			return status
+		}
+	}
+	return http.StatusBadRequest
+}
+
+func sortedCodes(m map[string]int) []string {
+	codes := make([]string, 0, len(m))
+	for code := range m {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func parseFailurePolicy(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", failurePolicyClosed:
+		return failurePolicyClosed, nil
+	case failurePolicyOpen:
+		return failurePolicyOpen, nil
+	default:
+		return "", fmt.Errorf("invalid failurepolicy: %s", value)
+	}
+}
@@ -0,0 +1,250 @@
+package turnstile
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultWebhookWindow           = 5 * time.Minute
+	defaultWebhookMinVerifications = 20
+	// webhookCheckInterval is how often the failure rate is evaluated
+	webhookCheckInterval = 15 * time.Second
+	webhookTimeout       = 10 * time.Second
+)
+
+// webhook events
+const (
+	webhookEventVerificationFailed = "verification-failed"
+	webhookEventFailureRate        = "failure-rate-exceeded"
+	webhookEventInvalidSecret      = "invalid-secret"
+)
+
+// secretAlertInterval limits alerts about a secret rejected by siteverify,
+// which would otherwise be raised by every request.
+const secretAlertInterval = time.Minute
+
+// WebhookConfig sends HMAC-signed notifications about failed verifications,
+// so security teams can alert on bot waves.
+type WebhookConfig struct {
+	// URL receives the notifications as JSON POST requests
+	URL string `yaml:"url"`
+	// Secret signs every payload with HMAC-SHA256, it may be a ${env:NAME} reference
+	Secret string `yaml:"secret"`
+	// FailureRate is the share of failed verifications, e.g. 0.5, that triggers a notification when crossed,
+	// if not provided, every failed verification will be notified
+	FailureRate float64 `yaml:"failurerate"`
+	// Window is the interval the failure rate is evaluated over, between 1m and 15m, if not provided, 5m will be used
+	Window string `yaml:"window"`
+	// MinVerifications is the number of verifications in the window below which the rate is not evaluated,
+	// if not provided, 20 will be used
+	MinVerifications int `yaml:"minverifications"`
+}
+
+// webhookPayload is the JSON body of a notification, fields not belonging
+// to the event are omitted.
+type webhookPayload struct {
+	Event      string `json:"event"`
+	Time       string `json:"time"`
+	Middleware string `json:"middleware"`
+	// fields of verification-failed
+	Route      string   `json:"route,omitempty"`
+	ClientIP   string   `json:"client_ip,omitempty"`
+	RequestID  string   `json:"request_id,omitempty"`
+	ErrorCodes []string `json:"error_codes,omitempty"`
+	// fields of failure-rate-exceeded
+	Window        string  `json:"window,omitempty"`
+	Verifications uint64  `json:"verifications,omitempty"`
+	Failures      uint64  `json:"failures,omitempty"`
+	FailureRate   float64 `json:"failure_rate,omitempty"`
+	Threshold     float64 `json:"threshold,omitempty"`
+}
+
+// webhookNotifier posts signed notifications to the webhook.
+type webhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+	name   string
+	// failureRate is the threshold, 0 notifies every failed verification
+	failureRate      float64
+	windowMinutes    int
+	minVerifications uint64
+
+	stats *decisionStats
+	// exceeded is set while the failure rate is above the threshold, it is
+	// only accessed by the serialized evaluation
+	exceeded bool
+}
+
+// newWebhookNotifier returns nil when no webhook is configured.
+func newWebhookNotifier(config *Config, name string) (*webhookNotifier, error) {
+	if config.Webhook == nil {
+		return nil, nil
+	}
+	var problems configErrors
+	problems.add(validateEndpoint("webhook.url", config.Webhook.URL))
+	if config.Webhook.URL == "" {
+		problems.add(errors.New("webhook.url cannot be empty"))
+	}
+	secret, err := resolveSecretRef("webhook.secret", config.Webhook.Secret)
+	problems.add(err)
+	if err == nil && secret == "" {
+		problems.add(errors.New("webhook.secret cannot be empty, payloads are always signed"))
+	}
+	if config.Webhook.FailureRate < 0 || config.Webhook.FailureRate > 1 {
+		problems.add(fmt.Errorf("invalid webhook.failurerate: %v is not between 0 and 1", config.Webhook.FailureRate))
+	}
+	window := defaultWebhookWindow
+	if config.Webhook.Window != "" {
+		window, err = time.ParseDuration(config.Webhook.Window)
+		if err != nil || window < time.Minute || window > statsMinutes*time.Minute {
+			problems.add(fmt.Errorf("invalid webhook.window: %s is not between 1m and %dm", config.Webhook.Window, statsMinutes))
+		}
+	}
+	minVerifications := config.Webhook.MinVerifications
+	switch {
+	case minVerifications == 0:
+		minVerifications = defaultWebhookMinVerifications
+	case minVerifications < 0:
+		problems.add(fmt.Errorf("invalid webhook.minverifications: %d", minVerifications))
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return &webhookNotifier{
+		url:              config.Webhook.URL,
+		secret:           []byte(secret),
+		client:           &http.Client{Timeout: webhookTimeout},
+		name:             name,
+		failureRate:      config.Webhook.FailureRate,
+		windowMinutes:    int(window / time.Minute),
+		minVerifications: uint64(minVerifications),
+	}, nil
+}
+
+// start evaluates the failure rate of stats until ctx is done, when a threshold is configured.
+func (w *webhookNotifier) start(ctx context.Context, stats *decisionStats) {
+	if w == nil || w.failureRate == 0 {
+		return
+	}
+	w.stats = stats
+	background.schedule(ctx, "webhook-failure-rate", webhookCheckInterval, w.evaluate)
+}
+
+// observe notifies a failed verification when no threshold is configured.
+func (w *webhookNotifier) observe(req *http.Request, router *Router, d *decision) {
+	if w.failureRate != 0 || d.Reason != ReasonVerificationFailed {
+		return
+	}
+	payload := webhookPayload{
+		Event:      webhookEventVerificationFailed,
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Middleware: w.name,
+		Route:      router.label(),
+		ClientIP:   clientIP(req).String(),
+		RequestID:  requestIDFromContext(req.Context()),
+		ErrorCodes: d.ErrorCodes,
+	}
+	background.submit("webhook", func() { w.send(payload) })
+}
+
+// evaluate notifies once when the failure rate crosses the threshold, and
+// again only after it fell below the threshold in between.
+func (w *webhookNotifier) evaluate() {
+	counts := w.stats.since(w.windowMinutes, time.Now())
+	failures := counts[ReasonVerificationFailed]
+	verifications := failures + counts[ReasonVerified]
+	if verifications < w.minVerifications {
+		w.exceeded = false
+		return
+	}
+	rate := float64(failures) / float64(verifications)
+	if rate < w.failureRate {
+		w.exceeded = false
+		return
+	}
+	if w.exceeded {
+		return
+	}
+	w.exceeded = true
+	w.send(webhookPayload{
+		Event:         webhookEventFailureRate,
+		Time:          time.Now().UTC().Format(time.RFC3339),
+		Middleware:    w.name,
+		Window:        (time.Duration(w.windowMinutes) * time.Minute).String(),
+		Verifications: verifications,
+		Failures:      failures,
+		FailureRate:   rate,
+		Threshold:     w.failureRate,
+	})
+}
+
+// send posts payload, signed with the timestamp so receivers can reject replays.
+func (w *webhookNotifier) send(payload webhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger().Error("failed to encode webhook payload", "error", err)
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		logger().Error("failed to create webhook request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Turnstile-Timestamp", timestamp)
+	req.Header.Set("X-Turnstile-Signature", "sha256="+signWebhook(w.secret, timestamp, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		logger().Warn("failed to send webhook notification", "event", payload.Event, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger().Warn("webhook rejected the notification", "event", payload.Event, "status", resp.Status)
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>".
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// alertInvalidSecret pages operators when siteverify rejects the secret, a
+// misconfiguration no client can fix: it logs at error level and notifies
+// the webhook, at most once per minute.
+func (a *turnstile) alertInvalidSecret(req *http.Request, router *Router) {
+	now := time.Now().Unix()
+	last := a.secretAlertAt.Load()
+	if now-last < int64(secretAlertInterval/time.Second) || !a.secretAlertAt.CompareAndSwap(last, now) {
+		return
+	}
+	logger().ErrorContext(req.Context(), "siteverify rejected the secret, check the configured secret", "middleware", a.name, "route", router.label(), "host", req.Host)
+	if a.webhook == nil {
+		return
+	}
+	payload := webhookPayload{
+		Event:      webhookEventInvalidSecret,
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Middleware: a.name,
+		Route:      router.label(),
+		RequestID:  requestIDFromContext(req.Context()),
+		ErrorCodes: []string{errorCodeInvalidSecret},
+	}
+	background.submit("webhook", func() { a.webhook.send(payload) })
+}
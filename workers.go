@@ -0,0 +1,167 @@
+package turnstile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	backgroundWorkers   = 4
+	backgroundQueueSize = 256
+)
+
+// background runs every background activity of the plugin (audit writes,
+// notifications, janitors, watchers) on a fixed number of goroutines shared by
+// all middleware instances, so features can't turn into unbounded goroutine
+// sprawl inside Traefik.
+var background = newWorkerPool(backgroundWorkers, backgroundQueueSize)
+
+type backgroundTask struct {
+	name string
+	fn   func()
+}
+
+// taskStats are the per-task-name counters of the worker pool.
+type taskStats struct {
+	submitted atomic.Uint64
+	completed atomic.Uint64
+	panicked  atomic.Uint64
+	dropped   atomic.Uint64
+	// nanoseconds is the total run time of the task
+	nanoseconds atomic.Int64
+}
+
+// workerPool is a bounded pool of goroutines consuming a bounded queue.
+type workerPool struct {
+	workers int
+	queue   chan backgroundTask
+	start   sync.Once
+
+	// stats maps task names to their *taskStats
+	stats sync.Map
+}
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	return &workerPool{
+		workers: workers,
+		queue:   make(chan backgroundTask, queueSize),
+	}
+}
+
+// submit queues fn without blocking, the task is dropped when the queue is full.
+func (p *workerPool) submit(name string, fn func()) bool {
+	p.start.Do(func() {
+		for i := 0; i < p.workers; i++ {
+			go p.work()
+		}
+	})
+	select {
+	case p.queue <- backgroundTask{name: name, fn: fn}:
+		p.taskStats(name).submitted.Add(1)
+		return true
+	default:
+		p.taskStats(name).dropped.Add(1)
+		logger().Warn("background queue full, dropped task", "task", name)
+		return false
+	}
+}
+
+// schedule submits fn every interval until ctx is done. Runs are skipped
+// rather than piled up while a previous run is still queued or running.
+func (p *workerPool) schedule(ctx context.Context, name string, interval time.Duration, fn func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		running := make(chan struct{}, 1)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				select {
+				case running <- struct{}{}:
+				default:
+					continue
+				}
+				if !p.submit(name, func() {
+					defer func() { <-running }()
+					fn()
+				}) {
+					<-running
+				}
+			}
+		}
+	}()
+}
+
+func (p *workerPool) work() {
+	for task := range p.queue {
+		p.run(task)
+	}
+}
+
+// run executes a task, isolating the worker from panics.
+func (p *workerPool) run(task backgroundTask) {
+	start := time.Now()
+	defer func() {
+		stats := p.taskStats(task.name)
+		stats.nanoseconds.Add(int64(time.Since(start)))
+		if r := recover(); r != nil {
+			logger().Error("background task panicked", "task", task.name, "panic", r)
+			stats.panicked.Add(1)
+			return
+		}
+		stats.completed.Add(1)
+	}()
+	task.fn()
+}
+
+func (p *workerPool) taskStats(name string) *taskStats {
+	stats, ok := p.stats.Load(name)
+	if !ok {
+		stats, _ = p.stats.LoadOrStore(name, &taskStats{})
+	}
+	return stats.(*taskStats)
+}
+
+// writeMetrics writes the pool statistics in the Prometheus text exposition format.
+func (p *workerPool) writeMetrics(w io.Writer) {
+	var names []string
+	stats := map[string]*taskStats{}
+	p.stats.Range(func(name, s interface{}) bool {
+		names = append(names, name.(string))
+		stats[name.(string)] = s.(*taskStats)
+		return true
+	})
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP turnstile_background_queue_length Tasks waiting for a background worker.")
+	fmt.Fprintln(w, "# TYPE turnstile_background_queue_length gauge")
+	fmt.Fprintf(w, "turnstile_background_queue_length %d\n", len(p.queue))
+	fmt.Fprintln(w, "# HELP turnstile_background_tasks_total Background tasks by name and outcome.")
+	fmt.Fprintln(w, "# TYPE turnstile_background_tasks_total counter")
+	for _, name := range names {
+		s := stats[name]
+		for _, outcome := range []struct {
+			name  string
+			value uint64
+		}{
+			{"submitted", s.submitted.Load()},
+			{"completed", s.completed.Load()},
+			{"panicked", s.panicked.Load()},
+			{"dropped", s.dropped.Load()},
+		} {
+			fmt.Fprintf(w, "turnstile_background_tasks_total{task=\"%s\",outcome=\"%s\"} %d\n", escapeLabel(name), outcome.name, outcome.value)
+		}
+	}
+	fmt.Fprintln(w, "# HELP turnstile_background_task_seconds_total Time spent running background tasks.")
+	fmt.Fprintln(w, "# TYPE turnstile_background_task_seconds_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "turnstile_background_task_seconds_total{task=\"%s\"} %g\n", escapeLabel(name), time.Duration(stats[name].nanoseconds.Load()).Seconds())
+	}
+}